@@ -0,0 +1,285 @@
+// Package barcodecount is the public API for counting DNA barcodes within sequencing reads.  It allows the counter to be
+// embedded within other Go programs without calling the barcode-count-go binary.  Nothing within this package calls
+// log.Fatal or prints to stdout.  All problems are returned as errors.
+//
+// A Counter is created from a Scheme, the optional sample and counted barcode sets, and Options.  Reads are then counted
+// from a FASTQ io.Reader with CountFastq or from any sequence iterator with CountSequences.
+package barcodecount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+// DefaultErrors is used within Options to allow the default number of sequencing errors, which is 20% of the length of the
+// barcode or constant region
+const DefaultErrors = -1
+
+// Scheme is the parsed sequence format.  It holds the constant regions and the sizes of the sample, counted and random barcodes
+type Scheme struct {
+	format input.SequenceFormat
+}
+
+// ParseScheme parses the sequence format from reader.  See the README for the sequence format file layout
+func ParseScheme(reader io.Reader) (*Scheme, error) {
+	format, err := input.ParseSequenceFormat(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Scheme{format: format}, nil
+}
+
+// String returns the sequence format where the barcodes are replaced with Ns
+func (s *Scheme) String() string {
+	return s.format.FormatString
+}
+
+// CountedBarcodeNum returns the number of counted barcodes within each read
+func (s *Scheme) CountedBarcodeNum() int {
+	return s.format.CountedBarcodeNum
+}
+
+// SampleSet holds the sample DNA barcodes and their sample IDs
+type SampleSet struct {
+	barcodes input.SampleBarcodes
+}
+
+// ReadSampleSet reads the sample barcodes from reader, which has the same layout as the sample barcodes file.  Each sample
+// barcode must be the size of the sample barcode of scheme
+func ReadSampleSet(reader io.Reader, scheme *Scheme) (*SampleSet, error) {
+	sampleBarcodes, err := input.ReadSampleBarcodes(reader, scheme.format)
+	if err != nil {
+		return nil, err
+	}
+	return &SampleSet{barcodes: sampleBarcodes}, nil
+}
+
+// BarcodeSet holds the counted DNA barcodes and their IDs for each counted barcode position
+type BarcodeSet struct {
+	barcodes input.CountedBarcodes
+}
+
+// ReadBarcodeSet reads the counted barcodes from reader, which has the same layout as the counted barcodes file.  The
+// barcode numbers must be within the number of counted barcodes of scheme, and each barcode must be the size of its counted
+// barcode within scheme
+func ReadBarcodeSet(reader io.Reader, scheme *Scheme) (*BarcodeSet, error) {
+	countedBarcodes, err := input.ReadCountedBarcodes(reader, scheme.format)
+	if err != nil {
+		return nil, err
+	}
+	return &BarcodeSet{barcodes: countedBarcodes}, nil
+}
+
+// Options holds the optional settings of a Counter
+type Options struct {
+	// Threads is the number of parsing goroutines.  Defaults to the number of CPUs when 0
+	Threads int
+	// SampleErrors, CountedErrors and ConstantErrors are the maximum sequencing errors allowed within the sample barcode,
+	// each counted barcode, and the constant region.  Use DefaultErrors for 20% of the length
+	SampleErrors   int
+	CountedErrors  int
+	ConstantErrors int
+}
+
+// DefaultOptions returns Options with the default number of threads and sequencing errors
+func DefaultOptions() Options {
+	return Options{SampleErrors: DefaultErrors, CountedErrors: DefaultErrors, ConstantErrors: DefaultErrors}
+}
+
+// Counter counts barcodes within sequencing reads.  A Counter can be used for multiple counts, and each count returns a
+// new Result
+type Counter struct {
+	scheme          *Scheme
+	sampleBarcodes  input.SampleBarcodes
+	countedBarcodes input.CountedBarcodes
+	maxErrors       results.MaxBarcodeErrorsAllowed
+	threads         int
+}
+
+// New creates a Counter.  samples and counted may be nil when there is not a sample barcodes file or counted barcodes file.
+// Otherwise their barcode sizes and number of counted barcodes must match scheme
+func New(scheme *Scheme, samples *SampleSet, counted *BarcodeSet, options Options) (*Counter, error) {
+	if scheme == nil {
+		return nil, errors.New("barcodecount: scheme is required")
+	}
+	counter := &Counter{scheme: scheme, threads: options.Threads}
+	if counter.threads <= 0 {
+		counter.threads = runtime.NumCPU()
+	}
+	if samples != nil {
+		for _, sampleBarcode := range samples.barcodes.Barcodes {
+			if len(sampleBarcode) != scheme.format.SampleSize {
+				return nil, fmt.Errorf("barcodecount: sample barcode '%v' is %v nucleotides, but the scheme sample barcode is %v", sampleBarcode, len(sampleBarcode), scheme.format.SampleSize)
+			}
+		}
+		counter.sampleBarcodes = samples.barcodes
+	} else {
+		counter.sampleBarcodes = input.SampleBarcodes{
+			Conversion: map[string]string{input.NoSampleName: input.NoSampleName},
+			Barcodes:   []string{input.NoSampleName},
+		}
+	}
+	if counted != nil {
+		if counted.barcodes.NumBarcodes != scheme.format.CountedBarcodeNum {
+			return nil, fmt.Errorf("barcodecount: counted barcode set has %v counted barcodes, but the scheme has %v", counted.barcodes.NumBarcodes, scheme.format.CountedBarcodeNum)
+		}
+		for i, barcodes := range counted.barcodes.Barcodes {
+			for _, barcode := range barcodes {
+				if len(barcode) != scheme.format.CountedBarcodesSizes[i] {
+					return nil, fmt.Errorf("barcodecount: counted barcode '%v' is %v nucleotides, but the scheme counted barcode number %v is %v", barcode, len(barcode), i+1, scheme.format.CountedBarcodesSizes[i])
+				}
+			}
+		}
+		counter.countedBarcodes = counted.barcodes
+	} else {
+		counter.countedBarcodes = input.CountedBarcodes{NumBarcodes: scheme.format.CountedBarcodeNum}
+	}
+	counter.maxErrors = results.NewMaxErrors(options.SampleErrors, options.CountedErrors, options.ConstantErrors, scheme.format)
+	return counter, nil
+}
+
+// CountFastq counts the barcodes within the FASTQ records read from reader.  Compressed input must be decompressed before
+// being passed in
+func (c *Counter) CountFastq(reader io.Reader) (*Result, error) {
+	return c.count(func(sequences chan<- input.Read) (int, error) {
+		return input.ScanFastq(context.Background(), reader, input.ReadOptions{}, sequences, nil)
+	})
+}
+
+// CountSequences counts the barcodes within the sequences returned by next.  next returns false once there are no more sequences
+func (c *Counter) CountSequences(next func() (string, bool)) (*Result, error) {
+	return c.count(func(sequences chan<- input.Read) (int, error) {
+		totalReads := 0
+		for sequence, ok := next(); ok; sequence, ok = next() {
+			sequences <- input.Read{Sequence: sequence}
+			totalReads++
+		}
+		return totalReads, nil
+	})
+}
+
+// count runs the parsing goroutines while read posts the sequences, then gathers the Result
+func (c *Counter) count(read func(sequences chan<- input.Read) (int, error)) (*Result, error) {
+	var wg sync.WaitGroup
+	var seqErrors results.ParseErrors
+	counts := results.NewCount(c.sampleBarcodes.Barcodes)
+	sequences := make(chan input.Read, c.threads*2)
+	parser := parse.NewParser(c.scheme.format, c.sampleBarcodes, c.countedBarcodes, c.maxErrors, input.NewAnchorMatcher(c.scheme.format))
+
+	for i := 0; i < c.threads; i++ {
+		wg.Add(1)
+		go parse.ParseSequences(context.Background(), sequences, &wg, counts, parser, &seqErrors, nil)
+	}
+	totalReads, err := read(sequences)
+	close(sequences)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := seqErrors.Summary()
+	result := &Result{
+		Stats: Stats{
+			TotalReads:     totalReads,
+			Correct:        summary.Correct,
+			ConstantErrors: summary.Constant,
+			SampleErrors:   summary.Sample,
+			RandomErrors:   summary.Random,
+			CountedErrors:  summary.Counted,
+			Duplicates:     summary.Duplicate,
+		},
+	}
+	for _, sampleBarcode := range c.sampleBarcodes.Barcodes {
+		sampleCounts := SampleCounts{ID: c.sampleBarcodes.Conversion[sampleBarcode], Barcode: sampleBarcode}
+		if !c.sampleBarcodes.Included {
+			sampleCounts.Barcode = ""
+		}
+		keys := make(map[string]struct{})
+		for countedBarcodes := range counts.NoRandom[sampleBarcode] {
+			keys[countedBarcodes] = struct{}{}
+		}
+		for countedBarcodes := range counts.Random[sampleBarcode] {
+			keys[countedBarcodes] = struct{}{}
+		}
+		for countedBarcodes := range keys {
+			sampleCounts.Counts = append(sampleCounts.Counts, BarcodeCount{
+				Barcodes: c.convert(countedBarcodes),
+				Count:    counts.SampleCount(sampleBarcode, countedBarcodes),
+			})
+		}
+		sort.Slice(sampleCounts.Counts, func(i, j int) bool {
+			return strings.Join(sampleCounts.Counts[i].Barcodes, ",") < strings.Join(sampleCounts.Counts[j].Barcodes, ",")
+		})
+		result.Samples = append(result.Samples, sampleCounts)
+	}
+	sort.Slice(result.Samples, func(i, j int) bool { return result.Samples[i].ID < result.Samples[j].ID })
+	return result, nil
+}
+
+// convert splits the comma separated counted barcodes and converts them to their IDs when a counted barcode set is included
+func (c *Counter) convert(countedBarcodes string) []string {
+	barcodes := strings.Split(countedBarcodes, ",")
+	if c.countedBarcodes.Included {
+		for i, barcode := range barcodes {
+			barcodes[i] = c.countedBarcodes.Conversion[i][barcode]
+		}
+	}
+	return barcodes
+}
+
+// Result holds the counts for each sample and the parsing stats of a count
+type Result struct {
+	// Samples holds the counts of each sample sorted by sample ID
+	Samples []SampleCounts
+	Stats   Stats
+}
+
+// Sample returns the counts of the sample with the sample ID
+func (r *Result) Sample(id string) (SampleCounts, bool) {
+	for _, sampleCounts := range r.Samples {
+		if sampleCounts.ID == id {
+			return sampleCounts, true
+		}
+	}
+	return SampleCounts{}, false
+}
+
+// SampleCounts holds the counts of a single sample
+type SampleCounts struct {
+	// ID is the sample ID, or 'barcode' when there is not a sample set
+	ID string
+	// Barcode is the sample DNA barcode, or empty when there is not a sample set
+	Barcode string
+	// Counts is sorted by the counted barcodes
+	Counts []BarcodeCount
+}
+
+// BarcodeCount holds the count of a combination of counted barcodes
+type BarcodeCount struct {
+	// Barcodes holds the ID of each counted barcode, or the DNA barcode when there is not a counted barcode set
+	Barcodes []string
+	// Count is the number of reads, or the number of unique random barcodes when the scheme has a random barcode
+	Count int
+}
+
+// Stats holds the number of reads within each parsing category.  RandomErrors are reads without a usable random barcode,
+// which are not counted
+type Stats struct {
+	TotalReads     int
+	Correct        int
+	ConstantErrors int
+	SampleErrors   int
+	RandomErrors   int
+	CountedErrors  int
+	Duplicates     int
+}
@@ -0,0 +1,145 @@
+package barcodecount
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testScheme = "# test scheme\nAGCT[4]TTGA{4}CC{4}TTTT\n"
+
+const testSamples = "Barcode,Sample_ID\nAAAA,sample_1\nCCCC,sample_2\n"
+
+const testCounted = "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\nTGCA,a2,1\nGGTT,b1,2\nCCAA,b2,2\n"
+
+func fastqRecord(name string, sequence string) string {
+	return "@" + name + "\n" + sequence + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+}
+
+func TestCountFastq(t *testing.T) {
+	scheme, err := ParseScheme(strings.NewReader(testScheme))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := ReadSampleSet(strings.NewReader(testSamples), scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := ReadBarcodeSet(strings.NewReader(testCounted), scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err := New(scheme, samples, counted, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fastq := fastqRecord("1", "GGAGCTAAAATTGAACGTCCGGTTTTTTGG") +
+		fastqRecord("2", "AGCTAAAATTGAACGTCCGGTTTTTT") +
+		fastqRecord("3", "AGCTCCCCTTGATGCACCCCAATTTT") +
+		fastqRecord("4", "AGCTGGGGTTGATGCACCCCAATTTT") +
+		fastqRecord("5", "TTTTTTTTTTTTTTTTTTTTTTTTTT")
+	result, err := counter.CountFastq(strings.NewReader(fastq))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStats := Stats{TotalReads: 5, Correct: 3, ConstantErrors: 1, SampleErrors: 1}
+	if result.Stats != wantStats {
+		t.Errorf("Stats = %+v, want %+v", result.Stats, wantStats)
+	}
+	sample1, ok := result.Sample("sample_1")
+	if !ok {
+		t.Fatal("sample_1 missing from result")
+	}
+	want := []BarcodeCount{{Barcodes: []string{"a1", "b1"}, Count: 2}}
+	if !reflect.DeepEqual(sample1.Counts, want) {
+		t.Errorf("sample_1 counts = %+v, want %+v", sample1.Counts, want)
+	}
+	sample2, _ := result.Sample("sample_2")
+	want = []BarcodeCount{{Barcodes: []string{"a2", "b2"}, Count: 1}}
+	if !reflect.DeepEqual(sample2.Counts, want) {
+		t.Errorf("sample_2 counts = %+v, want %+v", sample2.Counts, want)
+	}
+}
+
+func TestCountSequencesWithoutBarcodeSets(t *testing.T) {
+	scheme, err := ParseScheme(strings.NewReader("AGCT{4}TTTT(4)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err := New(scheme, nil, nil, Options{Threads: 2, SampleErrors: DefaultErrors, CountedErrors: DefaultErrors, ConstantErrors: DefaultErrors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequences := []string{"AGCTACGTTTTTAAAA", "AGCTACGTTTTTAAAA", "AGCTACGTTTTTCCCC", "AGCTGGGGTTTTAAAA"}
+	i := 0
+	result, err := counter.CountSequences(func() (string, bool) {
+		if i == len(sequences) {
+			return "", false
+		}
+		i++
+		return sequences[i-1], true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stats.Duplicates != 1 {
+		t.Errorf("Duplicates = %v, want 1", result.Stats.Duplicates)
+	}
+	want := []SampleCounts{{ID: "barcode", Counts: []BarcodeCount{
+		{Barcodes: []string{"ACGT"}, Count: 2},
+		{Barcodes: []string{"GGGG"}, Count: 1},
+	}}}
+	if !reflect.DeepEqual(result.Samples, want) {
+		t.Errorf("Samples = %+v, want %+v", result.Samples, want)
+	}
+}
+
+func TestParseSchemeErrors(t *testing.T) {
+	if _, err := ParseScheme(strings.NewReader("AGCT[4]TTTT")); err == nil {
+		t.Error("expected an error for a scheme without counted barcodes")
+	}
+	scheme, _ := ParseScheme(strings.NewReader(testScheme))
+	if _, err := ReadBarcodeSet(strings.NewReader("Barcode,Barcode_ID,Barcode_Number\nACGT,a1,3\n"), scheme); err == nil {
+		t.Error("expected an error for a barcode number outside of the scheme")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	scheme, err := ParseScheme(strings.NewReader(testScheme))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := ReadSampleSet(strings.NewReader(testSamples), scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := ReadBarcodeSet(strings.NewReader(testCounted), scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, scheme string
+		samples      *SampleSet
+		counted      *BarcodeSet
+		want         string
+	}{
+		{"sample size", "AGCT[6]TTGA{4}CC{4}TTTT", samples, nil, "sample barcode 'AAAA' is 4 nucleotides, but the scheme sample barcode is 6"},
+		{"no sample barcode", "AGCTTTGA{4}CC{4}TTTT", samples, nil, "sample barcode 'AAAA' is 4 nucleotides, but the scheme sample barcode is 0"},
+		{"counted number", "AGCT[4]TTGA{4}TTTT", nil, counted, "counted barcode set has 2 counted barcodes, but the scheme has 1"},
+		{"counted size", "AGCT[4]TTGA{4}CC{6}TTTT", nil, counted, "counted barcode 'GGTT' is 4 nucleotides, but the scheme counted barcode number 2 is 6"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			otherScheme, err := ParseScheme(strings.NewReader(test.scheme))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = New(otherScheme, test.samples, test.counted, DefaultOptions())
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
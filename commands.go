@@ -0,0 +1,259 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/arguments"
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/merge"
+	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/simulate"
+)
+
+// inputs holds the sequence format and barcode files shared by the subcommands
+type inputs struct {
+	format          input.SequenceFormat
+	sampleBarcodes  input.SampleBarcodes
+	countedBarcodes input.CountedBarcodes
+	crisprLibrary   input.CrisprLibrary
+}
+
+// loadInputs reads the sequence format and barcode files.  When a CRISPR library is included, the guides are used as the
+// counted barcodes
+func loadInputs(args arguments.Args) (inputs, error) {
+	var loaded inputs
+	// format contains all information for barcode and sequencing format.  This is used for regex searches and general
+	// information
+	if err := loaded.format.AddSearchRegex(args.FormatPath); err != nil {
+		return loaded, err
+	}
+
+	// the sample and random barcodes are taken from the SAM or BAM tags in place of the read when the tags are set
+	tags := input.BarcodeTags{Sample: args.SampleTag, Random: args.RandomTag}
+	if err := loaded.format.AddBarcodeTags(tags); err != nil {
+		return loaded, err
+	}
+	if tags.Sample != "" && args.SampleBarcodesPath == "" {
+		return loaded, fmt.Errorf("sample barcodes file needed for the sample barcodes within the %v tag", tags.Sample)
+	}
+
+	// sampleBarcodes contains conversion information for the sample barcodes  This is used in all parsing
+	// threads for sequencing error correction and while writing to csv to convert for the final file
+	var err error
+	loaded.sampleBarcodes, err = input.NewSampleBarcodes(args.SampleBarcodesPath, loaded.format)
+	if err != nil {
+		return loaded, err
+	}
+	if tags.Sample != "" {
+		loaded.format.SampleSize = len(loaded.sampleBarcodes.Barcodes[0])
+	}
+
+	// countedBarcodes contains conversion information for the counted barcodes.  This is used in all parsing
+	// threads for sequencing error correction and while writing to csv to convert for the final file
+	loaded.countedBarcodes, err = input.NewCountedBarcodes(args.CountedBarcodesPath, loaded.format)
+	if err != nil {
+		return loaded, err
+	}
+
+	// crisprLibrary contains the guide and gene information for CRISPR screens
+	loaded.crisprLibrary, err = input.NewCrisprLibrary(args.CrisprLibraryPath, loaded.format)
+	if err != nil {
+		return loaded, err
+	}
+	if loaded.crisprLibrary.Included {
+		loaded.countedBarcodes = loaded.crisprLibrary.CountedBarcodes()
+	}
+	return loaded, nil
+}
+
+// checkBarcodeDesign prints the pairwise distances within the sample barcodes and each counted barcode position.  When the
+// errors allowed could assign reads to the wrong barcode, or a set is too large to check, a warning is printed, or an error is
+// returned when requireSafe is set
+func checkBarcodeDesign(loaded inputs, maxErrors results.MaxBarcodeErrorsAllowed, requireSafe bool) error {
+	reports := input.CheckBarcodeDesign(loaded.sampleBarcodes, loaded.countedBarcodes, maxErrors.Sample, maxErrors.Counted)
+	if len(reports) == 0 {
+		return nil
+	}
+	fmt.Println("-BARCODE DISTANCES-")
+	var unsafe, unverified []string
+	for _, report := range reports {
+		report.Print()
+		if report.Skipped {
+			unverified = append(unverified, report.Name)
+		} else if !report.Safe() {
+			unsafe = append(unsafe, report.Name)
+		}
+	}
+	fmt.Println()
+	var messages []string
+	if len(unsafe) != 0 {
+		messages = append(messages, fmt.Sprintf("errors allowed exceed the maximum safe errors for %v.  Reads with this many errors can be dropped or counted as the wrong barcode.  "+
+			"Lower the errors allowed with the --max-errors flags", strings.Join(unsafe, ", ")))
+	}
+	if len(unverified) != 0 {
+		messages = append(messages, fmt.Sprintf("barcode distances not checked for %v, which have too many barcodes to search with the errors allowed, so the errors allowed "+
+			"are unverified.  Lower the errors allowed with the --max-errors flags to check them", strings.Join(unverified, ", ")))
+	}
+	if requireSafe && len(messages) != 0 {
+		return errors.New(strings.Join(messages, ".  "))
+	}
+	for _, message := range messages {
+		logging.Warn(message)
+	}
+	return nil
+}
+
+// runValidate checks the sequence format and barcode files for errors.  Exits with a non zero status at the first error
+func runValidate(args arguments.Args) {
+	loaded, err := loadInputs(args)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	fmt.Printf("Sequence format: %v\n", loaded.format.FormatString)
+	if loaded.sampleBarcodes.Included {
+		fmt.Printf("Sample barcodes: %v samples\n", len(loaded.sampleBarcodes.Barcodes))
+	}
+	if loaded.crisprLibrary.Included {
+		fmt.Printf("CRISPR library: %v guides, %v genes\n", len(loaded.crisprLibrary.Guides), len(loaded.crisprLibrary.GeneOrder))
+	} else if loaded.countedBarcodes.Included {
+		for i, barcodes := range loaded.countedBarcodes.Barcodes {
+			fmt.Printf("Counted barcode %v: %v barcodes\n", i+1, len(barcodes))
+		}
+	}
+	maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, loaded.format)
+	if err := checkBarcodeDesign(loaded, maxErrors, args.RequireSafeErrors); err != nil {
+		logging.Fatal(err)
+	}
+	if args.LibraryMembersPath != "" {
+		if !loaded.countedBarcodes.Included {
+			logging.Fatal(errors.New("counted barcodes file needed to validate the library members file"))
+		}
+		library, err := input.NewLibrary(args.LibraryMembersPath, loaded.countedBarcodes)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		fmt.Printf("Library members: %v\n", len(library.Members))
+	}
+	fmt.Println("All files valid")
+}
+
+// runInspect prints each region of the parsed sequence format and the number of sequencing errors allowed
+func runInspect(args arguments.Args) {
+	loaded, err := loadInputs(args)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	loaded.format.Print()
+	fmt.Println("-REGIONS-")
+	var position int
+	for _, region := range loaded.format.Regions {
+		name := region.Kind.String()
+		if region.Kind == input.CountedRegion {
+			name = fmt.Sprintf("counted %v", region.Index)
+		}
+		fmt.Printf("%v-%v\t%v\t%v\n", position+1, position+region.Size, name, region.Sequence)
+		position += region.Size
+	}
+	fmt.Println()
+	maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, loaded.format)
+	maxErrors.Print()
+}
+
+// runMerge merges the count files from multiple runs into a single file
+func runMerge(args arguments.Args) {
+	fileName, err := merge.Merge(args.MergeInputs, args.OutputDir)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if _, err := arguments.WriteConfig(args, args.OutputDir); err != nil {
+		logging.Fatal(err)
+	}
+	fmt.Printf("Merged %v count files into %v\n", len(args.MergeInputs), fileName)
+}
+
+// runSimulate writes simulated reads to the fastq file, and the truth table of the reads next to it.  The fastq file is gzipped
+// when the name ends with 'gz'
+func runSimulate(args arguments.Args) {
+	loaded, err := loadInputs(args)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	file, err := os.Create(args.FastqPath)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	var writer io.Writer = file
+	var gzipWriter *gzip.Writer
+	if strings.HasSuffix(args.FastqPath, "gz") {
+		gzipWriter = gzip.NewWriter(file)
+		writer = gzipWriter
+	}
+	truthPath := truthTablePath(args.FastqPath)
+	truthFile, err := os.Create(truthPath)
+	if err != nil {
+		logging.Fatal(err)
+	}
+
+	options := simulate.Options{
+		Reads:            args.SimulateReads,
+		Seed:             args.SimulateSeed,
+		SubstitutionRate: args.SimulateSubstitution,
+		InsertionRate:    args.SimulateInsertion,
+		DeletionRate:     args.SimulateDeletion,
+		DuplicationRate:  args.SimulateDuplication,
+		ChimeraRate:      args.SimulateChimera,
+		OffTargetRate:    args.SimulateOffTarget,
+		Flank:            args.SimulateFlank,
+	}
+	simulator := simulate.NewSimulator(loaded.format, loaded.sampleBarcodes, loaded.countedBarcodes, options)
+	// evaluator parses each read in the same way as the count subcommand to measure the accuracy of each parsing stage
+	var evaluator *simulate.Evaluator
+	if args.SimulateEvaluate {
+		maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, loaded.format)
+		matcher, err := input.NewMatcher(args.Matcher, loaded.format)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		parser := parse.NewParser(loaded.format, loaded.sampleBarcodes, loaded.countedBarcodes, maxErrors, matcher)
+		if args.ExpectedStart != -1 {
+			parser.LimitConstantOffsets(args.ExpectedStart, args.StartTolerance)
+		}
+		evaluator = simulate.NewEvaluator(parser, loaded.format)
+	}
+	if err := simulator.WriteFastq(writer, truthFile, evaluator); err != nil {
+		logging.Fatal(fmt.Errorf("%v: %w", args.FastqPath, err))
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			logging.Fatal(fmt.Errorf("%v: %w", args.FastqPath, err))
+		}
+	}
+	if err := file.Close(); err != nil {
+		logging.Fatal(fmt.Errorf("%v: %w", args.FastqPath, err))
+	}
+	if err := truthFile.Close(); err != nil {
+		logging.Fatal(fmt.Errorf("%v: %w", truthPath, err))
+	}
+	if _, err := arguments.WriteConfig(args, filepath.Dir(args.FastqPath)+string(filepath.Separator)); err != nil {
+		logging.Fatal(err)
+	}
+	fmt.Printf("Simulated %v reads into %v\nTruth table: %v\n\n", args.SimulateReads, args.FastqPath, truthPath)
+	if evaluator != nil {
+		evaluator.Print()
+	}
+}
+
+// truthTablePath returns the truth table file name, which is the fastq file name with the fastq extensions replaced
+func truthTablePath(fastqPath string) string {
+	base := strings.TrimSuffix(fastqPath, ".gz")
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".fastq"), ".fq")
+	return base + "_truth.csv"
+}
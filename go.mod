@@ -2,4 +2,12 @@ module github.com/Roco-scientist/barcode-count-go
 
 go 1.17
 
-require github.com/akamensky/argparse v1.3.1 // indirect
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/akamensky/argparse v1.3.1
+	github.com/klauspost/compress v1.15.15
+	github.com/ulikunitz/xz v0.5.11
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/klauspost/pgzip v1.2.5
@@ -1,64 +1,458 @@
 package arguments
 
 import (
-	"github.com/akamensky/argparse"
-	"log"
+	"errors"
+	"fmt"
+	"math"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/progress"
+	"github.com/akamensky/argparse"
+)
+
+// Subcommand names
+const (
+	CountCommand    = "count"
+	ValidateCommand = "validate"
+	InspectCommand  = "inspect"
+	MergeCommand    = "merge"
+	SimulateCommand = "simulate"
 )
 
-// Args holds all input argument information
+// Args holds all input argument information.  The tags are the config file keys, which match the long flag names
 type Args struct {
-	FastqPath              string // fastq file path
-	FormatPath             string // format scheme file path
-	SampleBarcodesPath     string // sample barcode file path.  Optional
-	CountedBarcodesPath    string // building block barcode file path. Optional
-	OutputDir              string // output directory.  Deafaults to './'
-	Threads                int    // Number of threads to use.  Defaults to number of threads on the machine
-	Prefix                 string // Prefix string for the output files
-	MergeOutput            bool   // Whether or not to create an additional output file that merges all samples
-	BarcodesErrors         int    // Optional input of how many errors are allowed in each building block barcode.  Defaults to 20% of the length
-	SampleErrors           int    // Optional input of how many errors are allowed in each sample barcode.  Defaults to 20% of the length
-	ConstantErrors         int    // Optional input of how many errors are allowed in each constant region barcode.  Defaults to 20% of the length
-	MinAverageQualityScore float32
-	Enrich                 bool
-}
-
-// GetArgs retrieves all arguments passed from the CLI
+	Command                string   `json:"command" yaml:"command" toml:"command"`                                                          // Subcommand that was called
+	FastqPath              string   `json:"fastq" yaml:"fastq" toml:"fastq"`                                                                // fastq file path
+	FormatPath             string   `json:"sequence-format" yaml:"sequence-format" toml:"sequence-format"`                                  // format scheme file path
+	SampleBarcodesPath     string   `json:"sample-barcodes" yaml:"sample-barcodes" toml:"sample-barcodes"`                                  // sample barcode file path.  Optional
+	CountedBarcodesPath    string   `json:"counted-barcodes" yaml:"counted-barcodes" toml:"counted-barcodes"`                               // building block barcode file path. Optional
+	OutputDir              string   `json:"output-dir" yaml:"output-dir" toml:"output-dir"`                                                 // output directory.  Deafaults to './'
+	Threads                int      `json:"threads" yaml:"threads" toml:"threads"`                                                          // Number of threads to use.  Defaults to number of threads on the machine
+	Prefix                 string   `json:"-" yaml:"-" toml:"-"`                                                                            // Prefix string for the output files
+	MergeOutput            bool     `json:"merge-output" yaml:"merge-output" toml:"merge-output"`                                           // Whether or not to create an additional output file that merges all samples
+	BarcodesErrors         int      `json:"max-errors-counted-barcode" yaml:"max-errors-counted-barcode" toml:"max-errors-counted-barcode"` // Optional input of how many errors are allowed in each building block barcode.  Defaults to 20% of the length
+	SampleErrors           int      `json:"max-errors-sample" yaml:"max-errors-sample" toml:"max-errors-sample"`                            // Optional input of how many errors are allowed in each sample barcode.  Defaults to 20% of the length
+	ConstantErrors         int      `json:"max-errors-constant" yaml:"max-errors-constant" toml:"max-errors-constant"`                      // Optional input of how many errors are allowed in each constant region barcode.  Defaults to 20% of the length
+	MinAverageQualityScore float32  `json:"-" yaml:"-" toml:"-"`
+	Enrich                 bool     `json:"enrich" yaml:"enrich" toml:"enrich"`
+	EnrichSizes            []int    `json:"enrich-sizes" yaml:"enrich-sizes" toml:"enrich-sizes"`                      // Number of barcodes within each enrichment subset.  Defaults to single and double when --enrich is called
+	ZeroCounts             bool     `json:"zero-counts" yaml:"zero-counts" toml:"zero-counts"`                         // Whether or not to write zero count rows for expected library members which were not observed
+	LibraryMembersPath     string   `json:"library-members" yaml:"library-members" toml:"library-members"`             // Optional file of expected library members.  Defaults to every combination of counted barcodes
+	CrisprLibraryPath      string   `json:"crispr-library" yaml:"crispr-library" toml:"crispr-library"`                // Optional CRISPR library file of guide sequence, guide ID and gene.  Used in place of the counted barcodes file
+	ControlSample          string   `json:"control-sample" yaml:"control-sample" toml:"control-sample"`                // Optional sample ID used as the control for normalized enrichment statistics within the merged output
+	MergeInputs            []string `json:"input" yaml:"input" toml:"input"`                                           // Count files from previous runs to merge.  Used by the merge subcommand
+	SimulateReads          int      `json:"reads" yaml:"reads" toml:"reads"`                                           // Number of reads to simulate.  Used by the simulate subcommand
+	SimulateSeed           int64    `json:"seed" yaml:"seed" toml:"seed"`                                              // Random seed for the simulated reads
+	SimulateSubstitution   float64  `json:"substitution-rate" yaml:"substitution-rate" toml:"substitution-rate"`       // Per nucleotide substitution rate of the simulated reads
+	SimulateInsertion      float64  `json:"insertion-rate" yaml:"insertion-rate" toml:"insertion-rate"`                // Per nucleotide insertion rate of the simulated reads
+	SimulateDeletion       float64  `json:"deletion-rate" yaml:"deletion-rate" toml:"deletion-rate"`                   // Per nucleotide deletion rate of the simulated reads
+	SimulateDuplication    float64  `json:"duplication-rate" yaml:"duplication-rate" toml:"duplication-rate"`          // Chance of a simulated read being a PCR duplicate of an earlier molecule
+	SimulateChimera        float64  `json:"chimera-rate" yaml:"chimera-rate" toml:"chimera-rate"`                      // Chance of a simulated read joining two molecules
+	SimulateOffTarget      float64  `json:"off-target-rate" yaml:"off-target-rate" toml:"off-target-rate"`             // Chance of a simulated read being random sequence
+	SimulateFlank          int      `json:"flank" yaml:"flank" toml:"flank"`                                           // Number of random nucleotides before and after the sequence format within each simulated read
+	SimulateEvaluate       bool     `json:"evaluate" yaml:"evaluate" toml:"evaluate"`                                  // Whether to parse the simulated reads and output the accuracy of each parsing stage
+	RequireSafeErrors      bool     `json:"require-safe-errors" yaml:"require-safe-errors" toml:"require-safe-errors"` // Whether to exit instead of warn when the errors allowed exceed the maximum safe errors of a barcode set
+	CPUProfile             string   `json:"cpuprofile" yaml:"cpuprofile" toml:"cpuprofile"`                            // Optional file to write the pprof CPU profile of the count to
+	MemProfile             string   `json:"memprofile" yaml:"memprofile" toml:"memprofile"`                            // Optional file to write the pprof heap profile to once every read is counted
+	StageTimers            bool     `json:"stage-timers" yaml:"stage-timers" toml:"stage-timers"`                      // Whether to time each parsing stage and output the reads per second of each stage
+	Matcher                string   `json:"matcher" yaml:"matcher" toml:"matcher"`                                     // How the sequence format is found within each read, either 'anchor' or 'regex'
+	FastqValidation        string   `json:"fastq-validation" yaml:"fastq-validation" toml:"fastq-validation"`          // How malformed FASTQ records are handled, either 'strict' or 'lenient'
+	SampleTag              string   `json:"sample-tag" yaml:"sample-tag" toml:"sample-tag"`                            // SAM or BAM tag which holds the sample barcode, such as BC or CB
+	RandomTag              string   `json:"random-tag" yaml:"random-tag" toml:"random-tag"`                            // SAM or BAM tag which holds the random barcode, such as RX
+	Checkpoint             string   `json:"checkpoint" yaml:"checkpoint" toml:"checkpoint"`                            // Checkpoint file which the counts are saved to every CheckpointEvery reads
+	CheckpointEvery        int      `json:"checkpoint-every" yaml:"checkpoint-every" toml:"checkpoint-every"`          // Number of reads between checkpoints
+	Resume                 bool     `json:"resume" yaml:"resume" toml:"resume"`                                        // Whether to resume from the Checkpoint file
+	WritePartial           bool     `json:"write-partial" yaml:"write-partial" toml:"write-partial"`                   // Whether to write the counts so far, marked as incomplete, when the count is stopped by SIGINT or SIGTERM
+	MemoryBudget           string   `json:"memory-budget" yaml:"memory-budget" toml:"memory-budget"`                   // Estimated memory of the counts before they are spilled to disk, such as 512M or 4G.  Empty keeps every count in memory
+	SpillDir               string   `json:"spill-dir" yaml:"spill-dir" toml:"spill-dir"`                               // Directory for the counts spilled to disk.  Defaults to the temporary directory
+	Progress               string   `json:"progress" yaml:"progress" toml:"progress"`                                  // How the progress is reported on stderr, either 'auto', 'tty', 'json' or 'quiet'
+	ProgressInterval       int      `json:"progress-interval" yaml:"progress-interval" toml:"progress-interval"`       // Seconds between progress reports
+	MetricsAddr            string   `json:"metrics-addr" yaml:"metrics-addr" toml:"metrics-addr"`                      // Optional address, such as :9090, which the Prometheus metrics are served on while counting
+	LogLevel               string   `json:"log-level" yaml:"log-level" toml:"log-level"`                               // Lowest level of the messages logged, either 'debug', 'info', 'warn' or 'error'
+	LogFormat              string   `json:"log-format" yaml:"log-format" toml:"log-format"`                            // Format of the logged messages, either 'text' or 'json'
+	LogFile                string   `json:"log-file" yaml:"log-file" toml:"log-file"`                                  // Optional file the messages are appended to in place of stderr
+	ExpectedStart          int      `json:"expected-start" yaml:"expected-start" toml:"expected-start"`                // Expected start of the sequence format within each read, used to limit the constant region repair.  -1 searches every start
+	StartTolerance         int      `json:"start-tolerance" yaml:"start-tolerance" toml:"start-tolerance"`             // Number of nucleotides the sequence format can start before or after ExpectedStart
+}
+
+// defaultArgs returns the Args defaults before any config file or CLI flags are applied
+func defaultArgs() Args {
+	return Args{
+		OutputDir:        "./",
+		Threads:          runtime.NumCPU(),
+		BarcodesErrors:   -1,
+		SampleErrors:     -1,
+		ConstantErrors:   -1,
+		SimulateReads:    10000,
+		SimulateSeed:     1,
+		SimulateFlank:    5,
+		Matcher:          input.AnchorMatcherName,
+		FastqValidation:  string(input.StrictValidation),
+		ExpectedStart:    -1,
+		CheckpointEvery:  10000000,
+		Progress:         progress.AutoMode,
+		ProgressInterval: 1,
+		LogLevel:         logging.InfoLevel.String(),
+		LogFormat:        logging.TextFormat,
+	}
+}
+
+// formatFlags holds the flags shared by the subcommands which read the sequence format and barcode files
+type formatFlags struct {
+	formatPath     *string
+	samplePath     *string
+	countedPath    *string
+	crisprLibrary  *string
+	barcodeErrors  *int
+	sampleErrors   *int
+	constantErrors *int
+}
+
+// addFormatFlags adds the sequence format, barcode file, and maximum error flags to the command.  The flag defaults are
+// taken from defaults, which holds any config file values
+func addFormatFlags(command *argparse.Command, defaults Args) formatFlags {
+	var flags formatFlags
+	flags.formatPath = command.String("q", "sequence-format", &argparse.Options{Required: defaults.FormatPath == "", Default: defaults.FormatPath, Help: "Sequence format file"})
+	flags.countedPath = command.String("c", "counted-barcodes", &argparse.Options{Default: defaults.CountedBarcodesPath, Help: "Counted barcodes file"})
+	flags.samplePath = command.String("s", "sample-barcodes", &argparse.Options{Default: defaults.SampleBarcodesPath, Help: "Sample barcodes file"})
+	flags.crisprLibrary = command.String("", "crispr-library", &argparse.Options{Default: defaults.CrisprLibraryPath, Help: "CRISPR library file with guide sequence, guide ID and gene columns.  Used in place of --counted-barcodes and outputs MAGeCK compatible count tables"})
+	flags.barcodeErrors = command.Int("", "max-errors-counted-barcode", &argparse.Options{Default: defaults.BarcodesErrors, Help: "Maximimum number of sequence errors allowed within each counted barcode. Defaults to 20% of the total."})
+	flags.sampleErrors = command.Int("", "max-errors-sample", &argparse.Options{Default: defaults.SampleErrors, Help: "Maximimum number of sequence errors allowed within the sample barcode. Defaults to 20% of the total."})
+	flags.constantErrors = command.Int("", "max-errors-constant", &argparse.Options{Default: defaults.ConstantErrors, Help: "Maximimum number of sequence errors allowed within the constant region. Defaults to 20% of the total."})
+	return flags
+}
+
+// addConfigFlag adds the config file flag to the command.  The config file is read before the flags are parsed, so the
+// value is only used for the help message
+func addConfigFlag(command *argparse.Command) {
+	command.String("", configFlag, &argparse.Options{Help: "YAML, TOML or JSON config file where the keys are the long flag names.  Flags on the command line override the config file values"})
+}
+
+// boolFlag is an on or off flag along with its --no- variant, so that a flag which is on within the config file can be
+// turned off from the command line
+type boolFlag struct {
+	on  *bool
+	off *bool
+}
+
+// addBoolFlag adds the --name flag, which defaults to the config file value, and the --no-name flag to the command
+func addBoolFlag(command *argparse.Command, short string, name string, defaultValue bool, help string) boolFlag {
+	return boolFlag{
+		on:  command.Flag(short, name, &argparse.Options{Default: defaultValue, Help: help}),
+		off: command.Flag("", "no-"+name, &argparse.Options{Help: "Turns off --" + name + ", such as when it is on within the config file"}),
+	}
+}
+
+// value returns whether the flag is on.  --no-name overrides both the config file and --name
+func (f boolFlag) value() bool {
+	return *f.on && !*f.off
+}
+
+// turnedOff returns whether --no-name was called, which also turns off the flags that imply --name
+func (f boolFlag) turnedOff() bool {
+	return *f.off
+}
+
+// logFlags holds the logging flags of a subcommand
+type logFlags struct {
+	command *argparse.Command
+	level   *string
+	format  *string
+	file    *string
+}
+
+// addLogFlags adds the logging flags to the command.  The flag defaults are taken from defaults, which holds any config file
+// values
+func addLogFlags(command *argparse.Command, defaults Args) logFlags {
+	return logFlags{
+		command: command,
+		level:   command.Selector("", "log-level", logging.Levels, &argparse.Options{Default: defaults.LogLevel, Help: "Lowest level of the messages logged"}),
+		format:  command.Selector("", "log-format", logging.Formats, &argparse.Options{Default: defaults.LogFormat, Help: "Format of the logged messages.  'json' writes a JSON object per line"}),
+		file:    command.String("", "log-file", &argparse.Options{Default: defaults.LogFile, Help: "File the messages are appended to in place of stderr.  The counts and run summary are still written to stdout"}),
+	}
+}
+
+// fill adds the logging flag values to args
+func (f logFlags) fill(args *Args) {
+	args.LogLevel = *f.level
+	args.LogFormat = *f.format
+	args.LogFile = *f.file
+}
+
+// fill adds the format flag values to args
+func (f formatFlags) fill(args *Args) {
+	args.FormatPath = *f.formatPath
+	args.CountedBarcodesPath = *f.countedPath
+	args.CrisprLibraryPath = *f.crisprLibrary
+	if *f.crisprLibrary != "" && *f.countedPath != "" {
+		logging.Warn("CRISPR library used in place of the counted barcodes file.  --counted-barcodes ignored")
+		args.CountedBarcodesPath = ""
+	}
+	args.SampleBarcodesPath = *f.samplePath
+	args.BarcodesErrors = *f.barcodeErrors
+	args.SampleErrors = *f.sampleErrors
+	args.ConstantErrors = *f.constantErrors
+}
+
+// GetArgs retrieves all arguments passed from the CLI and the optional config file.  When the first argument is a flag, the
+// subcommand within the config file is used, or the count subcommand so that runs from before the subcommands were added
+// still work
 func GetArgs() Args {
+	// defaults holds the config file values, which are used as the flag defaults so that the CLI flags override them
+	defaults := defaultArgs()
+	if configPath := findConfigPath(os.Args); configPath != "" {
+		if err := readConfig(configPath, &defaults); err != nil {
+			logging.Fatal(err)
+		}
+	}
+
 	var args Args
 	parser := argparse.NewParser("barcode-count-go", "Counts barcodes located in sequencing data")
-	fastqPath := parser.String("f", "fastq", &argparse.Options{Required: true, Help: "FASTQ file unzipped"})
-	formatPath := parser.String("q", "sequence-format", &argparse.Options{Required: true, Help: "Sequence format file"})
-	countedPath := parser.String("c", "counted-barcodes", &argparse.Options{Help: "Counted barcodes file"})
-	samplePath := parser.String("s", "sample-barcodes", &argparse.Options{Help: "Sample barcodes file"})
-	outputDir := parser.String("o", "output-dir", &argparse.Options{Default: "./", Help: "Directory to output the counts to"})
-	mergeOutput := parser.Flag("m", "merge-output", &argparse.Options{Help: "Merge sample output counts into a single file.  Not necessary when there is only one sample"})
-	enrich := parser.Flag("e", "enrich", &argparse.Options{Help: "Create output files of enrichment for single and double synthons/barcodes"})
-	threads := parser.Int("t", "threads", &argparse.Options{Default: runtime.NumCPU(), Help: "Number of threads"})
-	barcodeErrors := parser.Int("", "max-errors-counted-barcode", &argparse.Options{Default: -1, Help: "Maximimum number of sequence errors allowed within each counted barcode. Defaults to 20% of the total."})
-	sampleErrors := parser.Int("", "max-errors-sample", &argparse.Options{Default: -1, Help: "Maximimum number of sequence errors allowed within the sample barcode. Defaults to 20% of the total."})
-	constantErrors := parser.Int("", "max-errors-constant", &argparse.Options{Default: -1, Help: "Maximimum number of sequence errors allowed within the constant region. Defaults to 20% of the total."})
-	err := parser.Parse(os.Args)
+
+	count := parser.NewCommand(CountCommand, "Counts barcodes located in sequencing data")
+	fastqPath := count.String("f", "fastq", &argparse.Options{Required: defaults.FastqPath == "", Default: defaults.FastqPath, Help: "FASTQ, FASTA, SAM or BAM file, plain or compressed with gzip, bzip2, xz or zstd.  Use '-' to read from stdin"})
+	countFormat := addFormatFlags(count, defaults)
+	outputDir := count.String("o", "output-dir", &argparse.Options{Default: defaults.OutputDir, Help: "Directory to output the counts to"})
+	mergeOutput := addBoolFlag(count, "m", "merge-output", defaults.MergeOutput, "Merge sample output counts into a single file.  Not necessary when there is only one sample")
+	enrich := addBoolFlag(count, "e", "enrich", defaults.Enrich, "Create output files of enrichment for single and double synthons/barcodes")
+	enrichSizes := count.IntList("", "enrich-sizes", &argparse.Options{Default: defaults.EnrichSizes, Help: "Number of barcodes within each enrichment subset, ie 3 for triple barcodes.  Can be called multiple times.  Must be less than the number of counted barcodes.  Implies --enrich"})
+	controlSample := count.String("", "control-sample", &argparse.Options{Default: defaults.ControlSample, Help: "Sample ID of the control sample, ie no target.  Adds normalized counts and fold enrichment statistics against the control to the merged output.  Requires --merge-output"})
+	zeroCounts := addBoolFlag(count, "z", "zero-counts", defaults.ZeroCounts, "Include zero count rows for every expected library member and output a library coverage file.  Requires --counted-barcodes")
+	libraryMembers := count.String("", "library-members", &argparse.Options{Default: defaults.LibraryMembersPath, Help: "Expected library members file.  Used in place of every combination of counted barcodes.  Implies --zero-counts"})
+	threads := count.Int("t", "threads", &argparse.Options{Default: defaults.Threads, Help: "Number of threads"})
+	countRequireSafe := addBoolFlag(count, "", "require-safe-errors", defaults.RequireSafeErrors, "Exit instead of warning when the errors allowed within a barcode set could assign reads to the wrong barcode")
+	cpuProfile := count.String("", "cpuprofile", &argparse.Options{Default: defaults.CPUProfile, Help: "Write a pprof CPU profile of the count to this file"})
+	memProfile := count.String("", "memprofile", &argparse.Options{Default: defaults.MemProfile, Help: "Write a pprof heap profile to this file once every read is counted"})
+	matcher := count.Selector("", "matcher", []string{input.AnchorMatcherName, input.RegexMatcherName}, &argparse.Options{Default: defaults.Matcher, Help: "How the sequence format is found within each read.  'anchor' searches for the longest constant region, 'regex' uses the Go regex engine.  Both give the same counts"})
+	expectedStart := count.Int("", "expected-start", &argparse.Options{Default: defaults.ExpectedStart, Help: "Expected start of the sequence format within each read, starting at 0.  Limits the constant region repair to starts within --start-tolerance.  Defaults to searching every start"})
+	startTolerance := count.Int("", "start-tolerance", &argparse.Options{Default: defaults.StartTolerance, Help: "Number of nucleotides the sequence format can start before or after --expected-start when the constant region is repaired"})
+	fastqValidation := count.Selector("", "fastq-validation", []string{string(input.StrictValidation), string(input.LenientValidation)}, &argparse.Options{Default: defaults.FastqValidation, Help: "How malformed FASTQ records are handled.  'strict' exits at the first malformed record, 'lenient' skips malformed records and reports how many were skipped"})
+	sampleTag := count.String("", "sample-tag", &argparse.Options{Default: defaults.SampleTag, Help: "SAM or BAM tag which holds the sample barcode, such as BC or CB.  Used in place of a sample barcode within the sequence format.  Requires --sample-barcodes"})
+	randomTag := count.String("", "random-tag", &argparse.Options{Default: defaults.RandomTag, Help: "SAM or BAM tag which holds the random barcode (UMI), such as RX.  Used in place of a random barcode within the sequence format"})
+	checkpoint := count.String("", "checkpoint", &argparse.Options{Default: defaults.Checkpoint, Help: "Checkpoint file which the counts and the position within the reads file are saved to every --checkpoint-every reads.  Removed once the counts are written"})
+	checkpointEvery := count.Int("", "checkpoint-every", &argparse.Options{Default: defaults.CheckpointEvery, Help: "Number of reads between checkpoints"})
+	resume := addBoolFlag(count, "", "resume", defaults.Resume, "Resume from the --checkpoint file, which needs the same reads file and settings.  Starts from the first read when there is not a checkpoint")
+	writePartial := addBoolFlag(count, "", "write-partial", defaults.WritePartial, "When the count is stopped with Ctrl-C (SIGINT) or SIGTERM, write the counts of the reads counted so far with file names starting with INCOMPLETE_")
+	memoryBudget := count.String("", "memory-budget", &argparse.Options{Default: defaults.MemoryBudget, Help: "Estimated memory of the counts, such as 512M or 4G, before sorted counts are spilled to --spill-dir and merged once every read is counted.  Defaults to keeping every count in memory"})
+	spillDir := count.String("", "spill-dir", &argparse.Options{Default: defaults.SpillDir, Help: "Directory for the counts spilled once --memory-budget is reached.  Defaults to the temporary directory"})
+	progressMode := count.Selector("", "progress", progress.Modes, &argparse.Options{Default: defaults.Progress, Help: "How the progress is reported on stderr.  'tty' rewrites a progress line, 'json' writes a JSON object per line, 'quiet' does not report progress, and 'auto' is 'tty' when stderr is a terminal and 'quiet' otherwise"})
+	progressInterval := count.Int("", "progress-interval", &argparse.Options{Default: defaults.ProgressInterval, Help: "Seconds between progress reports"})
+	metricsAddr := count.String("", "metrics-addr", &argparse.Options{Default: defaults.MetricsAddr, Help: "Address, such as :9090 or localhost:9090, to serve Prometheus metrics on at /metrics while counting.  Defaults to not serving metrics"})
+	stageTimers := addBoolFlag(count, "", "stage-timers", defaults.StageTimers, "Time each parsing stage and output the reads per second of each stage within the run summary")
+	countLog := addLogFlags(count, defaults)
+	addConfigFlag(count)
+
+	validate := parser.NewCommand(ValidateCommand, "Checks the sequence format and barcode files for errors")
+	validateFormat := addFormatFlags(validate, defaults)
+	validateMembers := validate.String("", "library-members", &argparse.Options{Default: defaults.LibraryMembersPath, Help: "Expected library members file"})
+	validateRequireSafe := addBoolFlag(validate, "", "require-safe-errors", defaults.RequireSafeErrors, "Exit with an error when the errors allowed within a barcode set could assign reads to the wrong barcode")
+	validateLog := addLogFlags(validate, defaults)
+	addConfigFlag(validate)
+
+	inspect := parser.NewCommand(InspectCommand, "Prints the parsed sequence format and the sequencing errors allowed per barcode")
+	inspectFormat := addFormatFlags(inspect, defaults)
+	inspectLog := addLogFlags(inspect, defaults)
+	addConfigFlag(inspect)
+
+	merge := parser.NewCommand(MergeCommand, "Merges count files from multiple runs into a single file.  Counts of the same sample are summed")
+	mergeInputs := merge.StringList("i", "input", &argparse.Options{Required: len(defaults.MergeInputs) == 0, Default: defaults.MergeInputs, Help: "Count file to merge.  Either a single sample or a merged count file.  Called once per file"})
+	mergeOutputDir := merge.String("o", "output-dir", &argparse.Options{Default: defaults.OutputDir, Help: "Directory to output the merged counts to"})
+	mergeLog := addLogFlags(merge, defaults)
+	addConfigFlag(merge)
+
+	simulate := parser.NewCommand(SimulateCommand, "Generates a FASTQ file of synthetic reads from the sequence format and barcode files")
+	simulateFormat := addFormatFlags(simulate, defaults)
+	simulateOutput := simulate.String("f", "fastq", &argparse.Options{Required: defaults.FastqPath == "", Default: defaults.FastqPath, Help: "FASTQ file to write the simulated reads to.  Gzipped when ending with 'gz'"})
+	simulateReads := simulate.Int("n", "reads", &argparse.Options{Default: defaults.SimulateReads, Help: "Number of reads to simulate"})
+	simulateSeed := simulate.Int("", "seed", &argparse.Options{Default: int(defaults.SimulateSeed), Help: "Random seed"})
+	simulateSubstitution := simulate.Float("", "substitution-rate", &argparse.Options{Default: defaults.SimulateSubstitution, Help: "Per nucleotide substitution rate"})
+	simulateInsertion := simulate.Float("", "insertion-rate", &argparse.Options{Default: defaults.SimulateInsertion, Help: "Per nucleotide insertion rate"})
+	simulateDeletion := simulate.Float("", "deletion-rate", &argparse.Options{Default: defaults.SimulateDeletion, Help: "Per nucleotide deletion rate"})
+	simulateDuplication := simulate.Float("", "duplication-rate", &argparse.Options{Default: defaults.SimulateDuplication, Help: "Chance of a read being a PCR duplicate of an earlier molecule, with the same random barcode"})
+	simulateChimera := simulate.Float("", "chimera-rate", &argparse.Options{Default: defaults.SimulateChimera, Help: "Chance of a read joining the start of one molecule with the end of another"})
+	simulateOffTarget := simulate.Float("", "off-target-rate", &argparse.Options{Default: defaults.SimulateOffTarget, Help: "Chance of a read being random sequence"})
+	simulateFlank := simulate.Int("", "flank", &argparse.Options{Default: defaults.SimulateFlank, Help: "Number of random nucleotides before and after the sequence format within each read"})
+	simulateMatcher := simulate.Selector("", "matcher", []string{input.AnchorMatcherName, input.RegexMatcherName}, &argparse.Options{Default: defaults.Matcher, Help: "How the sequence format is found within each read when evaluating, either 'anchor' or 'regex'"})
+	simulateExpectedStart := simulate.Int("", "expected-start", &argparse.Options{Default: defaults.ExpectedStart, Help: "Expected start of the sequence format within each read when evaluating.  Defaults to searching every start"})
+	simulateStartTolerance := simulate.Int("", "start-tolerance", &argparse.Options{Default: defaults.StartTolerance, Help: "Number of nucleotides the sequence format can start before or after --expected-start when evaluating"})
+	simulateEvaluate := addBoolFlag(simulate, "", "evaluate", defaults.SimulateEvaluate, "Parse the simulated reads with the --max-errors settings and output the recall and precision of each parsing stage")
+	simulateLog := addLogFlags(simulate, defaults)
+	addConfigFlag(simulate)
+
+	osArgs := os.Args
+	if len(osArgs) > 1 && strings.HasPrefix(osArgs[1], "-") && osArgs[1] != "-h" && osArgs[1] != "--help" {
+		command := CountCommand
+		if defaults.Command != "" {
+			command = defaults.Command
+		}
+		osArgs = append([]string{osArgs[0], command}, osArgs[1:]...)
+	}
+	err := parser.Parse(osArgs)
 	if err != nil {
-		log.Fatal(err)
-	}
-	args.FastqPath = *fastqPath
-	args.FormatPath = *formatPath
-	args.CountedBarcodesPath = *countedPath
-	args.SampleBarcodesPath = *samplePath
-	args.OutputDir = *outputDir
-	if *samplePath != "" && *mergeOutput {
-		args.MergeOutput = *mergeOutput
-	} else if *mergeOutput {
-		l := log.New(os.Stderr, "", 0)
-		l.Println("Sample conversion file needed to merge output.  --merge-output flag set to false")
-		args.MergeOutput = false
-	}
-	args.Enrich = *enrich
-	args.Threads = *threads
-	args.BarcodesErrors = *barcodeErrors
-	args.SampleErrors = *sampleErrors
-	args.ConstantErrors = *constantErrors
+		fmt.Fprint(os.Stderr, parser.Usage(err))
+		os.Exit(1)
+	}
+
+	// logging is set up before the other flags are checked, so that their warnings are logged the same way
+	for _, flags := range []logFlags{countLog, validateLog, inspectLog, mergeLog, simulateLog} {
+		if flags.command.Happened() {
+			flags.fill(&args)
+		}
+	}
+	if err := logging.Setup(args.LogLevel, args.LogFormat, args.LogFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch {
+	case count.Happened():
+		args.Command = CountCommand
+		countFormat.fill(&args)
+		args.FastqPath = *fastqPath
+		args.OutputDir = *outputDir
+		if *countFormat.samplePath != "" && mergeOutput.value() {
+			args.MergeOutput = mergeOutput.value()
+		} else if mergeOutput.value() {
+			logging.Warn("Sample conversion file needed to merge output.  --merge-output flag set to false")
+			args.MergeOutput = false
+		}
+		if *controlSample != "" && args.MergeOutput {
+			args.ControlSample = *controlSample
+		} else if *controlSample != "" {
+			logging.Warn("Merged output needed for control sample statistics.  --control-sample ignored")
+		}
+		// --enrich-sizes and --library-members imply --enrich and --zero-counts, unless those are turned off with --no-enrich
+		// and --no-zero-counts, such as when the config file sets enrich-sizes or library-members
+		sizes, members := *enrichSizes, *libraryMembers
+		if enrich.turnedOff() {
+			sizes = nil
+		}
+		if zeroCounts.turnedOff() {
+			members = ""
+		}
+		args.Enrich = enrich.value() || len(sizes) != 0
+		if len(sizes) != 0 {
+			args.EnrichSizes = sizes
+		} else if enrich.value() {
+			args.EnrichSizes = []int{1, 2}
+		}
+		args.LibraryMembersPath = members
+		if (zeroCounts.value() || members != "") && *countFormat.countedPath == "" && *countFormat.crisprLibrary == "" {
+			logging.Warn("Counted barcodes file needed for zero counts.  --zero-counts flag set to false")
+			args.ZeroCounts = false
+		} else {
+			args.ZeroCounts = zeroCounts.value() || members != ""
+		}
+		args.Threads = *threads
+		args.RequireSafeErrors = countRequireSafe.value()
+		args.CPUProfile = *cpuProfile
+		args.MemProfile = *memProfile
+		args.StageTimers = stageTimers.value()
+		args.Matcher = *matcher
+		args.ExpectedStart = *expectedStart
+		args.StartTolerance = *startTolerance
+		if err := checkStart(args.ExpectedStart, args.StartTolerance); err != nil {
+			logging.Fatal(err)
+		}
+		args.FastqValidation = *fastqValidation
+		args.Checkpoint = *checkpoint
+		args.CheckpointEvery = *checkpointEvery
+		args.Resume = resume.value()
+		if args.Resume && args.Checkpoint == "" {
+			logging.Warn("Checkpoint file needed to resume.  --resume flag set to false")
+			args.Resume = false
+		}
+		args.WritePartial = writePartial.value()
+		args.SampleTag = *sampleTag
+		args.RandomTag = *randomTag
+		args.Progress = *progressMode
+		args.ProgressInterval = *progressInterval
+		if args.ProgressInterval < 1 {
+			logging.Warn("Progress interval needs to be at least 1 second.  --progress-interval set to 1")
+			args.ProgressInterval = 1
+		}
+		args.MetricsAddr = *metricsAddr
+		args.MemoryBudget = *memoryBudget
+		args.SpillDir = *spillDir
+		if _, err := ParseMemorySize(args.MemoryBudget); err != nil {
+			logging.Fatal(err)
+		}
+		if args.MemoryBudget != "" && args.Checkpoint != "" {
+			logging.Fatal(errors.New("checkpoints do not include the counts spilled to disk, so --checkpoint can not be used with --memory-budget"))
+		}
+	case validate.Happened():
+		args.Command = ValidateCommand
+		validateFormat.fill(&args)
+		args.LibraryMembersPath = *validateMembers
+		args.RequireSafeErrors = validateRequireSafe.value()
+	case inspect.Happened():
+		args.Command = InspectCommand
+		inspectFormat.fill(&args)
+	case merge.Happened():
+		args.Command = MergeCommand
+		args.MergeInputs = *mergeInputs
+		args.OutputDir = *mergeOutputDir
+	case simulate.Happened():
+		args.Command = SimulateCommand
+		simulateFormat.fill(&args)
+		args.FastqPath = *simulateOutput
+		args.SimulateReads = *simulateReads
+		args.SimulateSeed = int64(*simulateSeed)
+		args.SimulateSubstitution = *simulateSubstitution
+		args.SimulateInsertion = *simulateInsertion
+		args.SimulateDeletion = *simulateDeletion
+		args.SimulateDuplication = *simulateDuplication
+		args.SimulateChimera = *simulateChimera
+		args.SimulateOffTarget = *simulateOffTarget
+		args.SimulateFlank = *simulateFlank
+		args.SimulateEvaluate = simulateEvaluate.value()
+		args.Matcher = *simulateMatcher
+		args.ExpectedStart = *simulateExpectedStart
+		args.StartTolerance = *simulateStartTolerance
+		if err := checkStart(args.ExpectedStart, args.StartTolerance); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	if args.Threads == 0 {
+		args.Threads = runtime.NumCPU()
+	}
 	return args
 }
+
+// checkStart returns an error when the expected start is below -1, which searches every start, or the start tolerance is
+// negative
+func checkStart(expectedStart int, startTolerance int) error {
+	if expectedStart < -1 {
+		return fmt.Errorf("expected start %v must be 0 or more, or -1 to search every start", expectedStart)
+	}
+	if startTolerance < 0 {
+		return fmt.Errorf("start tolerance %v must be 0 or more", startTolerance)
+	}
+	return nil
+}
+
+// ParseMemorySize returns the number of bytes of a memory size, which is a number of bytes with an optional K, M, G or T suffix
+// for the powers of 1024, such as 512M or 4G.  An empty size is 0
+func ParseMemorySize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	number := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(size, "B"), "b"))
+	var shift uint
+	if last := len(number) - 1; last > 0 {
+		if index := strings.IndexByte("KMGT", number[last]); index != -1 {
+			shift = 10 * uint(index+1)
+			number = number[:last]
+		}
+	}
+	bytes, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || bytes <= 0 || bytes > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("memory size %q is not a positive number of bytes with an optional K, M, G or T suffix", size)
+	}
+	return bytes << shift, nil
+}
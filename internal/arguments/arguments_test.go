@@ -0,0 +1,94 @@
+package arguments
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBoolFlags(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "run.yaml")
+	config := "fastq: reads.fastq\nsequence-format: scheme.txt\nsample-barcodes: samples.csv\ncounted-barcodes: counted.csv\nmerge-output: true\nenrich: true\nzero-counts: true\nstage-timers: true\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		flags       []string
+		mergeOutput bool
+		enrich      bool
+		zeroCounts  bool
+		stageTimers bool
+	}{
+		{"config", nil, true, true, true, true},
+		{"no flags", []string{"--no-merge-output", "--no-zero-counts"}, false, true, false, true},
+		{"no flag overrides flag", []string{"--enrich", "--no-enrich", "--no-stage-timers"}, true, false, true, false},
+	}
+	osArgs := os.Args
+	defer func() { os.Args = osArgs }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Args = append([]string{"barcode-count-go", CountCommand, "--config", configPath}, test.flags...)
+			args := GetArgs()
+			if args.MergeOutput != test.mergeOutput || args.Enrich != test.enrich || args.ZeroCounts != test.zeroCounts || args.StageTimers != test.stageTimers {
+				t.Errorf("merge-output, enrich, zero-counts, stage-timers = %v, %v, %v, %v, want %v, %v, %v, %v", args.MergeOutput, args.Enrich,
+					args.ZeroCounts, args.StageTimers, test.mergeOutput, test.enrich, test.zeroCounts, test.stageTimers)
+			}
+		})
+	}
+}
+
+// TestImpliedFlags checks that --no-enrich and --no-zero-counts turn off the enrich-sizes and library-members of the config
+// file, which imply --enrich and --zero-counts
+func TestImpliedFlags(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "run.yaml")
+	config := "fastq: reads.fastq\nsequence-format: scheme.txt\ncounted-barcodes: counted.csv\nenrich-sizes: [1, 3]\nlibrary-members: members.csv\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		flags       []string
+		enrichSizes []int
+		members     string
+	}{
+		{"config", nil, []int{1, 3}, "members.csv"},
+		{"no enrich", []string{"--no-enrich"}, nil, "members.csv"},
+		{"no zero counts", []string{"--no-zero-counts"}, []int{1, 3}, ""},
+	}
+	osArgs := os.Args
+	defer func() { os.Args = osArgs }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Args = append([]string{"barcode-count-go", CountCommand, "--config", configPath}, test.flags...)
+			args := GetArgs()
+			if args.Enrich != (test.enrichSizes != nil) || !reflect.DeepEqual(args.EnrichSizes, test.enrichSizes) {
+				t.Errorf("enrich, enrich-sizes = %v, %v, want %v", args.Enrich, args.EnrichSizes, test.enrichSizes)
+			}
+			if args.ZeroCounts != (test.members != "") || args.LibraryMembersPath != test.members {
+				t.Errorf("zero-counts, library-members = %v, %q, want %q", args.ZeroCounts, args.LibraryMembersPath, test.members)
+			}
+		})
+	}
+}
+
+func TestCheckStart(t *testing.T) {
+	tests := []struct {
+		expectedStart, startTolerance int
+		wantErr                       bool
+	}{
+		{-1, 0, false},
+		{0, 0, false},
+		{12, 3, false},
+		{-2, 0, true},
+		{5, -1, true},
+	}
+	for _, test := range tests {
+		if err := checkStart(test.expectedStart, test.startTolerance); (err != nil) != test.wantErr {
+			t.Errorf("checkStart(%v, %v) = %v, want an error %v", test.expectedStart, test.startTolerance, err, test.wantErr)
+		}
+	}
+}
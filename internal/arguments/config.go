@@ -0,0 +1,115 @@
+package arguments
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlag is the long name of the flag which holds the config file path
+const configFlag = "config"
+
+// findConfigPath returns the value of the --config flag from the CLI arguments.  This is needed before the flags are
+// created so that the config values can be used as the flag defaults
+func findConfigPath(osArgs []string) string {
+	for i, arg := range osArgs {
+		if arg == "--"+configFlag && i+1 < len(osArgs) {
+			return osArgs[i+1]
+		}
+		if strings.HasPrefix(arg, "--"+configFlag+"=") {
+			return strings.TrimPrefix(arg, "--"+configFlag+"=")
+		}
+	}
+	return ""
+}
+
+// readConfig reads the config file at configPath into args.  Only the values within the config file replace the values
+// already within args.  The format is picked from the file extension, which is .yaml, .yml, .toml or .json
+func readConfig(configPath string, args *Args) error {
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		err = decoder.Decode(args)
+	case ".toml":
+		var metaData toml.MetaData
+		metaData, err = toml.Decode(string(contents), args)
+		if err == nil && len(metaData.Undecoded()) != 0 {
+			err = fmt.Errorf("unknown config keys %v", metaData.Undecoded())
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(args)
+	default:
+		err = fmt.Errorf("config file extension must be .yaml, .yml, .toml or .json")
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", configPath, err)
+	}
+	return nil
+}
+
+// WriteConfig writes the resolved arguments as a YAML config file within outputDir so that the run can be repeated with
+// --config.  File paths are converted to absolute paths.  The name of the written file is returned
+func WriteConfig(args Args, outputDir string) (string, error) {
+	resolved := args
+	for _, path := range []*string{&resolved.FastqPath, &resolved.FormatPath, &resolved.SampleBarcodesPath, &resolved.CountedBarcodesPath,
+		&resolved.LibraryMembersPath, &resolved.CrisprLibraryPath, &resolved.CPUProfile, &resolved.MemProfile, &resolved.Checkpoint, &resolved.SpillDir, &resolved.LogFile} {
+		if err := absolutePath(path); err != nil {
+			return "", err
+		}
+	}
+	resolved.MergeInputs = append([]string(nil), args.MergeInputs...)
+	for i := range resolved.MergeInputs {
+		if err := absolutePath(&resolved.MergeInputs[i]); err != nil {
+			return "", err
+		}
+	}
+	if resolved.OutputDir != "" {
+		// The output directory is used as a file name prefix, so the trailing separator needs to be kept
+		trailing := strings.HasSuffix(resolved.OutputDir, "/")
+		if err := absolutePath(&resolved.OutputDir); err != nil {
+			return "", err
+		}
+		if trailing {
+			resolved.OutputDir += "/"
+		}
+	}
+
+	contents, err := yaml.Marshal(resolved)
+	if err != nil {
+		return "", err
+	}
+	today := time.Now().Local().Format("2006-01-02")
+	fileName := outputDir + today + "_" + resolved.Command + "_config.yaml"
+	if err := os.WriteFile(fileName, contents, 0644); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// absolutePath replaces the path with the absolute path when it is not empty, or '-' for stdin
+func absolutePath(path *string) error {
+	if *path == "" || *path == input.StdinPath {
+		return nil
+	}
+	absolute, err := filepath.Abs(*path)
+	if err != nil {
+		return err
+	}
+	*path = absolute
+	return nil
+}
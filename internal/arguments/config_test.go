@@ -0,0 +1,98 @@
+package arguments
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	configs := map[string]string{
+		"run.yaml": "fastq: reads.fastq\nsequence-format: scheme.txt\nmerge-output: true\nenrich-sizes: [1, 3]\nmax-errors-sample: 0\n",
+		"run.toml": "fastq = \"reads.fastq\"\nsequence-format = \"scheme.txt\"\nmerge-output = true\nenrich-sizes = [1, 3]\nmax-errors-sample = 0\n",
+		"run.json": `{"fastq": "reads.fastq", "sequence-format": "scheme.txt", "merge-output": true, "enrich-sizes": [1, 3], "max-errors-sample": 0}`,
+	}
+	want := defaultArgs()
+	want.FastqPath = "reads.fastq"
+	want.FormatPath = "scheme.txt"
+	want.MergeOutput = true
+	want.EnrichSizes = []int{1, 3}
+	want.SampleErrors = 0
+	for name, contents := range configs {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := defaultArgs()
+		if err := readConfig(path, &args); err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("%v: args = %+v, want %+v", name, args, want)
+		}
+	}
+
+	errorTests := map[string]string{
+		"unknown.yaml": "fastqs: reads.fastq\n",
+		"unknown.toml": "fastqs = \"reads.fastq\"\n",
+		"unknown.json": `{"fastqs": "reads.fastq"}`,
+		"unknown.ini":  "fastq=reads.fastq\n",
+	}
+	for name, contents := range errorTests {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := defaultArgs()
+		if err := readConfig(path, &args); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%v: error = %v", name, err)
+		}
+	}
+}
+
+func TestFindConfigPath(t *testing.T) {
+	tests := []struct {
+		osArgs []string
+		want   string
+	}{
+		{[]string{"barcode-count", "count", "--config", "run.yaml", "-t", "2"}, "run.yaml"},
+		{[]string{"barcode-count", "--config=run.toml"}, "run.toml"},
+		{[]string{"barcode-count", "count", "-f", "reads.fastq"}, ""},
+	}
+	for _, test := range tests {
+		if got := findConfigPath(test.osArgs); got != test.want {
+			t.Errorf("findConfigPath(%v) = %v, want %v", test.osArgs, got, test.want)
+		}
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1024", 1024, false},
+		{"512K", 512 << 10, false},
+		{"512M", 512 << 20, false},
+		{"4G", 4 << 30, false},
+		{"4gb", 4 << 30, false},
+		{"2T", 2 << 40, false},
+		{"G", 0, true},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"4X", 0, true},
+		{"99999999999T", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseMemorySize(test.size)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseMemorySize(%q) = %v, %v, want %v and an error %v", test.size, got, err, test.want, test.wantErr)
+		}
+	}
+}
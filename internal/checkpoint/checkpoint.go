@@ -0,0 +1,208 @@
+// Package checkpoint saves the counts of a run to disk every so many reads, so that a run which stops early can be resumed
+// from the last checkpoint with the same final counts
+package checkpoint
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+// version is increased whenever the Checkpoint struct changes, so that older checkpoints are not resumed
+const version = 3
+
+// Settings holds the arguments and files which change the counts.  A checkpoint is only resumed with the same settings
+type Settings struct {
+	Format          File
+	SampleBarcodes  File
+	CountedBarcodes File
+	CrisprLibrary   File
+	SampleErrors    int
+	CountedErrors   int
+	ConstantErrors  int
+	ExpectedStart   int
+	StartTolerance  int
+	SampleTag       string
+	RandomTag       string
+	FastqValidation string
+}
+
+// File identifies the sequence format or a barcode file by its absolute path and a hash of its contents, so that a checkpoint
+// is not resumed once the file is edited.  The File of an unused file is empty
+type File struct {
+	Path string
+	Hash [sha256.Size]byte
+}
+
+// NewFile creates the File of the file at path, or the empty File when path is empty
+func NewFile(path string) (File, error) {
+	if path == "" {
+		return File{}, nil
+	}
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return File{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return File{}, fmt.Errorf("%v: %w", path, err)
+	}
+	checked := File{Path: absolutePath}
+	copy(checked.Hash[:], hash.Sum(nil))
+	return checked, nil
+}
+
+// Input identifies the reads file, so that a checkpoint is only resumed with the same file.  The size and modification time
+// are not known for stdin
+type Input struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// NewInput creates the Input of the reads file at fastqPath
+func NewInput(fastqPath string) (Input, error) {
+	if fastqPath == input.StdinPath {
+		return Input{Path: fastqPath}, nil
+	}
+	absolutePath, err := filepath.Abs(fastqPath)
+	if err != nil {
+		return Input{}, err
+	}
+	info, err := os.Stat(fastqPath)
+	if err != nil {
+		return Input{}, err
+	}
+	return Input{Path: absolutePath, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Checkpoint is the state of a count once the first Reads reads are counted
+type Checkpoint struct {
+	Version  int
+	Input    Input
+	Settings Settings
+	// Reads is the number of reads posted by the reader, which are skipped when resuming
+	Reads  int
+	Counts results.CountsState
+	Errors results.ErrorSummary
+}
+
+// Check returns an error when the checkpoint cannot be resumed with input and settings
+func (c Checkpoint) Check(input Input, settings Settings) error {
+	if c.Version != version {
+		return fmt.Errorf("checkpoint version %v is not the current version %v", c.Version, version)
+	}
+	for _, file := range []struct {
+		name           string
+		saved, current File
+	}{
+		{"sequence format file", c.Settings.Format, settings.Format},
+		{"sample barcodes file", c.Settings.SampleBarcodes, settings.SampleBarcodes},
+		{"counted barcodes file", c.Settings.CountedBarcodes, settings.CountedBarcodes},
+		{"CRISPR library file", c.Settings.CrisprLibrary, settings.CrisprLibrary},
+	} {
+		if file.saved != file.current {
+			return fmt.Errorf("the %v changed since the checkpoint", file.name)
+		}
+	}
+	if c.Settings != settings {
+		return errors.New("the errors allowed or the read settings changed since the checkpoint")
+	}
+	if c.Input.Path != input.Path || c.Input.Size != input.Size || !c.Input.ModTime.Equal(input.ModTime) {
+		return fmt.Errorf("the reads file changed since the checkpoint of %v", c.Input.Path)
+	}
+	return nil
+}
+
+// Write writes the checkpoint to checkpointPath.  The checkpoint is written to a temporary file which then replaces
+// checkpointPath, so that the last checkpoint is kept when the run stops while writing
+func Write(checkpointPath string, checkpoint Checkpoint) error {
+	checkpoint.Version = version
+	file, err := os.CreateTemp(filepath.Dir(checkpointPath), filepath.Base(checkpointPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	if err := gob.NewEncoder(writer).Encode(checkpoint); err != nil {
+		file.Close()
+		return fmt.Errorf("%v: %w", checkpointPath, err)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), checkpointPath)
+}
+
+// Read reads the checkpoint written by Write.  An error wrapping os.ErrNotExist is returned when there is not a checkpoint
+func Read(checkpointPath string) (Checkpoint, error) {
+	file, err := os.Open(checkpointPath)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer file.Close()
+	var checkpoint Checkpoint
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("%v: %w", checkpointPath, err)
+	}
+	return checkpoint, nil
+}
+
+// Writer writes the checkpoints of a count
+type Writer struct {
+	path      string
+	input     Input
+	settings  Settings
+	counts    *results.Counts
+	seqErrors *results.ParseErrors
+}
+
+// NewWriter creates a Writer which saves counts and seqErrors to checkpointPath
+func NewWriter(checkpointPath string, input Input, settings Settings, counts *results.Counts, seqErrors *results.ParseErrors) *Writer {
+	return &Writer{path: checkpointPath, input: input, settings: settings, counts: counts, seqErrors: seqErrors}
+}
+
+// Write waits for the parsing threads to count the first totalReads reads, then writes the checkpoint.  It is called by the
+// reader after posting totalReads reads, so nothing else is counted until it returns.  Once ctx is done, the parsing threads
+// stop counting, so the error of ctx is returned without writing the checkpoint
+func (w *Writer) Write(ctx context.Context, totalReads int) error {
+	// each parsed read is added to a single ParseErrors category once it is counted
+	if err := w.seqErrors.WaitReads(ctx, totalReads); err != nil {
+		return err
+	}
+	if err := Write(w.path, Checkpoint{
+		Input:    w.input,
+		Settings: w.settings,
+		Reads:    totalReads,
+		Counts:   w.counts.State(),
+		Errors:   w.seqErrors.Summary(),
+	}); err != nil {
+		return err
+	}
+	logging.Debug("Checkpoint written", "checkpoint", w.path, "reads", totalReads)
+	return nil
+}
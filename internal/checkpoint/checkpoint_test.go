@@ -0,0 +1,147 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+func TestWriteRead(t *testing.T) {
+	checkpointPath := filepath.Join(t.TempDir(), "count.checkpoint")
+	if _, err := Read(checkpointPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of a missing checkpoint error = %v, want os.ErrNotExist", err)
+	}
+
+	counts := results.NewCount([]string{"AAAA", "CCCC"})
+	counts.AddCount("AAAA", "ACGT,TTGA", "", true)
+	counts.AddCount("AAAA", "ACGT,TTGA", "", true)
+	counts.AddCount("CCCC", "ACGT,TTGA", "GGGG", true)
+	counts.AddUnmapped("CCCC", true)
+	var seqErrors results.ParseErrors
+	seqErrors.AddCorrect()
+	seqErrors.AddConstantError()
+	seqErrors.AddRepairOffset(3)
+	want := Checkpoint{
+		Input:    Input{Path: "/data/reads.fastq.gz", Size: 100, ModTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)},
+		Settings: Settings{Format: File{Path: "/data/scheme.txt"}, SampleErrors: -1, CountedErrors: 2},
+		Reads:    4,
+		Counts:   counts.State(),
+		Errors:   seqErrors.Summary(),
+	}
+	if err := Write(checkpointPath, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Version = version
+	if err := got.Check(want.Input, want.Settings); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+	if !reflect.DeepEqual(got.Errors, want.Errors) || got.Reads != want.Reads {
+		t.Errorf("Read() = %+v, want %+v", got, want)
+	}
+
+	restored := results.NewCount([]string{"AAAA", "CCCC"})
+	restored.Restore(got.Counts)
+	if !reflect.DeepEqual(restored.State(), counts.State()) {
+		t.Errorf("restored counts = %+v, want %+v", restored.State(), counts.State())
+	}
+	var restoredErrors results.ParseErrors
+	restoredErrors.Restore(got.Errors)
+	if !reflect.DeepEqual(restoredErrors.Summary(), seqErrors.Summary()) {
+		t.Errorf("restored errors = %+v, want %+v", restoredErrors.Summary(), seqErrors.Summary())
+	}
+
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(checkpointPath), "*"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("files next to the checkpoint = %v, want only the checkpoint", files)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	input := Input{Path: "/data/reads.fastq.gz", Size: 100, ModTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)}
+	settings := Settings{Format: File{Path: "/data/scheme.txt"}, SampleErrors: -1}
+	checkpoint := Checkpoint{Version: version, Input: input, Settings: settings}
+	changedSize, changedTime, changedErrors, changedFormat, addedCounted := input, input, settings, settings, settings
+	changedSize.Size = 101
+	changedTime.ModTime = changedTime.ModTime.Add(time.Second)
+	changedErrors.SampleErrors = 1
+	changedFormat.Format.Hash[0] = 1
+	addedCounted.CountedBarcodes = File{Path: "/data/counted.csv"}
+	tests := []struct {
+		name       string
+		checkpoint Checkpoint
+		input      Input
+		settings   Settings
+		wantErr    bool
+	}{
+		{"same", checkpoint, input, settings, false},
+		{"file size changed", checkpoint, changedSize, settings, true},
+		{"file modified", checkpoint, changedTime, settings, true},
+		{"errors allowed changed", checkpoint, input, changedErrors, true},
+		{"sequence format edited", checkpoint, input, changedFormat, true},
+		{"counted barcodes added", checkpoint, input, addedCounted, true},
+		{"old version", Checkpoint{Input: input, Settings: settings}, input, settings, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.checkpoint.Check(test.input, test.settings); (err != nil) != test.wantErr {
+				t.Errorf("Check() = %v, want an error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counted.csv")
+	if err := os.WriteFile(path, []byte("Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(file.Path) || file.Hash == [len(file.Hash)]byte{} {
+		t.Errorf("NewFile(%v) = %+v, want an absolute path and a hash", path, file)
+	}
+	// an edit which keeps the size still changes the hash
+	if err := os.WriteFile(path, []byte("Barcode,Barcode_ID,Barcode_Number\nACGT,a2,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if edited, err := NewFile(path); err != nil || edited == file {
+		t.Errorf("NewFile() of the edited file = %+v, %v, want a different hash", edited, err)
+	}
+	if unused, err := NewFile(""); err != nil || unused != (File{}) {
+		t.Errorf("NewFile(\"\") = %+v, %v, want the empty File", unused, err)
+	}
+}
+
+// TestWriterWaits checks that Writer.Write waits for the parsing threads to count every read posted before the checkpoint
+func TestWriterWaits(t *testing.T) {
+	checkpointPath := filepath.Join(t.TempDir(), "count.checkpoint")
+	var seqErrors results.ParseErrors
+	writer := NewWriter(checkpointPath, Input{}, Settings{}, results.NewCount(nil), &seqErrors)
+	seqErrors.AddCorrect()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		seqErrors.AddSampleError()
+	}()
+	if err := writer.Write(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Reads != 2 || got.Errors.Reads() != 2 {
+		t.Errorf("checkpoint of %v reads holds %v parsed reads, want 2", got.Reads, got.Errors.Reads())
+	}
+}
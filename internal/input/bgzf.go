@@ -0,0 +1,209 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// bgzfHeaderSize is the size of the gzip header up to and including XLEN
+	bgzfHeaderSize = 12
+	// bgzfMaxBlockSize is the largest BGZF block, compressed or decompressed
+	bgzfMaxBlockSize = 1 << 16
+	// bgzfFooterSize is the CRC32 and ISIZE at the end of each block
+	bgzfFooterSize = 8
+)
+
+// isBGZF returns whether start, the first bytes of a gzip file, is the header of a BGZF block.  BGZF blocks have the
+// 'BC' extra subfield holding the block size, and only the extra field flag is set
+func isBGZF(start []byte) bool {
+	if len(start) < bgzfHeaderSize || start[0] != 0x1f || start[1] != 0x8b || start[2] != 8 || start[3] != 4 {
+		return false
+	}
+	extraSize := int(binary.LittleEndian.Uint16(start[10:12]))
+	if len(start) < bgzfHeaderSize+extraSize {
+		return false
+	}
+	_, ok := bgzfBlockSize(start[bgzfHeaderSize : bgzfHeaderSize+extraSize])
+	return ok
+}
+
+// bgzfBlockSize returns the total block size from the 'BC' subfield of the gzip extra field
+func bgzfBlockSize(extra []byte) (int, bool) {
+	for len(extra) >= 4 {
+		subfieldSize := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if extra[0] == 'B' && extra[1] == 'C' && subfieldSize == 2 && len(extra) >= 6 {
+			return int(binary.LittleEndian.Uint16(extra[4:6])) + 1, true
+		}
+		if len(extra) < 4+subfieldSize {
+			break
+		}
+		extra = extra[4+subfieldSize:]
+	}
+	return 0, false
+}
+
+// bgzfBlock is a compressed block, which is replaced by the decompressed block once a worker finishes it
+type bgzfBlock struct {
+	data []byte
+	err  error
+	// done is closed once data holds the decompressed block
+	done chan struct{}
+}
+
+// bgzfReader decompresses the blocks of a BGZF file in parallel.  A reader goroutine splits the file into blocks using the
+// block size within each header, worker goroutines decompress the blocks, and Read returns the blocks in file order
+type bgzfReader struct {
+	// blocks holds the blocks in file order.  It is buffered so that the workers can decompress ahead of Read
+	blocks  chan *bgzfBlock
+	current *bgzfBlock
+	offset  int
+	err     error
+	// stop is closed by Close so that the goroutines exit before the end of the file
+	stop     chan struct{}
+	stopOnce sync.Once
+	buffers  sync.Pool
+}
+
+// newBGZFReader creates a bgzfReader which decompresses with workers goroutines
+func newBGZFReader(reader io.Reader, workers int) *bgzfReader {
+	if workers < 1 {
+		workers = 1
+	}
+	b := &bgzfReader{
+		blocks: make(chan *bgzfBlock, 4*workers),
+		stop:   make(chan struct{}),
+	}
+	b.buffers.New = func() interface{} { return make([]byte, 0, bgzfMaxBlockSize) }
+	jobs := make(chan *bgzfBlock, 4*workers)
+	for i := 0; i < workers; i++ {
+		go b.decompress(jobs)
+	}
+	go b.split(bufio.NewReaderSize(reader, 4*bgzfMaxBlockSize), jobs)
+	return b
+}
+
+// split reads each compressed block and sends it to both the workers and Read.  Errors are sent as a block so that Read
+// returns them in file order
+func (b *bgzfReader) split(reader *bufio.Reader, jobs chan<- *bgzfBlock) {
+	defer close(b.blocks)
+	defer close(jobs)
+	for {
+		block := &bgzfBlock{done: make(chan struct{})}
+		block.data, block.err = b.readBlock(reader)
+		if block.err == io.EOF {
+			return
+		}
+		if block.err != nil {
+			close(block.done)
+		}
+		select {
+		case b.blocks <- block:
+		case <-b.stop:
+			return
+		}
+		if block.err != nil {
+			return
+		}
+		select {
+		case jobs <- block:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// readBlock reads the next compressed block, including the header and footer.  io.EOF is returned at the end of the file
+func (b *bgzfReader) readBlock(reader *bufio.Reader) ([]byte, error) {
+	header, err := reader.Peek(bgzfHeaderSize)
+	if len(header) == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("truncated BGZF block header: %w", io.ErrUnexpectedEOF)
+	}
+	extraSize := int(binary.LittleEndian.Uint16(header[10:12]))
+	header, err = reader.Peek(bgzfHeaderSize + extraSize)
+	if err != nil || !isBGZF(header) {
+		return nil, errors.New("not a BGZF block, the file may be a mix of BGZF and gzip")
+	}
+	blockSize, _ := bgzfBlockSize(header[bgzfHeaderSize:])
+	if blockSize < bgzfHeaderSize+extraSize+bgzfFooterSize {
+		return nil, fmt.Errorf("BGZF block size %v is too small", blockSize)
+	}
+	block := make([]byte, blockSize)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, fmt.Errorf("truncated BGZF block: %w", io.ErrUnexpectedEOF)
+	}
+	return block, nil
+}
+
+// decompress inflates the blocks from jobs and checks the CRC32 and size of each
+func (b *bgzfReader) decompress(jobs <-chan *bgzfBlock) {
+	inflater := flate.NewReader(nil)
+	compressed := bytes.NewReader(nil)
+	var extra [1]byte
+	for block := range jobs {
+		extraSize := int(binary.LittleEndian.Uint16(block.data[10:12]))
+		footer := block.data[len(block.data)-bgzfFooterSize:]
+		size := int(binary.LittleEndian.Uint32(footer[4:]))
+		if size > bgzfMaxBlockSize {
+			block.err = fmt.Errorf("BGZF block size %v is too large", size)
+			close(block.done)
+			continue
+		}
+		compressed.Reset(block.data[bgzfHeaderSize+extraSize : len(block.data)-bgzfFooterSize])
+		inflater.(flate.Resetter).Reset(compressed, nil)
+		decompressed := b.buffers.Get().([]byte)[:size]
+		if _, err := io.ReadFull(inflater, decompressed); err != nil {
+			block.err = fmt.Errorf("BGZF block: %w", err)
+		} else if n, _ := inflater.Read(extra[:]); n != 0 {
+			block.err = errors.New("BGZF block size error")
+		} else if crc32.ChecksumIEEE(decompressed) != binary.LittleEndian.Uint32(footer[:4]) {
+			block.err = errors.New("BGZF block checksum error")
+		}
+		block.data = decompressed
+		close(block.done)
+	}
+}
+
+// Read returns the decompressed blocks in file order
+func (b *bgzfReader) Read(p []byte) (int, error) {
+	for b.current == nil || b.offset == len(b.current.data) {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.current != nil {
+			b.buffers.Put(b.current.data[:0])
+			b.current = nil
+		}
+		block, ok := <-b.blocks
+		if !ok {
+			b.err = io.EOF
+			continue
+		}
+		<-block.done
+		if block.err != nil {
+			b.err = block.err
+			continue
+		}
+		b.current, b.offset = block, 0
+	}
+	n := copy(p, b.current.data[b.offset:])
+	b.offset += n
+	return n, nil
+}
+
+// Close stops the reader and worker goroutines.  It does not close the underlying reader
+func (b *bgzfReader) Close() error {
+	b.stopOnce.Do(func() { close(b.stop) })
+	return nil
+}
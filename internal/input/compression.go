@@ -0,0 +1,205 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// StdinPath is used in place of a file path to read from stdin
+const StdinPath = "-"
+
+// Compression is the compression format of a fastq file
+type Compression int
+
+const (
+	// Plain is an uncompressed fastq file
+	Plain Compression = iota
+	Gzip
+	// Bgzf is gzip made of independent blocks of at most 64KB, which are decompressed in parallel
+	Bgzf
+	Bzip2
+	Xz
+	Zstd
+)
+
+// String returns the name of the compression format
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Bgzf:
+		return "bgzf"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	default:
+		return "plain"
+	}
+}
+
+// magicBytes holds the bytes at the start of a file of each compression format.  BGZF files have the gzip magic bytes and
+// are told apart by the gzip header
+var magicBytes = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Bzip2, []byte("BZh")},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// DetectCompression returns the compression format from the magic bytes at the start of reader without reading past them.
+// Anything which does not start with the magic bytes of a compression format is Plain
+func DetectCompression(reader *bufio.Reader) (Compression, error) {
+	for _, format := range magicBytes {
+		start, err := reader.Peek(len(format.magic))
+		if err != nil && err != io.EOF {
+			return Plain, err
+		}
+		if bytes.Equal(start, format.magic) {
+			if format.compression == Gzip && peekBGZF(reader) {
+				return Bgzf, nil
+			}
+			return format.compression, nil
+		}
+	}
+	return Plain, nil
+}
+
+// peekBGZF returns whether reader starts with a BGZF block header
+func peekBGZF(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(bgzfHeaderSize)
+	if len(header) < bgzfHeaderSize {
+		return false
+	}
+	header, _ = reader.Peek(bgzfHeaderSize + int(binary.LittleEndian.Uint16(header[10:12])))
+	return isBGZF(header)
+}
+
+// Decompress returns a reader of the decompressed contents of reader, with the compression format detected from the magic
+// bytes.  BGZF blocks are decompressed by GOMAXPROCS goroutines, and gzip is decompressed ahead of the reads within its own
+// goroutine, so that decompression is not limited to the thread reading the sequences.  The returned reader needs to be
+// closed, which does not close reader
+func Decompress(reader io.Reader) (io.ReadCloser, Compression, error) {
+	buffered := bufio.NewReader(reader)
+	compression, err := DetectCompression(buffered)
+	if err != nil {
+		return nil, compression, err
+	}
+	var decompressed io.ReadCloser
+	switch compression {
+	case Gzip:
+		decompressed, err = pgzip.NewReader(buffered)
+	case Bgzf:
+		decompressed = newBGZFReader(buffered, runtime.GOMAXPROCS(0))
+	case Bzip2:
+		decompressed = io.NopCloser(bzip2.NewReader(buffered))
+	case Xz:
+		var xzReader *xz.Reader
+		xzReader, err = xz.NewReader(buffered)
+		decompressed = io.NopCloser(xzReader)
+	case Zstd:
+		var zstdReader *zstd.Decoder
+		zstdReader, err = zstd.NewReader(buffered)
+		if err == nil {
+			decompressed = zstdReader.IOReadCloser()
+		}
+	default:
+		decompressed = io.NopCloser(buffered)
+	}
+	if err != nil {
+		return nil, compression, fmt.Errorf("%v: %w", compression, err)
+	}
+	return decompressed, compression, nil
+}
+
+// countingReader counts the bytes read from the compressed file.  The count is atomic as the file is read by the
+// decompression goroutines
+type countingReader struct {
+	reader io.Reader
+	bytes  int64
+}
+
+// Read reads from the wrapped reader
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.bytes, int64(n))
+	return n, err
+}
+
+// fastqFile is an open fastq file along with its decompressed reader
+type fastqFile struct {
+	io.ReadCloser
+	file    *os.File
+	counter *countingReader
+}
+
+// BytesRead returns the number of bytes read from the file before decompression
+func (f *fastqFile) BytesRead() int64 {
+	return atomic.LoadInt64(&f.counter.bytes)
+}
+
+// Close closes the decompressed reader then the file.  Stdin is not closed
+func (f *fastqFile) Close() error {
+	err := f.ReadCloser.Close()
+	if f.file != os.Stdin {
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// fastqName returns the name of the fastq file used within errors and messages
+func fastqName(fastqPath string) string {
+	if fastqPath == StdinPath {
+		return "stdin"
+	}
+	return fastqPath
+}
+
+// OpenFastq opens the fastq file, or stdin when fastqPath is StdinPath, and returns a reader of the decompressed contents
+// along with the compression format
+func OpenFastq(fastqPath string) (io.ReadCloser, Compression, error) {
+	fastq, compression, err := openFastq(fastqPath)
+	if err != nil {
+		return nil, compression, err
+	}
+	return fastq, compression, nil
+}
+
+// openFastq opens the fastq file in the same way as OpenFastq, and counts the bytes read from the file
+func openFastq(fastqPath string) (*fastqFile, Compression, error) {
+	file := os.Stdin
+	if fastqPath != StdinPath {
+		var err error
+		file, err = os.Open(fastqPath)
+		if err != nil {
+			return nil, Plain, err
+		}
+	}
+	counter := &countingReader{reader: file}
+	decompressed, compression, err := Decompress(counter)
+	if err != nil {
+		if file != os.Stdin {
+			file.Close()
+		}
+		return nil, compression, fmt.Errorf("%v: %w", fastqName(fastqPath), err)
+	}
+	return &fastqFile{ReadCloser: decompressed, file: file, counter: counter}, compression, nil
+}
@@ -0,0 +1,171 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFastq returns readNum random fastq records
+func testFastq(readNum int) []byte {
+	random := rand.New(rand.NewSource(1))
+	var fastq bytes.Buffer
+	for i := 0; i < readNum; i++ {
+		sequence := make([]byte, 60)
+		for j := range sequence {
+			sequence[j] = "ATGC"[random.Intn(4)]
+		}
+		fmt.Fprintf(&fastq, "@read_%v\n%s\n+\n%v\n", i, sequence, strings.Repeat("I", len(sequence)))
+	}
+	return fastq.Bytes()
+}
+
+// writeBGZF compresses contents as BGZF blocks of at most blockSize bytes, followed by the empty end of file block
+func writeBGZF(t testing.TB, contents []byte, blockSize int) []byte {
+	t.Helper()
+	var bgzf bytes.Buffer
+	for start := 0; ; start += blockSize {
+		end := start + blockSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		var block bytes.Buffer
+		writer := gzip.NewWriter(&block)
+		// the block size is filled in once the block is compressed
+		writer.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		if _, err := writer.Write(contents[start:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		blockBytes := block.Bytes()
+		binary.LittleEndian.PutUint16(blockBytes[16:18], uint16(len(blockBytes)-1))
+		bgzf.Write(blockBytes)
+		if end == len(contents) {
+			break
+		}
+	}
+	return bgzf.Bytes()
+}
+
+// gzipMembers compresses contents as one gzip member per memberSize bytes
+func gzipMembers(t testing.TB, contents []byte, memberSize int) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	for start := 0; start < len(contents); start += memberSize {
+		end := start + memberSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(contents[start:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return compressed.Bytes()
+}
+
+func TestDecompressGzip(t *testing.T) {
+	fastq := testFastq(20000)
+	tests := []struct {
+		name        string
+		compressed  []byte
+		compression Compression
+	}{
+		{"bgzf", writeBGZF(t, fastq, 60000), Bgzf},
+		{"bgzf small blocks", writeBGZF(t, fastq, 1000), Bgzf},
+		{"gzip", gzipMembers(t, fastq, len(fastq)), Gzip},
+		{"multiple gzip members", gzipMembers(t, fastq, 100000), Gzip},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, compression, err := Decompress(bytes.NewReader(test.compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if compression != test.compression {
+				t.Errorf("compression = %v, want %v", compression, test.compression)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fastq) {
+				t.Errorf("decompressed %v bytes which differ from the %v byte fastq", len(got), len(fastq))
+			}
+		})
+	}
+}
+
+func TestBGZFErrors(t *testing.T) {
+	fastq := testFastq(2000)
+	corrupt := writeBGZF(t, fastq, 60000)
+	// the CRC32 of the first block is 8 bytes before the end of the block
+	firstBlockSize := int(binary.LittleEndian.Uint16(corrupt[16:18])) + 1
+	corrupt[firstBlockSize-8]++
+	truncated := writeBGZF(t, fastq, 60000)
+	truncated = truncated[:len(truncated)-10]
+	mixed := append(writeBGZF(t, fastq, 60000), gzipMembers(t, fastq, len(fastq))...)
+	tests := []struct {
+		name       string
+		compressed []byte
+		want       string
+	}{
+		{"checksum", corrupt, "checksum error"},
+		{"truncated", truncated, "truncated BGZF block"},
+		{"gzip after bgzf", mixed, "not a BGZF block"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, _, err := Decompress(bytes.NewReader(test.compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// BenchmarkDecompress measures the decompression throughput of gzip and BGZF
+func BenchmarkDecompress(b *testing.B) {
+	fastq := testFastq(200000)
+	benchmarks := []struct {
+		name       string
+		compressed []byte
+	}{
+		{"gzip", gzipMembers(b, fastq, len(fastq))},
+		{"bgzf", writeBGZF(b, fastq, 65280)},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.SetBytes(int64(len(fastq)))
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				reader, _, err := Decompress(bytes.NewReader(benchmark.compressed))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+				reader.Close()
+			}
+			b.ReportMetric(float64(b.N*200000)/time.Since(start).Seconds(), "reads/s")
+		})
+	}
+}
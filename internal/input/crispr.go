@@ -0,0 +1,87 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CrisprLibrary holds the guide information for CRISPR screens.  Each guide is a single counted barcode which is aggregated
+// by gene for the gene level counts
+type CrisprLibrary struct {
+	// Guides is a slice of guide DNA sequences in the same order as the library file
+	Guides []string
+	// GuideIds is a map where the key is the guide DNA sequence and the value is the guide ID
+	GuideIds map[string]string
+	// Genes is a map where the key is the guide DNA sequence and the value is the gene targeted by the guide
+	Genes map[string]string
+	// GeneOrder is a slice of the genes in the order they first appear within the library file
+	GeneOrder []string
+	Included  bool
+}
+
+// NewCrisprLibrary creates a CrisprLibrary struct from the CRISPR library file.  The file has a header, followed by rows of
+// guide sequence, guide ID and gene.  The sequence format must have a single counted barcode for the guide, and each guide
+// must be the size of this counted barcode
+func NewCrisprLibrary(libraryFilePath string, format SequenceFormat) (CrisprLibrary, error) {
+	var library CrisprLibrary
+	if len(libraryFilePath) == 0 {
+		return library, nil
+	}
+	library.Included = true
+	if format.CountedBarcodeNum != 1 {
+		return library, fmt.Errorf("CRISPR library requires a single counted barcode within the sequence format.  %v found", format.CountedBarcodeNum)
+	}
+	library.GuideIds = make(map[string]string)
+	library.Genes = make(map[string]string)
+
+	file, err := os.Open(libraryFilePath)
+	if err != nil {
+		return library, err
+	}
+	defer file.Close()
+
+	// genesFound is used to keep the order of the genes as they first appear
+	genesFound := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // remove the header
+	lineNum := 1
+	for scanner.Scan() {
+		lineNum++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := strings.Split(scanner.Text(), ",")
+		if len(row) < 3 {
+			return library, fmt.Errorf("%v: line %v: expected guide sequence, guide ID and gene columns", libraryFilePath, lineNum)
+		}
+		guide := row[0]
+		if err := validateBarcode(guide, format.CountedBarcodesSizes[0]); err != nil {
+			return library, fmt.Errorf("%v: line %v: guide %w", libraryFilePath, lineNum, err)
+		}
+		if _, ok := library.GuideIds[guide]; ok {
+			return library, fmt.Errorf("%v: line %v: duplicate guide sequence '%v'", libraryFilePath, lineNum, guide)
+		}
+		library.Guides = append(library.Guides, guide)
+		library.GuideIds[guide] = row[1]
+		library.Genes[guide] = row[2]
+		if _, ok := genesFound[row[2]]; !ok {
+			genesFound[row[2]] = struct{}{}
+			library.GeneOrder = append(library.GeneOrder, row[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return library, fmt.Errorf("%v: %w", libraryFilePath, err)
+	}
+	return library, nil
+}
+
+// CountedBarcodes converts the guides into a CountedBarcodes struct so that the guides are error corrected and converted
+// to guide IDs in the same way as any other counted barcode
+func (l CrisprLibrary) CountedBarcodes() CountedBarcodes {
+	countedBarcodes := CountedBarcodes{NumBarcodes: 1, Included: true}
+	countedBarcodes.Conversion = []map[string]string{l.GuideIds}
+	countedBarcodes.Barcodes = [][]string{l.Guides}
+	return countedBarcodes
+}
@@ -0,0 +1,214 @@
+package input
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// exhaustiveLimit is the largest barcode set where every pair of barcodes is compared to find the exact minimum distance
+const exhaustiveLimit = 5000
+
+// minSegmentSize is the smallest segment used to search larger barcode sets.  Smaller segments put so many barcodes within
+// each segment group that the search is as slow as comparing every pair
+const minSegmentSize = 5
+
+// maxPairsPrinted is the number of ambiguous pairs printed per barcode set.  All pairs are kept within the DistanceReport
+const maxPairsPrinted = 10
+
+// DistanceReport holds the pairwise distance analysis of a set of barcodes.  Reads are error corrected to the closest
+// barcode and dropped when there is a tie, so when two barcodes are within 2x the errors allowed of each other, reads can
+// be dropped or assigned to the wrong barcode
+type DistanceReport struct {
+	// Name is the barcode set name used when printing, ie 'Sample barcodes' or 'Counted barcode 1'
+	Name     string
+	Barcodes int
+	// MinDistance is the smallest number of mismatches between any two barcodes, or -1 when there are fewer than 2 barcodes
+	MinDistance int
+	// MinDistanceBound is true when MinDistance is a lower bound because the set was too large to compare every pair
+	MinDistanceBound bool
+	// Skipped is true when the set was too large to search with the errors allowed
+	Skipped bool
+	// MaxSafeErrors is the most errors that can be allowed while every read is still corrected to the right barcode
+	MaxSafeErrors int
+	// MaxErrors is the number of errors allowed during the count
+	MaxErrors int
+	// AmbiguousPairs holds every pair of barcodes which are within 2x MaxErrors of each other
+	AmbiguousPairs []BarcodePair
+}
+
+// BarcodePair is a pair of barcodes and the number of mismatches between them
+type BarcodePair struct {
+	First, Second string
+	// FirstId and SecondId are the barcode IDs from the barcode file
+	FirstId, SecondId string
+	Distance          int
+}
+
+// Safe returns whether MaxErrors is at or below MaxSafeErrors.  Skipped sets are unverified, so they are not safe
+func (r DistanceReport) Safe() bool {
+	return !r.Skipped && (r.MinDistance == -1 || r.MaxErrors <= r.MaxSafeErrors)
+}
+
+// Print outputs the distance analysis to stdout along with the first ambiguous pairs
+func (r DistanceReport) Print() {
+	if r.Skipped {
+		fmt.Printf("%v: %v barcodes, too many to check with %v errors allowed, unverified\n", r.Name, r.Barcodes, r.MaxErrors)
+		return
+	}
+	if r.MinDistance == -1 {
+		fmt.Printf("%v: %v barcodes\n", r.Name, r.Barcodes)
+		return
+	}
+	if r.MinDistanceBound {
+		fmt.Printf("%v: %v barcodes, minimum distance at least %v, maximum safe errors at least %v, errors allowed %v\n", r.Name, r.Barcodes, r.MinDistance, r.MaxSafeErrors, r.MaxErrors)
+	} else {
+		fmt.Printf("%v: %v barcodes, minimum distance %v, maximum safe errors %v, errors allowed %v\n", r.Name, r.Barcodes, r.MinDistance, r.MaxSafeErrors, r.MaxErrors)
+	}
+	for i, pair := range r.AmbiguousPairs {
+		if i == maxPairsPrinted {
+			fmt.Printf("\t...%v more ambiguous pairs\n", len(r.AmbiguousPairs)-maxPairsPrinted)
+			break
+		}
+		fmt.Printf("\t%v (%v) and %v (%v): %v mismatches\n", pair.FirstId, pair.First, pair.SecondId, pair.Second, pair.Distance)
+	}
+}
+
+// CheckDistances finds the minimum pairwise distance within barcodes and every pair within 2x maxErrors of each other.
+// conversion converts the DNA barcodes to their IDs for the report.  Sets larger than exhaustiveLimit only search for the
+// ambiguous pairs, so the minimum distance is a lower bound when none are found.  When the errors allowed are too high to
+// search a large set quickly, the set is skipped
+func CheckDistances(name string, barcodes []string, conversion map[string]string, maxErrors int) DistanceReport {
+	report := DistanceReport{Name: name, Barcodes: len(barcodes), MinDistance: -1, MaxErrors: maxErrors}
+	if len(barcodes) < 2 {
+		return report
+	}
+	sorted := append([]string(nil), barcodes...)
+	sort.Strings(sorted)
+	ambiguousDistance := 2 * maxErrors
+	addPair := func(first string, second string, distance int) {
+		if report.MinDistance == -1 || distance < report.MinDistance {
+			report.MinDistance = distance
+		}
+		if distance <= ambiguousDistance {
+			report.AmbiguousPairs = append(report.AmbiguousPairs, BarcodePair{
+				First: first, Second: second, FirstId: conversion[first], SecondId: conversion[second], Distance: distance,
+			})
+		}
+	}
+	if len(sorted) > exhaustiveLimit && len(sorted[0])/(ambiguousDistance+1) < minSegmentSize {
+		report.Skipped = true
+		return report
+	}
+	if len(sorted) <= exhaustiveLimit {
+		for i, first := range sorted {
+			for _, second := range sorted[i+1:] {
+				// the distance only needs to be exact while it can still be the minimum or an ambiguous pair
+				limit := ambiguousDistance
+				if report.MinDistance == -1 || report.MinDistance > limit {
+					limit = report.MinDistance
+				}
+				addPair(first, second, barcodeDistance(first, second, limit))
+			}
+		}
+	} else {
+		ambiguousPairs(sorted, ambiguousDistance, addPair)
+		if report.MinDistance == -1 {
+			report.MinDistance = ambiguousDistance + 1
+			report.MinDistanceBound = true
+		}
+	}
+	if report.MinDistance > 0 {
+		report.MaxSafeErrors = (report.MinDistance - 1) / 2
+	}
+	sort.SliceStable(report.AmbiguousPairs, func(i, j int) bool { return report.AmbiguousPairs[i].Distance < report.AmbiguousPairs[j].Distance })
+	return report
+}
+
+// ambiguousPairs calls addPair for every pair of barcodes within maxDistance of each other.  When each barcode is split into
+// maxDistance+1 segments, any two barcodes within maxDistance share at least one segment exactly, so only barcodes which
+// share a segment are compared.  Barcodes with an N match any segment and are compared to every barcode
+func ambiguousPairs(barcodes []string, maxDistance int, addPair func(string, string, int)) {
+	segmentNum := maxDistance + 1
+	size := len(barcodes[0])
+	hasN := make(map[int]bool)
+	for i, barcode := range barcodes {
+		if strings.Contains(barcode, "N") {
+			hasN[i] = true
+		}
+	}
+	for i := range hasN {
+		for j := range barcodes {
+			// pairs where both barcodes have an N are only compared once
+			if j != i && (!hasN[j] || j > i) {
+				if distance := barcodeDistance(barcodes[i], barcodes[j], maxDistance); distance <= maxDistance {
+					addPair(barcodes[i], barcodes[j], distance)
+				}
+			}
+		}
+	}
+	// segmentStart returns the start of the segment so that the segments cover the barcode with sizes differing by at most 1
+	segmentStart := func(segment int) int { return segment * size / segmentNum }
+	for segment := 0; segment < segmentNum; segment++ {
+		buckets := make(map[string][]int)
+		for i, barcode := range barcodes {
+			if !hasN[i] {
+				key := barcode[segmentStart(segment):segmentStart(segment+1)]
+				buckets[key] = append(buckets[key], i)
+			}
+		}
+		for _, bucket := range buckets {
+			for a, i := range bucket {
+				for _, j := range bucket[a+1:] {
+					// pairs which share an earlier segment were already compared
+					if sharesEarlierSegment(barcodes[i], barcodes[j], segment, segmentStart) {
+						continue
+					}
+					if distance := barcodeDistance(barcodes[i], barcodes[j], maxDistance); distance <= maxDistance {
+						addPair(barcodes[i], barcodes[j], distance)
+					}
+				}
+			}
+		}
+	}
+}
+
+// sharesEarlierSegment returns whether the barcodes are identical within any segment before segment
+func sharesEarlierSegment(first string, second string, segment int, segmentStart func(int) int) bool {
+	for earlier := 0; earlier < segment; earlier++ {
+		if first[segmentStart(earlier):segmentStart(earlier+1)] == second[segmentStart(earlier):segmentStart(earlier+1)] {
+			return true
+		}
+	}
+	return false
+}
+
+// barcodeDistance returns the number of mismatches between the barcodes in the same way as the error correction, where an
+// N matches any nucleotide.  Counting stops once the mismatches are above limit, unless limit is -1
+func barcodeDistance(first string, second string, limit int) int {
+	var mismatches int
+	for i := 0; i < len(first) && i < len(second); i++ {
+		if first[i] != second[i] && first[i] != 'N' && second[i] != 'N' {
+			mismatches++
+			if limit != -1 && mismatches > limit {
+				break
+			}
+		}
+	}
+	return mismatches
+}
+
+// CheckBarcodeDesign runs CheckDistances on the sample barcodes and each counted barcode position when they are included
+func CheckBarcodeDesign(sampleBarcodes SampleBarcodes, countedBarcodes CountedBarcodes, sampleErrors int, countedErrors int) []DistanceReport {
+	var reports []DistanceReport
+	if sampleBarcodes.Included {
+		reports = append(reports, CheckDistances("Sample barcodes", sampleBarcodes.Barcodes, sampleBarcodes.Conversion, sampleErrors))
+	}
+	if countedBarcodes.Included {
+		for i, barcodes := range countedBarcodes.Barcodes {
+			name := fmt.Sprintf("Counted barcode %v", i+1)
+			reports = append(reports, CheckDistances(name, barcodes, countedBarcodes.Conversion[i], countedErrors))
+		}
+	}
+	return reports
+}
@@ -0,0 +1,178 @@
+package input
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Validation is how malformed FASTQ records are handled
+type Validation string
+
+const (
+	// StrictValidation stops at the first malformed record with an error.  It is the default, which includes the zero value
+	StrictValidation Validation = "strict"
+	// LenientValidation skips malformed records and continues from the next record
+	LenientValidation Validation = "lenient"
+)
+
+// ReadOptions holds how the reads file is read
+type ReadOptions struct {
+	// Tags are the SAM or BAM tags which hold the sample and random barcodes
+	Tags BarcodeTags
+	// Validation is how malformed FASTQ records are handled
+	Validation Validation
+	// Skipped, if not nil, is called with each malformed FASTQ record which is skipped by LenientValidation
+	Skipped func(*RecordError)
+	// Skip is the number of reads at the start of the file which are read but not posted, as they were counted before the
+	// checkpoint which is resumed
+	Skip int
+	// Checkpoint, if not nil, is called after every CheckpointEvery reads are posted, with the total reads so far.  The
+	// reader waits for Checkpoint to return
+	Checkpoint      func(totalReads int)
+	CheckpointEvery int
+	// Progress, if not nil, is called by ReadFastq every 10,000 reads with the total reads and the bytes of the reads file read
+	// so far.  The bytes are counted before decompression
+	Progress func(totalReads int, bytesRead int64)
+}
+
+// readPoster posts the reads of a scanner to the sequences channel.  It counts the reads, skips the first options.Skip,
+// and calls the progress and checkpoint functions.  Posting stops once ctx is done
+type readPoster struct {
+	ctx        context.Context
+	sequences  chan<- Read
+	options    ReadOptions
+	progress   func(int)
+	totalReads int
+}
+
+// post posts the read to the sequences channel.  Once ctx is done, the read is not posted or counted and the error of ctx is
+// returned, so that the reader does not wait on parsing threads which have stopped
+func (p *readPoster) post(read Read) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	p.totalReads++
+	if p.totalReads > p.options.Skip {
+		select {
+		case p.sequences <- read:
+		case <-p.ctx.Done():
+			p.totalReads--
+			return p.ctx.Err()
+		}
+		if p.options.Checkpoint != nil && p.options.CheckpointEvery > 0 && p.totalReads%p.options.CheckpointEvery == 0 {
+			p.options.Checkpoint(p.totalReads)
+		}
+	}
+	if p.progress != nil && p.totalReads%10000 == 0 {
+		p.progress(p.totalReads)
+	}
+	return nil
+}
+
+// RecordError is a malformed FASTQ record
+type RecordError struct {
+	// Record is the number of the record within the file, starting at 1.  Malformed records are included
+	Record int
+	// Line is the first line of the record
+	Line   int
+	Reason string
+}
+
+// Error returns the record number, line and reason
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %v (line %v): %v", e.Record, e.Line, e.Reason)
+}
+
+// fastqWindow holds up to 4 lines, which are checked as the next FASTQ record.  The line buffers are reused so that reading
+// and checking each record does not allocate
+type fastqWindow struct {
+	scanner *bufio.Scanner
+	lines   [4][]byte
+	size    int
+	// lineNum is the line number of the first line within the window
+	lineNum int
+}
+
+// fill reads lines until the window holds 4 lines or the file ends
+func (w *fastqWindow) fill() {
+	for w.size < 4 && w.scanner.Scan() {
+		w.lines[w.size] = append(w.lines[w.size][:0], w.scanner.Bytes()...)
+		w.size++
+	}
+}
+
+// drop removes the first n lines of the window, keeping their buffers for the next lines
+func (w *fastqWindow) drop(n int) {
+	for i := 0; i < n; i++ {
+		first := w.lines[0]
+		copy(w.lines[:], w.lines[1:])
+		w.lines[len(w.lines)-1] = first
+	}
+	w.size -= n
+	w.lineNum += n
+}
+
+// check returns why the lines within the window are not a FASTQ record, or an empty string when they are
+func (w *fastqWindow) check() string {
+	switch {
+	case w.size < 4:
+		return fmt.Sprintf("truncated record of %v lines", w.size)
+	case len(w.lines[0]) == 0 || w.lines[0][0] != '@':
+		return "header line does not start with '@'"
+	case len(w.lines[2]) == 0 || w.lines[2][0] != '+':
+		return "separator line does not start with '+'"
+	case len(w.lines[1]) != len(w.lines[3]):
+		return fmt.Sprintf("sequence is %v nucleotides, but the quality is %v characters", len(w.lines[1]), len(w.lines[3]))
+	}
+	return ""
+}
+
+// ScanFastq reads the fastq records from reader and posts the sequence to the sequences channel.  Each record is checked for
+// the '@' header, the '+' separator and a quality the same length as the sequence.  With StrictValidation the first malformed
+// record is returned as a *RecordError.  With LenientValidation it is passed to options.Skipped, and the lines are skipped
+// one at a time until the next record is found.  Blank lines between records are ignored.  progress, if not nil, is called
+// every 10,000 reads with the total reads so far.  The total number of reads, including options.Skip, is returned.  Reading
+// stops with the error of ctx once it is done.  sequences is not closed
+func ScanFastq(ctx context.Context, reader io.Reader, options ReadOptions, sequences chan<- Read, progress func(int)) (int, error) {
+	poster := readPoster{ctx: ctx, sequences: sequences, options: options, progress: progress}
+	recordNum := 0
+	window := fastqWindow{scanner: newLineScanner(reader), lineNum: 1}
+	// malformed is set once a malformed record is found, until the next record, so that each malformed record is reported once
+	malformed := false
+	for {
+		window.fill()
+		for window.size > 0 && len(window.lines[0]) == 0 {
+			window.drop(1)
+			window.fill()
+		}
+		if err := window.scanner.Err(); err != nil {
+			return poster.totalReads, err
+		}
+		if window.size == 0 {
+			return poster.totalReads, nil
+		}
+		if reason := window.check(); reason != "" {
+			if !malformed {
+				recordNum++
+				err := &RecordError{Record: recordNum, Line: window.lineNum, Reason: reason}
+				if options.Validation != LenientValidation {
+					return poster.totalReads, err
+				}
+				if options.Skipped != nil {
+					options.Skipped(err)
+				}
+				malformed = true
+			}
+			window.drop(1)
+			continue
+		}
+		malformed = false
+		recordNum++
+		if err := poster.post(Read{Sequence: string(window.lines[1])}); err != nil {
+			return poster.totalReads, err
+		}
+		window.drop(4)
+	}
+}
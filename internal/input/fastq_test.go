@@ -0,0 +1,112 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanFastqValidation(t *testing.T) {
+	const (
+		good  = "@read_1\nAGCT\n+\nIIII\n"
+		good2 = "@read_2\nTTGA\n+read_2\nI@II\n"
+	)
+	tests := []struct {
+		name  string
+		fastq string
+		// want is the sequences read with LenientValidation, and wantSkipped the records it skips
+		want        []string
+		wantSkipped []RecordError
+	}{
+		{"valid", good + good2, []string{"AGCT", "TTGA"}, nil},
+		{"blank lines between records", good + "\n" + good2 + "\n\n", []string{"AGCT", "TTGA"}, nil},
+		{"windows line endings", strings.ReplaceAll(good+good2, "\n", "\r\n"), []string{"AGCT", "TTGA"}, nil},
+		{"empty sequence", "@read_1\n\n+\n\n" + good2, []string{"", "TTGA"}, nil},
+		{"missing header", good + "AGCT\n+\nIIII\n" + good2, []string{"AGCT", "TTGA"},
+			[]RecordError{{Record: 2, Line: 5, Reason: "header line does not start with '@'"}}},
+		{"missing separator", good + "@read_x\nAGCT\nIIII\n" + good2, []string{"AGCT", "TTGA"},
+			[]RecordError{{Record: 2, Line: 5, Reason: "separator line does not start with '+'"}}},
+		{"short quality", good + "@read_x\nAGCT\n+\nIII\n" + good2, []string{"AGCT", "TTGA"},
+			[]RecordError{{Record: 2, Line: 5, Reason: "sequence is 4 nucleotides, but the quality is 3 characters"}}},
+		{"quality starting with @ after a missing line", "@read_x\nAGCT\n@III\n" + good + good2, []string{"AGCT", "TTGA"},
+			[]RecordError{{Record: 1, Line: 1, Reason: "separator line does not start with '+'"}}},
+		{"truncated", good + "@read_x\nAGCT\n", []string{"AGCT"},
+			[]RecordError{{Record: 2, Line: 5, Reason: "truncated record of 2 lines"}}},
+		{"two malformed records", good + "@read_x\nAGCT\n+\nIII\n" + good2 + "AGCT\n", []string{"AGCT", "TTGA"},
+			[]RecordError{{Record: 2, Line: 5, Reason: "sequence is 4 nucleotides, but the quality is 3 characters"},
+				{Record: 4, Line: 13, Reason: "truncated record of 1 lines"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scan := func(options ReadOptions) ([]string, error) {
+				sequences := make(chan Read, 10)
+				_, err := ScanFastq(context.Background(), strings.NewReader(test.fastq), options, sequences, nil)
+				close(sequences)
+				var got []string
+				for read := range sequences {
+					got = append(got, read.Sequence)
+				}
+				return got, err
+			}
+
+			var skipped []RecordError
+			got, err := scan(ReadOptions{Validation: LenientValidation, Skipped: func(err *RecordError) { skipped = append(skipped, *err) }})
+			if err != nil {
+				t.Fatalf("lenient validation error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(skipped, test.wantSkipped) {
+				t.Errorf("lenient validation read %q and skipped %+v, want %q and %+v", got, skipped, test.want, test.wantSkipped)
+			}
+
+			_, err = scan(ReadOptions{Validation: StrictValidation})
+			var recordErr *RecordError
+			if len(test.wantSkipped) == 0 {
+				if err != nil {
+					t.Errorf("strict validation error = %v", err)
+				}
+			} else if !errors.As(err, &recordErr) || *recordErr != test.wantSkipped[0] {
+				t.Errorf("strict validation error = %v, want %v", err, &test.wantSkipped[0])
+			}
+		})
+	}
+}
+
+func TestReadOptionsSkipCheckpoint(t *testing.T) {
+	var fastq strings.Builder
+	for i := 0; i < 10; i++ {
+		fastq.WriteString("@read\n" + strings.Repeat("A", i+1) + "\n+\n" + strings.Repeat("I", i+1) + "\n")
+	}
+	var checkpoints []int
+	options := ReadOptions{Skip: 4, CheckpointEvery: 3, Checkpoint: func(totalReads int) { checkpoints = append(checkpoints, totalReads) }}
+	sequences := make(chan Read, 10)
+	totalReads, err := ScanFastq(context.Background(), strings.NewReader(fastq.String()), options, sequences, nil)
+	close(sequences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lengths []int
+	for read := range sequences {
+		lengths = append(lengths, len(read.Sequence))
+	}
+	if totalReads != 10 || !reflect.DeepEqual(lengths, []int{5, 6, 7, 8, 9, 10}) || !reflect.DeepEqual(checkpoints, []int{6, 9}) {
+		t.Errorf("ScanFastq read %v reads, posted reads of lengths %v with checkpoints %v, want 10, 5 to 10 and [6 9]", totalReads, lengths, checkpoints)
+	}
+}
+
+// TestScanFastqCancel checks that reading stops once ctx is done, without posting or counting the next read
+func TestScanFastqCancel(t *testing.T) {
+	var fastq strings.Builder
+	for i := 0; i < 10; i++ {
+		fastq.WriteString("@read\nAGCT\n+\nIIII\n")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := ReadOptions{CheckpointEvery: 3, Checkpoint: func(int) { cancel() }}
+	sequences := make(chan Read, 10)
+	totalReads, err := ScanFastq(ctx, strings.NewReader(fastq.String()), options, sequences, nil)
+	if !errors.Is(err, context.Canceled) || totalReads != 3 || len(sequences) != 3 {
+		t.Errorf("ScanFastq = %v reads with %v posted and error %v, want 3, 3 and %v", totalReads, len(sequences), err, context.Canceled)
+	}
+}
@@ -2,14 +2,19 @@ package input
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
 )
 
 const NoSampleName = "barcode"
@@ -26,28 +31,92 @@ type SequenceFormat struct {
 	SampleSize           int
 	CountedBarcodesSizes []int
 	CountedBarcodeNum    int
+	// Regions holds each part of the sequence format in order.  This is used wherever the layout of the read is needed
+	// without the regex, such as inspecting the format or simulating reads
+	Regions []FormatRegion
+	// Tags are the SAM or BAM tags which hold the sample and random barcodes in place of the read.  The sequence format does
+	// not have the barcode of a tag, and SampleSize is the size of the sample barcodes when the sample barcode is a tag
+	Tags BarcodeTags
+}
+
+// RegionKind is the type of a region within the sequence format
+type RegionKind int
+
+const (
+	ConstantRegion RegionKind = iota
+	SampleRegion
+	CountedRegion
+	RandomRegion
+	AnyRegion // Ns within the sequence format, which match any nucleotide
+)
+
+// String returns the name of the region kind
+func (k RegionKind) String() string {
+	switch k {
+	case ConstantRegion:
+		return "constant"
+	case SampleRegion:
+		return "sample"
+	case CountedRegion:
+		return "counted"
+	case RandomRegion:
+		return "random"
+	default:
+		return "any"
+	}
+}
+
+// FormatRegion is a single part of the sequence format
+type FormatRegion struct {
+	Kind RegionKind
+	Size int
+	// Sequence is the DNA sequence of a constant region, otherwise empty
+	Sequence string
+	// Index is the counted barcode number, starting at 1, of a counted region, otherwise 0
+	Index int
 }
 
 // AddSearchRegex method uses the format scheme within the format file to create the FormatRegex, FormatString, and ConstantSize.
-func (f *SequenceFormat) AddSearchRegex(formatFilePath string) {
-	// formatText contains all text from the formatFile that is from a line not preceded by '#'
-	var formatText string
+func (f *SequenceFormat) AddSearchRegex(formatFilePath string) error {
 	file, err := os.Open(formatFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	scanner := bufio.NewScanner(file)
+	defer file.Close()
+	format, err := ParseSequenceFormat(file)
+	if err != nil {
+		return fmt.Errorf("%v: %w", formatFilePath, err)
+	}
+	*f = format
+	return nil
+}
+
+// ParseSequenceFormat reads the format scheme from reader and creates a SequenceFormat with the FormatRegex, FormatString, and ConstantSize.
+// Lines preceded by '#' are ignored
+func ParseSequenceFormat(reader io.Reader) (SequenceFormat, error) {
+	var f SequenceFormat
+	// barcodeSearch finds different format types, ie barcode or constant region, in order to iterate over each
+	barcodeSearch := regexp.MustCompile(`(?i)(\{\d+\})|(\[\d+\])|(\(\d+\))|N+|[ATGC]+`)
+	// formatText contains all text from the formatFile that is from a line not preceded by '#'
+	var formatText string
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Text()
 		if !strings.HasPrefix(line, "#") {
+			// Anything left after removing the format types is not a recognized part of the sequence format
+			if unknown := strings.TrimSpace(barcodeSearch.ReplaceAllString(line, "")); unknown != "" {
+				return f, fmt.Errorf("line %v: unrecognized sequence format '%v'", lineNum, unknown)
+			}
 			formatText += line
 		}
 	}
-
+	if err := scanner.Err(); err != nil {
+		return f, err
+	}
 	// digitSearch is used to find digits within any bracket style from the format scheme
 	digitSearch := regexp.MustCompile(`\d+`)
-	// barcodeSearch finds different format types, ie barcode or constant region, in order to iterate over each
-	barcodeSearch := regexp.MustCompile(`(?i)(\{\d+\})|(\[\d+\])|(\(\d+\))|N+|[ATGC]+`)
 	// regexString is built with capture groups then used for the regex object
 	var regexString string
 	// iterates through each barcodeSearch group and create the regex string
@@ -62,16 +131,19 @@ func (f *SequenceFormat) AddSearchRegex(formatFilePath string) {
 			digitsString = digitSearch.FindString(group)
 			digits, _ = strconv.Atoi(digitsString)
 			f.SampleSize = digits
+			f.Regions = append(f.Regions, FormatRegion{Kind: SampleRegion, Size: digits})
 		} else if strings.Contains(group, "{") {
 			f.CountedBarcodeNum++
 			groupName = fmt.Sprintf("counted_%v", f.CountedBarcodeNum)
 			digitsString = digitSearch.FindString(group)
 			digits, _ = strconv.Atoi(digitsString)
 			f.CountedBarcodesSizes = append(f.CountedBarcodesSizes, digits)
+			f.Regions = append(f.Regions, FormatRegion{Kind: CountedRegion, Size: digits, Index: f.CountedBarcodeNum})
 		} else if strings.Contains(group, "(") {
 			groupName = "random"
 			digitsString = digitSearch.FindString(group)
 			digits, _ = strconv.Atoi(digitsString)
+			f.Regions = append(f.Regions, FormatRegion{Kind: RandomRegion, Size: digits})
 		}
 
 		if len(groupName) != 0 {
@@ -85,15 +157,25 @@ func (f *SequenceFormat) AddSearchRegex(formatFilePath string) {
 			// If there are Ns within the format scheme, add these as any nucleotide within the search
 			regexString += fmt.Sprintf("[ATGCN]{%v}", len(group))
 			f.FormatString += group
+			f.Regions = append(f.Regions, FormatRegion{Kind: AnyRegion, Size: len(group)})
 		} else {
 			// If there are not any barcodes nor Ns, it should be the constant region.
 			regexString += group
 			f.FormatString += group
 			f.ConstantSize += len(group)
+			f.Regions = append(f.Regions, FormatRegion{Kind: ConstantRegion, Size: len(group), Sequence: group})
 		}
 
 	}
-	f.FormatRegex = *regexp.MustCompile(regexString)
+	formatRegex, err := regexp.Compile(regexString)
+	if err != nil {
+		return f, fmt.Errorf("sequence format could not be converted to a regex: %w", err)
+	}
+	if f.CountedBarcodeNum == 0 {
+		return f, errors.New("sequence format needs at least one counted barcode '{#}'")
+	}
+	f.FormatRegex = *formatRegex
+	return f, nil
 }
 
 // Print outputs to stdout a string which represents the sequencing read format with barcodes replaced by Ns
@@ -103,6 +185,23 @@ func (f *SequenceFormat) Print() {
 	fmt.Println()
 }
 
+// AddBarcodeTags takes the sample and random barcodes from the SAM or BAM tags in place of the read.  The sequence format
+// cannot also have the barcode of a tag.  With a sample tag, SampleSize is set from the sample barcodes file
+func (f *SequenceFormat) AddBarcodeTags(tags BarcodeTags) error {
+	if tags.Sample != "" && f.SampleSize != 0 {
+		return fmt.Errorf("the sample barcode is within the %v tag, but the sequence format has a sample barcode '[#]'", tags.Sample)
+	}
+	if tags.Random != "" {
+		for _, region := range f.Regions {
+			if region.Kind == RandomRegion {
+				return fmt.Errorf("the random barcode is within the %v tag, but the sequence format has a random barcode '(#)'", tags.Random)
+			}
+		}
+	}
+	f.Tags = tags
+	return nil
+}
+
 // SampleBarcodes contains sample barcode information
 type SampleBarcodes struct {
 	// Conversion is a map where the key is the sample DNA barcode and the value is the sample id
@@ -112,31 +211,85 @@ type SampleBarcodes struct {
 	Included bool
 }
 
-// NewSampleBarcodes creates a new SampleBarcodes struct using the sample barcodes file
-func NewSampleBarcodes(sampleFilePath string) SampleBarcodes {
-	var sampleBarcodes SampleBarcodes
-	sampleBarcodes.Conversion = make(map[string]string)
+// NewSampleBarcodes creates a new SampleBarcodes struct using the sample barcodes file.  The sample barcodes are validated against
+// the sample barcode size of the sequence format
+func NewSampleBarcodes(sampleFilePath string, format SequenceFormat) (SampleBarcodes, error) {
 	if len(sampleFilePath) == 0 {
+		var sampleBarcodes SampleBarcodes
+		sampleBarcodes.Conversion = make(map[string]string)
 		sampleBarcodes.Conversion[NoSampleName] = NoSampleName
 		sampleBarcodes.Barcodes = append(sampleBarcodes.Barcodes, NoSampleName)
-		return sampleBarcodes
-	} else {
-		sampleBarcodes.Included = true
+		return sampleBarcodes, nil
 	}
 	file, err := os.Open(sampleFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return SampleBarcodes{}, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	sampleBarcodes, err := ReadSampleBarcodes(file, format)
+	if err != nil {
+		return sampleBarcodes, fmt.Errorf("%v: %w", sampleFilePath, err)
+	}
+	return sampleBarcodes, nil
+}
+
+// ReadSampleBarcodes creates a new SampleBarcodes struct from reader, which has a header followed by rows of
+// sample DNA barcode and sample ID.  Each sample barcode must be the size of the sample barcode within format
+func ReadSampleBarcodes(reader io.Reader, format SequenceFormat) (SampleBarcodes, error) {
+	var sampleBarcodes SampleBarcodes
+	sampleBarcodes.Conversion = make(map[string]string)
+	sampleBarcodes.Included = true
+	sampleSize := format.SampleSize
+	if format.Tags.Sample != "" {
+		// the size of a sample barcode tag is set by the first sample barcode
+		sampleSize = -1
+	} else if sampleSize == 0 {
+		return sampleBarcodes, errors.New("sequence format does not have a sample barcode '[#]'")
+	}
+
+	scanner := bufio.NewScanner(reader)
 	scanner.Scan() // remove the header
+	lineNum := 1
 	for scanner.Scan() {
+		lineNum++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
 		row := strings.Split(scanner.Text(), ",")
+		if len(row) < 2 || row[1] == "" {
+			return sampleBarcodes, fmt.Errorf("line %v: expected sample barcode and sample ID columns", lineNum)
+		}
+		if sampleSize == -1 {
+			sampleSize = len(row[0])
+		}
+		if err := validateBarcode(row[0], sampleSize); err != nil {
+			return sampleBarcodes, fmt.Errorf("line %v: sample %w", lineNum, err)
+		}
+		if _, ok := sampleBarcodes.Conversion[row[0]]; ok {
+			return sampleBarcodes, fmt.Errorf("line %v: duplicate sample barcode '%v'", lineNum, row[0])
+		}
 		sampleBarcodes.Conversion[row[0]] = row[1]
 		sampleBarcodes.Barcodes = append(sampleBarcodes.Barcodes, row[0])
 	}
-	return sampleBarcodes
+	if err := scanner.Err(); err != nil {
+		return sampleBarcodes, err
+	}
+	if len(sampleBarcodes.Barcodes) == 0 {
+		return sampleBarcodes, errors.New("no sample barcodes found")
+	}
+	return sampleBarcodes, nil
+}
+
+// validateBarcode checks that the barcode only contains nucleotides and is the size of the barcode within the sequence format
+func validateBarcode(barcode string, size int) error {
+	if len(barcode) != size {
+		return fmt.Errorf("barcode '%v' is %v nucleotides, but the sequence format barcode is %v", barcode, len(barcode), size)
+	}
+	if strings.Trim(barcode, "ATGCN") != "" {
+		return fmt.Errorf("barcode '%v' contains characters other than A, T, G, C or N", barcode)
+	}
+	return nil
 }
 
 // CountedBarcodes contains counted barcode information
@@ -151,41 +304,77 @@ type CountedBarcodes struct {
 	Included    bool
 }
 
-// NewCountedBarcodes creates a CountedBarcodes struct with the information within the counted barcodes file
-func NewCountedBarcodes(countedBcFilePath string, numBarcodes int) CountedBarcodes {
-	var countedBarcodes CountedBarcodes
-	countedBarcodes.NumBarcodes = numBarcodes
-
+// NewCountedBarcodes creates a CountedBarcodes struct with the information within the counted barcodes file.  The counted barcodes
+// are validated against the counted barcode sizes of the sequence format
+func NewCountedBarcodes(countedBcFilePath string, format SequenceFormat) (CountedBarcodes, error) {
 	if len(countedBcFilePath) == 0 {
-		return countedBarcodes
-	} else {
-		countedBarcodes.Included = true
+		var countedBarcodes CountedBarcodes
+		countedBarcodes.NumBarcodes = format.CountedBarcodeNum
+		return countedBarcodes, nil
 	}
 	file, err := os.Open(countedBcFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return CountedBarcodes{}, err
 	}
 	defer file.Close()
 
+	countedBarcodes, err := ReadCountedBarcodes(file, format)
+	if err != nil {
+		return countedBarcodes, fmt.Errorf("%v: %w", countedBcFilePath, err)
+	}
+	return countedBarcodes, nil
+}
+
+// ReadCountedBarcodes creates a CountedBarcodes struct from reader, which has a header followed by rows of counted DNA barcode,
+// barcode ID and barcode number.  Each barcode must be the size of the counted barcode with the same number within format
+func ReadCountedBarcodes(reader io.Reader, format SequenceFormat) (CountedBarcodes, error) {
+	var countedBarcodes CountedBarcodes
+	countedBarcodes.NumBarcodes = format.CountedBarcodeNum
+	countedBarcodes.Included = true
+
 	// Slices with the length of the counted barcodes are created to have the counted barcode number be the index
 	for i := 0; i < countedBarcodes.NumBarcodes; i++ {
 		countedBarcodes.Conversion = append(countedBarcodes.Conversion, make(map[string]string))
 		countedBarcodes.Barcodes = append(countedBarcodes.Barcodes, make([]string, 0))
 	}
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(reader)
 	scanner.Scan() // remove the header
+	lineNum := 1
 	// Data needs to be inserted into the conversion map slice and the barcodes slice from the counted barcode file.
 	// The sequential barcode number is used as the index
 	for scanner.Scan() {
+		lineNum++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
 		rowSplit := strings.Split(scanner.Text(), ",")
-		barcodeNum, _ := strconv.Atoi(rowSplit[2])
+		if len(rowSplit) < 3 {
+			return countedBarcodes, fmt.Errorf("line %v: expected barcode, barcode ID and barcode number columns", lineNum)
+		}
+		barcodeNum, err := strconv.Atoi(strings.TrimSpace(rowSplit[2]))
+		if err != nil || barcodeNum < 1 || barcodeNum > countedBarcodes.NumBarcodes {
+			return countedBarcodes, fmt.Errorf("line %v: barcode number '%v' must be an integer from 1 to %v", lineNum, rowSplit[2], countedBarcodes.NumBarcodes)
+		}
 		insertNum := barcodeNum - 1
+		if err := validateBarcode(rowSplit[0], format.CountedBarcodesSizes[insertNum]); err != nil {
+			return countedBarcodes, fmt.Errorf("line %v: counted %w", lineNum, err)
+		}
+		if _, ok := countedBarcodes.Conversion[insertNum][rowSplit[0]]; ok {
+			return countedBarcodes, fmt.Errorf("line %v: duplicate barcode '%v' for barcode number %v", lineNum, rowSplit[0], barcodeNum)
+		}
 		countedBarcodes.Conversion[insertNum][rowSplit[0]] = rowSplit[1]
 		countedBarcodes.Barcodes[insertNum] = append(countedBarcodes.Barcodes[insertNum], rowSplit[0])
 	}
-
-	return countedBarcodes
+	if err := scanner.Err(); err != nil {
+		return countedBarcodes, err
+	}
+	for i, barcodes := range countedBarcodes.Barcodes {
+		if len(barcodes) == 0 {
+			return countedBarcodes, fmt.Errorf("no barcodes found for barcode number %v", i+1)
+		}
+	}
+	return countedBarcodes, nil
 }
 
 // Max finds the maximum in within a slice of integers
@@ -199,67 +388,76 @@ func max(intSlice []int) int {
 	return maxInt
 }
 
-// ReadFastq reads the fastq file line by line and posts the sequence to the sequences string channel.
-// This channel is then read by other parsing threads to parse the sequence
-func ReadFastq(fastqPath string, sequences chan string, wg *sync.WaitGroup) int {
+// ReadFastq reads the reads file and posts each read to the sequences channel.  This channel is then read by other parsing
+// threads to parse the sequence.  The sequences channel is closed even when an error is returned so that the parsing threads
+// finish.  The compression format and then the file format, FASTQ, FASTA, SAM or BAM, are detected from the start of the
+// file, and stdin is read when fastqPath is StdinPath.  options holds the SAM or BAM tags of the sample and random barcodes,
+// and how malformed FASTQ records are handled.  The first 10 malformed records skipped by LenientValidation are logged as
+// warnings, and every skipped record is passed to options.Skipped.  The total reads are returned rather than printed, so
+// that the caller can print them once any progress line is finished, and options.Progress is called while reading.  When
+// timings is not nil, the time spent reading and decompressing the file is added to the ReadFastq stage.  Once ctx is done,
+// reading stops and an error wrapping the error of ctx is returned along with the reads posted so far
+func ReadFastq(ctx context.Context, fastqPath string, options ReadOptions, sequences chan Read, wg *sync.WaitGroup, timings *timing.StageTimes) (int, error) {
 	defer close(sequences)
 	defer wg.Done()
-	file, err := os.Open(fastqPath)
+	fastq, compression, err := openFastq(fastqPath)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	defer file.Close()
+	defer fastq.Close()
+	var reader io.Reader = fastq
 
-	totalReads := 0
-	lineNum := 0
-	if strings.HasSuffix(fastqPath, "gz") {
-		rawContents, err := gzip.NewReader(file)
-		if err != nil {
-			log.Fatal(err)
-		}
-		scanner := bufio.NewScanner(rawContents)
-		for scanner.Scan() {
-			lineNum++
-			switch lineNum {
-			case 2:
-				totalReads++
-				for len(sequences) > 10000 {
-				}
-				sequences <- scanner.Text()
-				if totalReads%10000 == 0 {
-					fmt.Printf("\rTotal reads:                 %v", totalReads)
-				}
-			case 4:
-				lineNum = 0
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+	// the reads are timed without the time waiting for the parsing threads to take the sequences
+	timer := timings.NewTimer()
+	defer timings.Add(timer)
+	if timer != nil {
+		reader = &timedReader{reader: reader, timer: timer}
+	}
+	skippedNum := 0
+	skipped := options.Skipped
+	options.Skipped = func(err *RecordError) {
+		skippedNum++
+		if skippedNum <= 10 {
+			logging.Warn("Skipped malformed FASTQ record", "file", fastqName(fastqPath), "record", err.Record, "line", err.Line, "reason", err.Reason)
 		}
-	} else if strings.HasSuffix(fastqPath, "fastq") {
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			lineNum++
-			switch lineNum {
-			case 2:
-				totalReads++
-				for len(sequences) > 10000 {
-				}
-				sequences <- scanner.Text()
-				if totalReads%10000 == 0 {
-					fmt.Printf("\rTotal reads:                 %v", totalReads)
-				}
-			case 4:
-				lineNum = 0
-			}
+		if skipped != nil {
+			skipped(err)
 		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+	}
+	// the read times are added along with the progress, so that they are up to date while reading.  timedReads is the reads
+	// already added
+	timedReads := 0
+	progress := func(totalReads int) {
+		timer.Add(timing.Read, 0, totalReads-timedReads)
+		timedReads = totalReads
+		timings.Add(timer)
+		if options.Progress != nil {
+			options.Progress(totalReads, fastq.BytesRead())
 		}
-	} else {
-		log.Fatal("fastq file must end with 'gz' or 'fastq'")
 	}
+	totalReads, fileFormat, err := ScanReads(ctx, reader, options, sequences, progress)
+	logging.Debug("Read the reads file", "file", fastqName(fastqPath), "compression", compression, "format", fileFormat, "reads", totalReads)
+	timer.Add(timing.Read, 0, totalReads-timedReads)
+	if err != nil {
+		return totalReads, fmt.Errorf("%v: %w", fastqName(fastqPath), err)
+	}
+
+	if options.Progress != nil {
+		options.Progress(totalReads, fastq.BytesRead())
+	}
+	return totalReads, nil
+}
+
+// timedReader adds the time of each Read to the ReadFastq stage of timer
+type timedReader struct {
+	reader io.Reader
+	timer  *timing.Timer
+}
 
-	fmt.Printf("\rTotal reads:                 %v\n", totalReads)
-	return totalReads
+// Read reads from the wrapped reader
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := r.timer.Start()
+	n, err := r.reader.Read(p)
+	r.timer.Add(timing.Read, time.Since(start), 0)
+	return n, err
 }
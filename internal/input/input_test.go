@@ -0,0 +1,385 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testFormat = "# comment\nAGCT[4]TTGA{4}CC{6}TTTT(4)\n"
+
+func testSequenceFormat(t *testing.T) SequenceFormat {
+	t.Helper()
+	format, err := ParseSequenceFormat(strings.NewReader(testFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return format
+}
+
+func TestParseSequenceFormat(t *testing.T) {
+	format := testSequenceFormat(t)
+	if format.FormatString != "AGCTNNNNTTGANNNNCCNNNNNNTTTTNNNN" {
+		t.Errorf("FormatString = %v", format.FormatString)
+	}
+	if format.SampleSize != 4 || format.CountedBarcodeNum != 2 || format.ConstantSize != 14 {
+		t.Errorf("SampleSize = %v, CountedBarcodeNum = %v, ConstantSize = %v", format.SampleSize, format.CountedBarcodeNum, format.ConstantSize)
+	}
+
+	wantRegions := []FormatRegion{
+		{Kind: ConstantRegion, Size: 4, Sequence: "AGCT"},
+		{Kind: SampleRegion, Size: 4},
+		{Kind: ConstantRegion, Size: 4, Sequence: "TTGA"},
+		{Kind: CountedRegion, Size: 4, Index: 1},
+		{Kind: ConstantRegion, Size: 2, Sequence: "CC"},
+		{Kind: CountedRegion, Size: 6, Index: 2},
+		{Kind: ConstantRegion, Size: 4, Sequence: "TTTT"},
+		{Kind: RandomRegion, Size: 4},
+	}
+	if len(format.Regions) != len(wantRegions) {
+		t.Fatalf("Regions = %v, want %v", format.Regions, wantRegions)
+	}
+	for i, region := range format.Regions {
+		if region != wantRegions[i] {
+			t.Errorf("Regions[%v] = %v, want %v", i, region, wantRegions[i])
+		}
+	}
+
+	errorTests := []struct {
+		name, format, want string
+	}{
+		{"no counted barcode", "AGCT[4]TTTT", "at least one counted barcode"},
+		{"unknown characters", "AGCT\nAGCT{4}XX\n", "line 2: unrecognized sequence format 'XX'"},
+	}
+	for _, test := range errorTests {
+		_, err := ParseSequenceFormat(strings.NewReader(test.format))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestReadSampleBarcodesErrors(t *testing.T) {
+	format := testSequenceFormat(t)
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"missing column", "Barcode,Sample_ID\nAAAA,s1\nCCCC\n", "line 3: expected sample barcode and sample ID columns"},
+		{"wrong length", "Barcode,Sample_ID\nAAAAA,s1\n", "line 2: sample barcode 'AAAAA' is 5 nucleotides, but the sequence format barcode is 4"},
+		{"not DNA", "Barcode,Sample_ID\nAAXA,s1\n", "line 2: sample barcode 'AAXA' contains characters other than"},
+		{"duplicate", "Barcode,Sample_ID\nAAAA,s1\nAAAA,s2\n", "line 3: duplicate sample barcode 'AAAA'"},
+		{"empty", "Barcode,Sample_ID\n", "no sample barcodes found"},
+	}
+	for _, test := range tests {
+		_, err := ReadSampleBarcodes(strings.NewReader(test.contents), format)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestReadCountedBarcodes(t *testing.T) {
+	format := testSequenceFormat(t)
+	countedBarcodes, err := ReadCountedBarcodes(strings.NewReader("Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\n\nACGTAC,b1,2\n"), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countedBarcodes.Conversion[0]["ACGT"] != "a1" || countedBarcodes.Conversion[1]["ACGTAC"] != "b1" {
+		t.Errorf("Conversion = %v", countedBarcodes.Conversion)
+	}
+
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"missing column", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1\n", "line 2: expected barcode, barcode ID and barcode number columns"},
+		{"not an integer", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,one\n", "line 2: barcode number 'one' must be an integer from 1 to 2"},
+		{"outside of format", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,3\n", "line 2: barcode number '3' must be an integer from 1 to 2"},
+		{"wrong length", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\nACGT,b1,2\n", "line 3: counted barcode 'ACGT' is 4 nucleotides, but the sequence format barcode is 6"},
+		{"duplicate", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\nACGT,a2,1\n", "line 3: duplicate barcode 'ACGT' for barcode number 1"},
+		{"missing barcode number", "Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\n", "no barcodes found for barcode number 2"},
+	}
+	for _, test := range tests {
+		_, err := ReadCountedBarcodes(strings.NewReader(test.contents), format)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestCheckDistances(t *testing.T) {
+	conversion := map[string]string{"AAAAAA": "a", "AAAATT": "b", "CCCCCC": "c", "AANAAT": "d"}
+	report := CheckDistances("Counted barcode 1", []string{"AAAAAA", "AAAATT", "CCCCCC"}, conversion, 1)
+	if report.MinDistance != 2 || report.MaxSafeErrors != 0 || report.Safe() {
+		t.Errorf("MinDistance = %v, MaxSafeErrors = %v, Safe = %v", report.MinDistance, report.MaxSafeErrors, report.Safe())
+	}
+	if len(report.AmbiguousPairs) != 1 || report.AmbiguousPairs[0].FirstId != "a" || report.AmbiguousPairs[0].SecondId != "b" {
+		t.Errorf("AmbiguousPairs = %v", report.AmbiguousPairs)
+	}
+
+	// N matches any nucleotide in the same way as the error correction
+	report = CheckDistances("Counted barcode 1", []string{"AAAAAA", "AANAAT", "CCCCCC"}, conversion, 0)
+	if report.MinDistance != 1 || !report.Safe() {
+		t.Errorf("MinDistance = %v, Safe = %v", report.MinDistance, report.Safe())
+	}
+
+	// sets too large to search with the errors allowed are skipped and unverified, so they are not safe
+	var barcodes []string
+	for i := 0; len(barcodes) <= exhaustiveLimit; i++ {
+		barcode := make([]byte, 8)
+		for j, number := 0, i; j < len(barcode); j, number = j+1, number/4 {
+			barcode[j] = "ACGT"[number%4]
+		}
+		barcodes = append(barcodes, string(barcode))
+	}
+	report = CheckDistances("Counted barcode 1", barcodes, nil, 1)
+	if !report.Skipped || report.Safe() {
+		t.Errorf("Skipped = %v, Safe = %v", report.Skipped, report.Safe())
+	}
+}
+
+func TestAmbiguousPairs(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var barcodes []string
+	found := make(map[string]bool)
+	for len(barcodes) < 2000 {
+		barcode := make([]byte, 8)
+		for j := range barcode {
+			barcode[j] = "ATGC"[random.Intn(4)]
+		}
+		if len(barcodes)%500 == 0 {
+			barcode[3] = 'N'
+		}
+		if !found[string(barcode)] {
+			found[string(barcode)] = true
+			barcodes = append(barcodes, string(barcode))
+		}
+	}
+	// pairKey is the same for either order of the barcodes
+	pairKey := func(first string, second string) string {
+		if first > second {
+			first, second = second, first
+		}
+		return first + "," + second
+	}
+	const maxDistance = 2
+	want := make(map[string]int)
+	for i, first := range barcodes {
+		for _, second := range barcodes[i+1:] {
+			if distance := barcodeDistance(first, second, -1); distance <= maxDistance {
+				want[pairKey(first, second)]++
+			}
+		}
+	}
+	got := make(map[string]int)
+	ambiguousPairs(barcodes, maxDistance, func(first string, second string, distance int) {
+		if distance != barcodeDistance(first, second, -1) {
+			t.Errorf("%v %v distance = %v", first, second, distance)
+		}
+		got[pairKey(first, second)]++
+	})
+	if len(got) != len(want) {
+		t.Fatalf("found %v pairs, want %v", len(got), len(want))
+	}
+	for pair, count := range got {
+		if count != 1 || want[pair] != 1 {
+			t.Errorf("pair %v found %v times, want once", pair, count)
+		}
+	}
+}
+
+func BenchmarkScanFastq(b *testing.B) {
+	var fastq strings.Builder
+	for i := 0; i < b.N; i++ {
+		fastq.WriteString("@read\nAGCTAAAATTGACCCCCCCTTTTGGGG\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIII\n")
+	}
+	sequences := make(chan Read, 1000)
+	go func() {
+		for range sequences {
+		}
+	}()
+	b.ResetTimer()
+	start := time.Now()
+	if _, err := ScanFastq(context.Background(), strings.NewReader(fastq.String()), ReadOptions{}, sequences, nil); err != nil {
+		b.Fatal(err)
+	}
+	close(sequences)
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "reads/s")
+}
+
+// TestMatchers checks that the anchor matcher finds the same start as the regex on random reads which contain parts of
+// the sequence format, including reads with repeated anchors, N regions, other characters, and reads shorter than the format
+func TestMatchers(t *testing.T) {
+	formats := []string{
+		"AGCTAGCT[6]TTGACAGT{8}CCTGA{8}GGACT(10)TTTTGCA",
+		"AGCT[4]TTGA{4}CC{6}TTTT(4)",
+		"{8}",
+		"[4]{6}NNN(3)",
+		"AAAA{4}AAAA",
+		"ACNNGT{4}TT",
+	}
+	random := rand.New(rand.NewSource(3))
+	for _, formatText := range formats {
+		format, err := ParseSequenceFormat(strings.NewReader(formatText))
+		if err != nil {
+			t.Fatal(err)
+		}
+		anchor, regex := NewAnchorMatcher(format), NewRegexMatcher(format)
+		for i := 0; i < 2000; i++ {
+			// each read is built from random nucleotides and pieces of the format string, where the Ns are replaced
+			var read []byte
+			for len(read) < random.Intn(3*len(format.FormatString)) {
+				if random.Intn(3) == 0 {
+					read = append(read, "ATGCN."[random.Intn(6)])
+					continue
+				}
+				start := random.Intn(len(format.FormatString))
+				for _, nucleotide := range []byte(format.FormatString[start:]) {
+					if nucleotide == 'N' && random.Intn(10) != 0 {
+						nucleotide = "ATGC"[random.Intn(4)]
+					}
+					read = append(read, nucleotide)
+				}
+			}
+			if got, want := anchor.Find(string(read)), regex.Find(string(read)); got != want {
+				t.Fatalf("%v: Find(%s) = %v, regex found %v", formatText, read, got, want)
+			}
+		}
+	}
+}
+
+// readAll reads every read of the file with ReadFastq and returns the reads along with the error
+func readAll(fastqPath string, tags BarcodeTags) ([]Read, error) {
+	var wg sync.WaitGroup
+	sequences := make(chan Read)
+	readErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		_, err := ReadFastq(context.Background(), fastqPath, ReadOptions{Tags: tags}, sequences, &wg, nil)
+		readErr <- err
+	}()
+	var got []Read
+	for read := range sequences {
+		got = append(got, read)
+	}
+	wg.Wait()
+	return got, <-readErr
+}
+
+// readSequences reads every sequence of the file with ReadFastq
+func readSequences(t *testing.T, fastqPath string) []string {
+	t.Helper()
+	reads, err := readAll(fastqPath, BarcodeTags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequences []string
+	for _, read := range reads {
+		sequences = append(sequences, read.Sequence)
+	}
+	return sequences
+}
+
+// TestReadFastqProgress checks that the last progress has every read and every byte of the compressed file
+func TestReadFastqProgress(t *testing.T) {
+	fastqPath := filepath.Join("testdata", "reads.fastq.gz")
+	info, err := os.Stat(fastqPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reads int
+	var bytesRead int64
+	options := ReadOptions{Progress: func(totalReads int, fileBytes int64) { reads, bytesRead = totalReads, fileBytes }}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sequences := make(chan Read, 10)
+	if _, err := ReadFastq(context.Background(), fastqPath, options, sequences, &wg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 2 || bytesRead != info.Size() {
+		t.Errorf("progress = %v reads and %v bytes, want 2 reads and %v bytes", reads, bytesRead, info.Size())
+	}
+}
+
+// TestReadFastqCancel checks that a reader which is stopped still closes the sequences channel and returns the error of ctx
+func TestReadFastqCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sequences := make(chan Read)
+	totalReads, err := ReadFastq(ctx, filepath.Join("testdata", "reads.fastq.gz"), ReadOptions{}, sequences, &wg, nil)
+	if _, open := <-sequences; open || totalReads != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadFastq = %v reads with error %v, channel open %v, want 0 reads, %v and a closed channel", totalReads, err, open, context.Canceled)
+	}
+}
+
+func TestReadFastqCompression(t *testing.T) {
+	want := []string{"AGCTAAAATTGACCCCCCCTTTTGGGG", "AGCTCCCCTTGAGGGGAAAAAATTTTACGT"}
+	tests := []struct {
+		file        string
+		compression Compression
+	}{
+		{"reads.fq", Plain},
+		{"reads.fastq.gz", Gzip},
+		{"reads.fq.bz2", Bzip2},
+		{"reads.fq.xz", Xz},
+		{"reads.fq.zst", Zstd},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			fastqPath := filepath.Join("testdata", test.file)
+			fastq, compression, err := OpenFastq(fastqPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fastq.Close()
+			if compression != test.compression {
+				t.Errorf("compression = %v, want %v", compression, test.compression)
+			}
+			if got := readSequences(t, fastqPath); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("sequences = %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("stdin", func(t *testing.T) {
+		file, err := os.Open(filepath.Join("testdata", "reads.fq.zst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		stdin := os.Stdin
+		os.Stdin = file
+		defer func() { os.Stdin = stdin }()
+		if got := readSequences(t, StdinPath); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("sequences = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNewLibraryDuplicates(t *testing.T) {
+	format := testSequenceFormat(t)
+	countedBarcodes, err := ReadCountedBarcodes(strings.NewReader("Barcode,Barcode_ID,Barcode_Number\nACGT,a1,1\nTGCA,a2,1\nACGTAC,b1,2\n"), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	membersPath := filepath.Join(t.TempDir(), "members.csv")
+	if err := os.WriteFile(membersPath, []byte("Barcode_1,Barcode_2\na2,b1\na1,b1\nTGCA,ACGTAC\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	library, err := NewLibrary(membersPath, countedBarcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"TGCA,ACGTAC", "ACGT,ACGTAC"}
+	if !reflect.DeepEqual(library.Members, want) {
+		t.Errorf("Members = %v, want %v", library.Members, want)
+	}
+}
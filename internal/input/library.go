@@ -0,0 +1,122 @@
+package input
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+)
+
+// maxLibraryEnumeration is the largest cartesian product of counted barcodes that will be enumerated when a library
+// members file is not supplied.  Larger libraries should supply the expected members with --library-members
+const maxLibraryEnumeration = 50000000
+
+// Library holds the expected members of the counted barcode library.  This is used to write zero count rows for members
+// which were never observed and to calculate library coverage
+type Library struct {
+	// Members is a slice of comma separated counted DNA barcodes, in the same format as the keys of results.Counts
+	Members  []string
+	Included bool
+}
+
+// NewLibrary creates a Library struct.  If membersFilePath is empty, the full combinatorial space of the counted barcodes
+// is enumerated.  Otherwise each row of the members file, after the header, is a comma separated list of counted barcode IDs
+// or DNA barcodes, one column per counted barcode.  Duplicate members are only included once
+func NewLibrary(membersFilePath string, countedBarcodes CountedBarcodes) (Library, error) {
+	var library Library
+	if !countedBarcodes.Included {
+		return library, errors.New("counted barcodes file needed to enumerate the expected library")
+	}
+	library.Included = true
+
+	if len(membersFilePath) == 0 {
+		librarySize := 1
+		for _, barcodes := range countedBarcodes.Barcodes {
+			librarySize *= len(barcodes)
+			if librarySize > maxLibraryEnumeration {
+				return library, fmt.Errorf("expected library is larger than %v members.  Use --library-members to supply the expected members", maxLibraryEnumeration)
+			}
+		}
+		library.Members = make([]string, 0, librarySize)
+		library.enumerate(countedBarcodes.Barcodes, "", 0)
+		return library, nil
+	}
+
+	// idToBarcode is a slice of maps, one per counted barcode, which converts the barcode ID back to the DNA barcode
+	idToBarcode := make([]map[string]string, countedBarcodes.NumBarcodes)
+	for i, conversion := range countedBarcodes.Conversion {
+		idToBarcode[i] = make(map[string]string)
+		for barcode, id := range conversion {
+			idToBarcode[i][id] = barcode
+		}
+	}
+
+	file, err := os.Open(membersFilePath)
+	if err != nil {
+		return library, err
+	}
+	defer file.Close()
+
+	// seen holds the members already added so that duplicate rows do not create duplicate zero count rows
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // remove the header
+	lineNum := 1
+	for scanner.Scan() {
+		lineNum++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := strings.Split(scanner.Text(), ",")
+		if len(row) != countedBarcodes.NumBarcodes {
+			return library, fmt.Errorf("%v: line %v: expected %v columns, one per counted barcode", membersFilePath, lineNum, countedBarcodes.NumBarcodes)
+		}
+		var member string
+		for i, value := range row {
+			if i != 0 {
+				member += ","
+			}
+			if barcode, ok := idToBarcode[i][value]; ok {
+				member += barcode
+			} else if _, ok := countedBarcodes.Conversion[i][value]; ok {
+				member += value
+			} else {
+				return library, fmt.Errorf("%v: line %v: '%v' not found within the counted barcodes for barcode number %v", membersFilePath, lineNum, value, i+1)
+			}
+		}
+		if seen[member] {
+			logging.Warn(fmt.Sprintf("%v: line %v: duplicate library member skipped", membersFilePath, lineNum))
+			continue
+		}
+		seen[member] = true
+		library.Members = append(library.Members, member)
+	}
+	if err := scanner.Err(); err != nil {
+		return library, fmt.Errorf("%v: %w", membersFilePath, err)
+	}
+	return library, nil
+}
+
+// enumerate recursively adds every combination of the counted barcodes to Members
+func (l *Library) enumerate(barcodes [][]string, prefix string, index int) {
+	if index == len(barcodes) {
+		l.Members = append(l.Members, prefix)
+		return
+	}
+	for _, barcode := range barcodes[index] {
+		if index == 0 {
+			l.enumerate(barcodes, barcode, index+1)
+		} else {
+			l.enumerate(barcodes, prefix+","+barcode, index+1)
+		}
+	}
+}
+
+// Print outputs to stdout the number of expected library members
+func (l Library) Print() {
+	fmt.Println("-LIBRARY-")
+	fmt.Printf("Expected members: %v\n\n", len(l.Members))
+}
@@ -0,0 +1,148 @@
+package input
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// AnchorMatcherName selects the AnchorMatcher, which is the default
+	AnchorMatcherName = "anchor"
+	// RegexMatcherName selects the RegexMatcher, which uses the FormatRegex of the sequence format
+	RegexMatcherName = "regex"
+)
+
+// Matcher finds where the sequence format starts within a read.  Every region of the sequence format has a fixed size, so
+// each barcode is sliced from the read at its offset from the start
+type Matcher interface {
+	// Find returns the first position of the read where the sequence format matches, or -1 when it does not match
+	Find(sequence string) int
+}
+
+// NewMatcher creates the Matcher selected by name, which is either AnchorMatcherName or RegexMatcherName
+func NewMatcher(name string, format SequenceFormat) (Matcher, error) {
+	switch name {
+	case AnchorMatcherName:
+		return NewAnchorMatcher(format), nil
+	case RegexMatcherName:
+		return NewRegexMatcher(format), nil
+	default:
+		return nil, fmt.Errorf("unknown matcher '%v', must be '%v' or '%v'", name, AnchorMatcherName, RegexMatcherName)
+	}
+}
+
+// RegexMatcher finds the sequence format with the FormatRegex
+type RegexMatcher struct {
+	regex *regexp.Regexp
+}
+
+// NewRegexMatcher creates a RegexMatcher from the FormatRegex of format
+func NewRegexMatcher(format SequenceFormat) *RegexMatcher {
+	return &RegexMatcher{regex: &format.FormatRegex}
+}
+
+// Find returns the start of the leftmost regex match, or -1 when the regex does not match
+func (m *RegexMatcher) Find(sequence string) int {
+	location := m.regex.FindStringIndex(sequence)
+	if location == nil {
+		return -1
+	}
+	return location[0]
+}
+
+// offsetRegion is a region of the sequence format and its offset from the start of the format
+type offsetRegion struct {
+	offset   int
+	size     int
+	sequence string
+}
+
+// barcodeNucleotides holds the nucleotides which the regex accepts within a barcode or N region
+var barcodeNucleotides = [256]bool{'A': true, 'T': true, 'G': true, 'C': true, 'N': true}
+
+// AnchorMatcher finds the sequence format without a regex.  The longest constant region is the anchor, which is found with
+// an exact substring search.  At each position of the anchor, the other constant regions are compared at their offsets and
+// the barcode regions are checked for nucleotides.  The first position which passes is the same match as the leftmost regex
+// match, because every region has a fixed size
+type AnchorMatcher struct {
+	// size is the length of the sequence format
+	size   int
+	anchor offsetRegion
+	// constants holds the constant regions other than the anchor
+	constants []offsetRegion
+	// variable holds the barcode and N regions, which match any of ATGCN
+	variable []offsetRegion
+}
+
+// NewAnchorMatcher creates an AnchorMatcher from the regions of format
+func NewAnchorMatcher(format SequenceFormat) *AnchorMatcher {
+	m := &AnchorMatcher{size: len(format.FormatString)}
+	var offset int
+	for _, region := range format.Regions {
+		current := offsetRegion{offset: offset, size: region.Size, sequence: region.Sequence}
+		if region.Kind == ConstantRegion {
+			// the anchor has a size of 0 until the first constant region is found
+			if region.Size > m.anchor.size {
+				if m.anchor.size != 0 {
+					m.constants = append(m.constants, m.anchor)
+				}
+				m.anchor = current
+			} else {
+				m.constants = append(m.constants, current)
+			}
+		} else {
+			m.variable = append(m.variable, current)
+		}
+		offset += region.Size
+	}
+	return m
+}
+
+// Find returns the first position of the read where the sequence format matches, or -1 when it does not match
+func (m *AnchorMatcher) Find(sequence string) int {
+	lastStart := len(sequence) - m.size
+	if lastStart < 0 {
+		return -1
+	}
+	// without a constant region every position is checked
+	if m.anchor.size == 0 {
+		for start := 0; start <= lastStart; start++ {
+			if m.matchesAt(sequence, start) {
+				return start
+			}
+		}
+		return -1
+	}
+	// window holds every position of the anchor where the whole sequence format fits within the read
+	window := sequence[m.anchor.offset : lastStart+m.anchor.offset+m.anchor.size]
+	for searched := 0; ; {
+		found := strings.Index(window[searched:], m.anchor.sequence)
+		if found == -1 {
+			return -1
+		}
+		start := searched + found
+		if m.matchesAt(sequence, start) {
+			return start
+		}
+		searched = start + 1
+	}
+}
+
+// matchesAt returns whether the constant regions other than the anchor and the barcode regions match with the sequence
+// format starting at start
+func (m *AnchorMatcher) matchesAt(sequence string, start int) bool {
+	for _, constant := range m.constants {
+		if sequence[start+constant.offset:start+constant.offset+constant.size] != constant.sequence {
+			return false
+		}
+	}
+	for _, region := range m.variable {
+		for i := start + region.offset; i < start+region.offset+region.size; i++ {
+			if !barcodeNucleotides[sequence[i]] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,431 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Read is a single sequencing read posted to the parsing threads.  SampleBarcode and RandomBarcode hold the barcodes taken
+// from the SAM or BAM tags of BarcodeTags, and are empty otherwise
+type Read struct {
+	Sequence      string
+	SampleBarcode string
+	RandomBarcode string
+}
+
+// BarcodeTags are the SAM or BAM tags, such as BC, RX or CB, which hold the sample and random barcodes in place of the read.
+// An empty tag is not used
+type BarcodeTags struct {
+	Sample string
+	Random string
+}
+
+// Used returns whether either tag is used
+func (t BarcodeTags) Used() bool {
+	return t.Sample != "" || t.Random != ""
+}
+
+// FileFormat is the format of the reads file after decompression
+type FileFormat int
+
+const (
+	Fastq FileFormat = iota
+	Fasta
+	Sam
+	Bam
+	// Cram is detected so that it can be reported, but is not read
+	Cram
+)
+
+// String returns the name of the file format
+func (f FileFormat) String() string {
+	switch f {
+	case Fasta:
+		return "fasta"
+	case Sam:
+		return "sam"
+	case Bam:
+		return "bam"
+	case Cram:
+		return "cram"
+	default:
+		return "fastq"
+	}
+}
+
+// samHeader matches the first line of a SAM file with a header
+var samHeader = regexp.MustCompile(`^@(HD|SQ|RG|PG|CO)\t`)
+
+// samFields is the number of mandatory fields of a SAM alignment line
+const samFields = 11
+
+// DetectFileFormat returns the file format from the start of the decompressed reader without reading past it.  BAM and CRAM
+// are found by their magic bytes and FASTA by the '>' of the first header.  SAM is told apart from FASTQ, which also starts
+// with '@', by the SAM header line or by the tab separated fields of a SAM file without a header
+func DetectFileFormat(reader *bufio.Reader) (FileFormat, error) {
+	start, err := reader.Peek(reader.Size())
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Fastq, err
+	}
+	switch {
+	case bytes.HasPrefix(start, []byte("BAM\x01")):
+		return Bam, nil
+	case bytes.HasPrefix(start, []byte("CRAM")):
+		return Cram, nil
+	case bytes.HasPrefix(start, []byte(">")):
+		return Fasta, nil
+	}
+	firstLine := start
+	if end := bytes.IndexByte(start, '\n'); end != -1 {
+		firstLine = start[:end]
+	}
+	if samHeader.Match(firstLine) || bytes.Count(firstLine, []byte("\t")) >= samFields-1 {
+		return Sam, nil
+	}
+	return Fastq, nil
+}
+
+// ScanReads detects the file format of reader and posts each read to the sequences channel.  options.Tags can only be used
+// with SAM or BAM files, and options.Validation is used with FASTQ files.  progress, if not nil, is called every 10,000 reads
+// with the total reads so far.  The total number of reads, including options.Skip, and the file format are returned.  Reading
+// stops with the error of ctx once it is done.  sequences is not closed
+func ScanReads(ctx context.Context, reader io.Reader, options ReadOptions, sequences chan<- Read, progress func(int)) (int, FileFormat, error) {
+	buffered := bufio.NewReaderSize(reader, 1<<16)
+	format, err := DetectFileFormat(buffered)
+	if err != nil {
+		return 0, format, err
+	}
+	if options.Tags.Used() && format != Sam && format != Bam {
+		return 0, format, fmt.Errorf("barcode tags are only within SAM or BAM files, but the input is %v", format)
+	}
+	var totalReads int
+	switch format {
+	case Fasta:
+		totalReads, err = ScanFasta(ctx, buffered, options, sequences, progress)
+	case Sam:
+		totalReads, err = ScanSam(ctx, buffered, options, sequences, progress)
+	case Bam:
+		totalReads, err = ScanBam(ctx, buffered, options, sequences, progress)
+	case Cram:
+		err = errors.New("CRAM is not supported as it needs the reference to decode.  Convert it with 'samtools view -b' or 'samtools fastq'")
+	default:
+		totalReads, err = ScanFastq(ctx, buffered, options, sequences, progress)
+	}
+	return totalReads, format, err
+}
+
+// newLineScanner creates a bufio.Scanner which allows lines up to 16MB, so that long reads and FASTA sequences fit
+func newLineScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<24)
+	return scanner
+}
+
+// ScanFasta reads the FASTA records from reader and posts each sequence to the sequences channel.  Sequences split over
+// multiple lines are joined, and lowercase nucleotides, which FASTA files use for soft masking, are made uppercase.  progress,
+// if not nil, is called every 10,000 reads.  sequences is not closed
+func ScanFasta(ctx context.Context, reader io.Reader, options ReadOptions, sequences chan<- Read, progress func(int)) (int, error) {
+	poster := readPoster{ctx: ctx, sequences: sequences, options: options, progress: progress}
+	var sequence strings.Builder
+	inRecord := false
+	post := func() error {
+		err := poster.post(Read{Sequence: strings.ToUpper(sequence.String())})
+		sequence.Reset()
+		return err
+	}
+	scanner := newLineScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte(">")) {
+			if inRecord {
+				if err := post(); err != nil {
+					return poster.totalReads, err
+				}
+			}
+			inRecord = true
+			continue
+		}
+		if !inRecord {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			return poster.totalReads, fmt.Errorf("line %v: expected a FASTA header starting with '>'", lineNum)
+		}
+		sequence.Write(bytes.TrimSpace(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return poster.totalReads, err
+	}
+	if inRecord {
+		return poster.totalReads, post()
+	}
+	return poster.totalReads, nil
+}
+
+const (
+	// samReverse is the SAM flag of a read which is reverse complemented within the file
+	samReverse = 0x10
+	// samSecondary and samSupplementary are the SAM flags of extra alignments of a read, which are skipped so that each
+	// read is counted once
+	samSecondary     = 0x100
+	samSupplementary = 0x800
+)
+
+// ScanSam reads the alignment lines of a SAM file from reader and posts each read to the sequences channel, with the barcodes
+// of options.Tags.  Header lines are skipped, along with secondary and supplementary alignments.  Reads aligned to the reverse strand
+// are reverse complemented back to the sequenced read.  progress, if not nil, is called every 10,000 reads.  sequences is not
+// closed
+func ScanSam(ctx context.Context, reader io.Reader, options ReadOptions, sequences chan<- Read, progress func(int)) (int, error) {
+	poster := readPoster{ctx: ctx, sequences: sequences, options: options, progress: progress}
+	tags := options.Tags
+	scanner := newLineScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "@") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < samFields {
+			return poster.totalReads, fmt.Errorf("line %v: expected %v tab separated SAM fields, found %v", lineNum, samFields, len(fields))
+		}
+		flag, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return poster.totalReads, fmt.Errorf("line %v: SAM flag '%v' is not a number", lineNum, fields[1])
+		}
+		if flag&(samSecondary|samSupplementary) != 0 {
+			continue
+		}
+		read := Read{Sequence: fields[9]}
+		if read.Sequence == "*" {
+			read.Sequence = ""
+		}
+		if flag&samReverse != 0 {
+			read.Sequence = reverseComplement(read.Sequence)
+		}
+		for _, field := range fields[samFields:] {
+			// optional fields are TAG:TYPE:VALUE
+			if len(field) < 5 || field[2] != ':' || field[4] != ':' {
+				continue
+			}
+			tag, value := field[:2], field[5:]
+			if tag == tags.Sample {
+				read.SampleBarcode = tagBarcode(value)
+			}
+			if tag == tags.Random {
+				read.RandomBarcode = tagBarcode(value)
+			}
+		}
+		if err := poster.post(read); err != nil {
+			return poster.totalReads, err
+		}
+	}
+	return poster.totalReads, scanner.Err()
+}
+
+// bamNucleotides decodes the 4 bit nucleotides of a BAM record
+const bamNucleotides = "=ACMGRSVTWYHKDBN"
+
+// bamFixedSize is the size of the fixed fields of a BAM record after the block size
+const bamFixedSize = 32
+
+// ScanBam reads the records of a decompressed BAM file from reader and posts each read to the sequences channel, with the
+// barcodes of options.Tags.  The records are handled in the same way as ScanSam.  progress, if not nil, is called every 10,000
+// reads.  sequences is not closed
+func ScanBam(ctx context.Context, reader io.Reader, options ReadOptions, sequences chan<- Read, progress func(int)) (int, error) {
+	buffered := bufio.NewReaderSize(reader, 1<<16)
+	if err := skipBamHeader(buffered); err != nil {
+		return 0, err
+	}
+	poster := readPoster{ctx: ctx, sequences: sequences, options: options, progress: progress}
+	tags := options.Tags
+	recordNum := 0
+	var record []byte
+	var sequence []byte
+	for {
+		var blockSize [4]byte
+		if _, err := io.ReadFull(buffered, blockSize[:]); err == io.EOF {
+			return poster.totalReads, nil
+		} else if err != nil {
+			return poster.totalReads, fmt.Errorf("BAM record %v: truncated", recordNum+1)
+		}
+		recordNum++
+		size := int(binary.LittleEndian.Uint32(blockSize[:]))
+		if size < bamFixedSize {
+			return poster.totalReads, fmt.Errorf("BAM record %v: block size %v is too small", recordNum, size)
+		}
+		if cap(record) < size {
+			record = make([]byte, size)
+		}
+		record = record[:size]
+		if _, err := io.ReadFull(buffered, record); err != nil {
+			return poster.totalReads, fmt.Errorf("BAM record %v: truncated", recordNum)
+		}
+		nameSize := int(record[8])
+		cigarNum := int(binary.LittleEndian.Uint16(record[12:14]))
+		flag := binary.LittleEndian.Uint16(record[14:16])
+		sequenceSize := int(binary.LittleEndian.Uint32(record[16:20]))
+		sequenceStart := bamFixedSize + nameSize + 4*cigarNum
+		tagsStart := sequenceStart + (sequenceSize+1)/2 + sequenceSize
+		if sequenceSize < 0 || tagsStart > size {
+			return poster.totalReads, fmt.Errorf("BAM record %v: fields are larger than the block size %v", recordNum, size)
+		}
+		if flag&(samSecondary|samSupplementary) != 0 {
+			continue
+		}
+		sequence = sequence[:0]
+		for i := 0; i < sequenceSize; i++ {
+			packed := record[sequenceStart+i/2]
+			if i%2 == 0 {
+				packed >>= 4
+			}
+			sequence = append(sequence, bamNucleotides[packed&0xf])
+		}
+		read := Read{Sequence: string(sequence)}
+		if flag&samReverse != 0 {
+			read.Sequence = reverseComplement(read.Sequence)
+		}
+		if tags.Used() {
+			var err error
+			read.SampleBarcode, read.RandomBarcode, err = bamTagBarcodes(record[tagsStart:], tags)
+			if err != nil {
+				return poster.totalReads, fmt.Errorf("BAM record %v: %w", recordNum, err)
+			}
+		}
+		if err := poster.post(read); err != nil {
+			return poster.totalReads, err
+		}
+	}
+}
+
+// skipBamHeader checks the magic bytes of the BAM file and reads past the header text and the reference sequences
+func skipBamHeader(reader *bufio.Reader) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(reader, magic[:]); err != nil || string(magic[:]) != "BAM\x01" {
+		return errors.New("not a BAM file")
+	}
+	readSize := func() (int, error) {
+		var size int32
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			return 0, errors.New("truncated BAM header")
+		}
+		if size < 0 {
+			return 0, errors.New("negative size within the BAM header")
+		}
+		return int(size), nil
+	}
+	textSize, err := readSize()
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Discard(textSize); err != nil {
+		return errors.New("truncated BAM header")
+	}
+	referenceNum, err := readSize()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < referenceNum; i++ {
+		nameSize, err := readSize()
+		if err != nil {
+			return err
+		}
+		// the name is followed by the length of the reference sequence
+		if _, err := reader.Discard(nameSize + 4); err != nil {
+			return errors.New("truncated BAM header")
+		}
+	}
+	return nil
+}
+
+// bamTagValueSizes holds the size of the fixed size BAM tag types
+var bamTagValueSizes = map[byte]int{'A': 1, 'c': 1, 'C': 1, 's': 2, 'S': 2, 'i': 4, 'I': 4, 'f': 4}
+
+// bamTagBarcodes returns the values of the sample and random barcode tags within the tags of a BAM record.  Only string
+// tags are used as barcodes
+func bamTagBarcodes(fields []byte, tags BarcodeTags) (string, string, error) {
+	var sample, random string
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return sample, random, errors.New("truncated tag")
+		}
+		tag, valueType := string(fields[:2]), fields[2]
+		fields = fields[3:]
+		var valueSize int
+		switch valueType {
+		case 'Z', 'H':
+			end := bytes.IndexByte(fields, 0)
+			if end == -1 {
+				return sample, random, fmt.Errorf("tag %v is not terminated", tag)
+			}
+			value := string(fields[:end])
+			if tag == tags.Sample {
+				sample = tagBarcode(value)
+			}
+			if tag == tags.Random {
+				random = tagBarcode(value)
+			}
+			valueSize = end + 1
+		case 'B':
+			if len(fields) < 5 {
+				return sample, random, fmt.Errorf("tag %v is truncated", tag)
+			}
+			elementSize, ok := bamTagValueSizes[fields[0]]
+			if !ok {
+				return sample, random, fmt.Errorf("tag %v has an unknown array type '%c'", tag, fields[0])
+			}
+			valueSize = 5 + elementSize*int(binary.LittleEndian.Uint32(fields[1:5]))
+		default:
+			var ok bool
+			if valueSize, ok = bamTagValueSizes[valueType]; !ok {
+				return sample, random, fmt.Errorf("tag %v has an unknown type '%c'", tag, valueType)
+			}
+		}
+		if valueSize < 0 || valueSize > len(fields) {
+			return sample, random, fmt.Errorf("tag %v is truncated", tag)
+		}
+		fields = fields[valueSize:]
+	}
+	return sample, random, nil
+}
+
+// gemWellSuffix matches the '-1' suffix which Cell Ranger adds to the CB tag
+var gemWellSuffix = regexp.MustCompile(`-\d+$`)
+
+// tagBarcode returns the barcode of a tag value.  The numbered suffix of a cell barcode is removed, and the barcodes of dual
+// indexes or duplex UMIs, which are separated by '-', are joined
+func tagBarcode(value string) string {
+	return strings.ReplaceAll(gemWellSuffix.ReplaceAllString(value, ""), "-", "")
+}
+
+// complementNucleotides holds the complement of each IUPAC nucleotide.  Anything else is not changed
+var complementNucleotides = func() [256]byte {
+	var complement [256]byte
+	for i := range complement {
+		complement[i] = byte(i)
+	}
+	for _, pair := range []string{"AT", "CG", "MK", "RY", "VB", "HD"} {
+		complement[pair[0]], complement[pair[1]] = pair[1], pair[0]
+	}
+	return complement
+}()
+
+// reverseComplement returns the reverse complement of sequence
+func reverseComplement(sequence string) string {
+	reversed := make([]byte, len(sequence))
+	for i := 0; i < len(sequence); i++ {
+		reversed[len(sequence)-1-i] = complementNucleotides[sequence[i]]
+	}
+	return string(reversed)
+}
@@ -0,0 +1,240 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRead is a read written to a test BAM file
+type testRead struct {
+	name     string
+	flag     uint16
+	sequence string
+	// tags holds the string tags of the record in order
+	tags [][2]string
+}
+
+// testBam creates a decompressed BAM file of reads, with a header and a single reference sequence.  An int tag and an array
+// tag are written before the string tags so that they are skipped
+func testBam(reads []testRead) []byte {
+	var bam bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&bam, binary.LittleEndian, value)
+		}
+	}
+	header := "@HD\tVN:1.6\tSO:unsorted\n"
+	bam.WriteString("BAM\x01")
+	write(int32(len(header)))
+	bam.WriteString(header)
+	write(int32(1), int32(5))
+	bam.WriteString("chr1\x00")
+	write(int32(1000))
+	for _, read := range reads {
+		var record bytes.Buffer
+		recordWrite := func(values ...interface{}) {
+			for _, value := range values {
+				binary.Write(&record, binary.LittleEndian, value)
+			}
+		}
+		// refID, pos, l_read_name, mapq, bin, n_cigar_op, flag, l_seq, next_refID, next_pos, tlen
+		recordWrite(int32(-1), int32(-1), uint8(len(read.name)+1), uint8(0), uint16(4680), uint16(0), read.flag,
+			int32(len(read.sequence)), int32(-1), int32(-1), int32(0))
+		record.WriteString(read.name + "\x00")
+		packed := make([]byte, (len(read.sequence)+1)/2)
+		for i := 0; i < len(read.sequence); i++ {
+			code := byte(strings.IndexByte(bamNucleotides, read.sequence[i]))
+			if i%2 == 0 {
+				code <<= 4
+			}
+			packed[i/2] |= code
+		}
+		record.Write(packed)
+		record.Write(bytes.Repeat([]byte{30}, len(read.sequence)))
+		record.WriteString("NMi")
+		recordWrite(int32(2))
+		record.WriteString("ZBBs")
+		recordWrite(int32(2), int16(1), int16(-1))
+		for _, tag := range read.tags {
+			record.WriteString(tag[0] + "Z" + tag[1] + "\x00")
+		}
+		write(int32(record.Len()))
+		bam.Write(record.Bytes())
+	}
+	return bam.Bytes()
+}
+
+// wantReads are the reads within each of the test files, with the BC and RX tags of the SAM and BAM files
+var wantReads = []Read{
+	{Sequence: "AGCTAAAATTGACCCCCCCTTTTGGGG", SampleBarcode: "ACGTTTGA", RandomBarcode: "AAAC"},
+	{Sequence: "AGCTCCCCTTGAGGGGAAAAAATTTTACGT", SampleBarcode: "CCGTTTGA", RandomBarcode: "AAAG"},
+}
+
+// testBamReads are the reads of wantReads written to a BAM file, where the second read is reverse complemented and has a
+// secondary alignment
+var testBamReads = []testRead{
+	{"read_1", 4, wantReads[0].Sequence, [][2]string{{"BC", "ACGT-TTGA"}, {"RX", "AAAC"}, {"CB", "ACGTAC-1"}}},
+	{"read_2", samReverse, reverseComplement(wantReads[1].Sequence), [][2]string{{"BC", "CCGTTTGA"}, {"RX", "AAAG"}}},
+	{"read_2", samSecondary, "", [][2]string{{"BC", "CCGTTTGA"}, {"RX", "AAAG"}}},
+}
+
+func TestDetectFileFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		want  FileFormat
+	}{
+		{"fastq", "@read_1\nAGCT\n+\nIIII\n", Fastq},
+		{"fasta", ">read_1\nAGCT\n", Fasta},
+		{"sam with a header", "@HD\tVN:1.6\n", Sam},
+		{"sam without a header", "read_1\t4\t*\t0\t0\t*\t*\t0\t0\tAGCT\tIIII\n", Sam},
+		{"bam", "BAM\x01\x00\x00\x00\x00", Bam},
+		{"cram", "CRAM\x03\x00", Cram},
+		{"empty", "", Fastq},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DetectFileFormat(bufio.NewReader(strings.NewReader(test.start)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("DetectFileFormat(%q) = %v, want %v", test.start, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadFastqFormats(t *testing.T) {
+	bamPath := filepath.Join(t.TempDir(), "reads.bam")
+	if err := os.WriteFile(bamPath, writeBGZF(t, testBam(testBamReads), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tags := BarcodeTags{Sample: "BC", Random: "RX"}
+	tests := []struct {
+		name      string
+		fastqPath string
+		tags      BarcodeTags
+		want      []Read
+	}{
+		{"fasta", filepath.Join("testdata", "reads.fa"), BarcodeTags{}, []Read{{Sequence: wantReads[0].Sequence}, {Sequence: wantReads[1].Sequence}}},
+		{"sam", filepath.Join("testdata", "reads.sam"), tags, wantReads},
+		{"sam without tags", filepath.Join("testdata", "reads.sam"), BarcodeTags{}, []Read{{Sequence: wantReads[0].Sequence}, {Sequence: wantReads[1].Sequence}}},
+		{"sam cell barcode", filepath.Join("testdata", "reads.sam"), BarcodeTags{Sample: "CB"}, []Read{{Sequence: wantReads[0].Sequence, SampleBarcode: "ACGTAC"}, {Sequence: wantReads[1].Sequence}}},
+		{"bam", bamPath, tags, wantReads},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readAll(test.fastqPath, test.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("reads = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanReadsErrors(t *testing.T) {
+	bam := testBam(testBamReads)
+	tests := []struct {
+		name     string
+		contents []byte
+		tags     BarcodeTags
+		want     string
+	}{
+		{"tags within fastq", []byte("@read_1\nAGCT\n+\nIIII\n"), BarcodeTags{Sample: "BC"}, "only within SAM or BAM"},
+		{"cram", []byte("CRAM\x03\x00"), BarcodeTags{}, "CRAM is not supported"},
+		{"truncated bam", bam[:len(bam)-3], BarcodeTags{}, "BAM record 3: truncated"},
+		{"too few sam fields", []byte("@HD\tVN:1.6\nread_1\t4\t*\n"), BarcodeTags{}, "line 2: expected 11"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sequences := make(chan Read, 10)
+			_, _, err := ScanReads(context.Background(), bytes.NewReader(test.contents), ReadOptions{Tags: test.tags}, sequences, nil)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ScanReads error = %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	// text before the first FASTA header is detected as FASTQ, so ScanFasta is called directly
+	if _, err := ScanFasta(context.Background(), strings.NewReader("AGCT\n>read_1\nAGCT\n"), ReadOptions{}, make(chan Read, 10), nil); err == nil || !strings.Contains(err.Error(), "line 1: expected a FASTA header") {
+		t.Errorf("ScanFasta error = %v, want a missing header", err)
+	}
+}
+
+func TestTagBarcode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"ACGTACGT", "ACGTACGT"},
+		{"ACGT-TTGA", "ACGTTTGA"},
+		{"ACGTACGTACGTACGT-1", "ACGTACGTACGTACGT"},
+		{"ACGTACGT-12", "ACGTACGT"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := tagBarcode(test.value); got != test.want {
+			t.Errorf("tagBarcode(%v) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAddBarcodeTags(t *testing.T) {
+	format := testSequenceFormat(t)
+	if err := format.AddBarcodeTags(BarcodeTags{Sample: "BC"}); err == nil {
+		t.Error("AddBarcodeTags with a sample tag and a sample barcode within the sequence format did not return an error")
+	}
+	if err := format.AddBarcodeTags(BarcodeTags{Random: "RX"}); err == nil {
+		t.Error("AddBarcodeTags with a random tag and a random barcode within the sequence format did not return an error")
+	}
+
+	format, err := ParseSequenceFormat(strings.NewReader("AGCTTTGA{4}CC{6}TTTT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := format.AddBarcodeTags(BarcodeTags{Sample: "BC", Random: "RX"}); err != nil {
+		t.Fatal(err)
+	}
+	sampleBarcodes, err := ReadSampleBarcodes(strings.NewReader("Barcode,Sample_ID\nACGTTTGA,s1\nCCGTTTGA,s2\n"), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sampleBarcodes.Barcodes) != 2 {
+		t.Errorf("sample barcodes = %v, want 2", sampleBarcodes.Barcodes)
+	}
+	if _, err := ReadSampleBarcodes(strings.NewReader("Barcode,Sample_ID\nACGTTTGA,s1\nCCGT,s2\n"), format); err == nil {
+		t.Error("ReadSampleBarcodes with sample barcodes of different sizes did not return an error")
+	}
+}
+
+func BenchmarkScanBam(b *testing.B) {
+	reads := make([]testRead, 1000)
+	for i := range reads {
+		reads[i] = testRead{"read", 4, "AGCTAGCTAAAAAATTGACAGTACGTACGTCCTGAGGTTCCAAGGACTAAAAAAAAAATTTTGCA", [][2]string{{"BC", "ACGT-TTGA"}, {"RX", "AAAACCCC"}}}
+	}
+	bam := testBam(reads)
+	tags := BarcodeTags{Sample: "BC", Random: "RX"}
+	sequences := make(chan Read, 1000)
+	go func() {
+		for range sequences {
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ScanBam(context.Background(), bytes.NewReader(bam), ReadOptions{Tags: tags}, sequences, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	close(sequences)
+}
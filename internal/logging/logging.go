@@ -0,0 +1,244 @@
+// Package logging writes the diagnostic messages of every package, such as warnings, errors and debug messages, with a level
+// and a timestamp as text or JSON lines.  Messages go to stderr or a log file, so that they are kept apart from the counts
+// and the run summary written to stdout
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message.  Messages below the level of the Logger are not written
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// String returns the name of the level used within the messages and the --log-level flag
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Levels are the level names in order
+var Levels = []string{DebugLevel.String(), InfoLevel.String(), WarnLevel.String(), ErrorLevel.String()}
+
+// ParseLevel returns the level with the name
+func ParseLevel(name string) (Level, error) {
+	for i, level := range Levels {
+		if strings.EqualFold(name, level) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("log level %q is not one of %v", name, strings.Join(Levels, ", "))
+}
+
+// Format names
+const (
+	// TextFormat writes the time, level, message, then key=value pairs
+	TextFormat = "text"
+	// JSONFormat writes a JSON object per line with time, level and msg keys along with the key value pairs
+	JSONFormat = "json"
+)
+
+// Formats are the format names
+var Formats = []string{TextFormat, JSONFormat}
+
+// Logger writes messages at or above its level.  It is safe to use from multiple goroutines
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	// now returns the time of each message, which is replaced within tests
+	now func() time.Time
+}
+
+// New creates a Logger which writes messages at or above level to out in format, either TextFormat or JSONFormat
+func New(out io.Writer, level Level, format string) *Logger {
+	return &Logger{out: out, level: level, format: format, now: time.Now}
+}
+
+// Writer returns the writer the messages are written to
+func (l *Logger) Writer() io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out
+}
+
+// SetWriter replaces the writer the messages are written to
+func (l *Logger) SetWriter(out io.Writer) {
+	l.mu.Lock()
+	l.out = out
+	l.mu.Unlock()
+}
+
+// Enabled returns whether messages at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a message used to follow what the count is doing
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(DebugLevel, msg, keyvals)
+}
+
+// Info writes a message about the normal progress of the count
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(InfoLevel, msg, keyvals)
+}
+
+// Warn writes a message about a problem which the count continues past, such as an ignored flag
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(WarnLevel, msg, keyvals)
+}
+
+// Error writes a message about a problem which stops the count
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(ErrorLevel, msg, keyvals)
+}
+
+// log writes the message with the key value pairs, which alternate between a string key and any value.  A key without a value
+// is written with an empty value
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().Format("2006-01-02T15:04:05.000Z07:00")
+	var line strings.Builder
+	if l.format == JSONFormat {
+		line.WriteString(`{"time":` + strconv.Quote(now) + `,"level":"` + level.String() + `","msg":` + jsonValue(msg))
+		for i := 0; i < len(keyvals); i += 2 {
+			line.WriteString("," + jsonValue(fmt.Sprint(keyvals[i])) + ":" + jsonValue(value(keyvals, i+1)))
+		}
+		line.WriteString("}\n")
+	} else {
+		line.WriteString(now + " " + strings.ToUpper(level.String()) + " " + msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			line.WriteString(" " + fmt.Sprint(keyvals[i]) + "=" + textValue(value(keyvals, i+1)))
+		}
+		line.WriteString("\n")
+	}
+	io.WriteString(l.out, line.String())
+}
+
+// value returns the value at index i of the key value pairs, or an empty string when the last key has no value.  Errors are
+// written as their message, and values with a String method, such as the compression format, as their name
+func value(keyvals []interface{}, i int) interface{} {
+	if i >= len(keyvals) {
+		return ""
+	}
+	switch value := keyvals[i].(type) {
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return keyvals[i]
+}
+
+// jsonValue returns the JSON of the value, or the value as a JSON string when it can not be encoded
+func jsonValue(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return strconv.Quote(fmt.Sprint(value))
+	}
+	return string(encoded)
+}
+
+// textValue returns the value as text, quoted when it is empty or holds spaces, quotes or '='
+func textValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// std is the Logger used by the package functions
+var std = New(os.Stderr, InfoLevel, TextFormat)
+
+// stdFile is the log file of std, which is not stderr when a log file is used
+var stdFile = os.Stderr
+
+// Default returns the Logger used by the package functions
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the Logger used by the package functions
+func SetDefault(logger *Logger) {
+	std = logger
+}
+
+// Setup replaces the Logger used by the package functions with one at the level named levelName in format.  When logPath is not
+// empty, the messages are appended to the file at logPath, which stays open until the program exits, instead of stderr
+func Setup(levelName string, format string, logPath string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if format != TextFormat && format != JSONFormat {
+		return fmt.Errorf("log format %q is not one of %v", format, strings.Join(Formats, ", "))
+	}
+	out := os.Stderr
+	if logPath != "" {
+		out, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	SetDefault(New(out, level, format))
+	stdFile = out
+	return nil
+}
+
+// Debug writes a debug message with the default Logger
+func Debug(msg string, keyvals ...interface{}) {
+	std.Debug(msg, keyvals...)
+}
+
+// Info writes an info message with the default Logger
+func Info(msg string, keyvals ...interface{}) {
+	std.Info(msg, keyvals...)
+}
+
+// Warn writes a warning with the default Logger
+func Warn(msg string, keyvals ...interface{}) {
+	std.Warn(msg, keyvals...)
+}
+
+// Error writes an error with the default Logger
+func Error(msg string, keyvals ...interface{}) {
+	std.Error(msg, keyvals...)
+}
+
+// Fatal writes err with the default Logger and exits with status 1.  When the messages go to a log file, err is also written
+// to stderr so that the reason for the exit is seen
+func Fatal(err error) {
+	std.Error(err.Error())
+	if stdFile != os.Stderr {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  Level
+		format string
+		log    func(logger *Logger)
+		want   string
+	}{
+		{"text", InfoLevel, TextFormat, func(logger *Logger) {
+			logger.Warn("Skipped malformed FASTQ record", "file", "reads.fastq", "record", 3, "reason", "header line does not start with '@'")
+		}, "2022-01-02T03:04:05.000Z WARN Skipped malformed FASTQ record file=reads.fastq record=3 reason=\"header line does not start with '@'\"\n"},
+		{"json", InfoLevel, JSONFormat, func(logger *Logger) {
+			logger.Info("Writing counts", "sample", "Sample_1", "rows", 12, "log_level", DebugLevel, "error", errors.New("none"))
+		}, `{"time":"2022-01-02T03:04:05.000Z","level":"info","msg":"Writing counts","sample":"Sample_1","rows":12,"log_level":"debug","error":"none"}` + "\n"},
+		{"below level", WarnLevel, TextFormat, func(logger *Logger) {
+			logger.Info("Writing counts")
+			logger.Debug("Checkpoint written")
+		}, ""},
+		{"debug", DebugLevel, TextFormat, func(logger *Logger) {
+			logger.Debug("Checkpoint written", "reads", 100, "missing")
+		}, "2022-01-02T03:04:05.000Z DEBUG Checkpoint written reads=100 missing=\"\"\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := New(&out, test.level, test.format)
+			logger.now = func() time.Time { return time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC) }
+			test.log(logger)
+			if out.String() != test.want {
+				t.Errorf("logged %q, want %q", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for i, name := range Levels {
+		if level, err := ParseLevel(strings.ToUpper(name)); err != nil || level != Level(i) {
+			t.Errorf("ParseLevel(%v) = %v, %v, want %v", name, level, err, Level(i))
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) did not return an error")
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer SetDefault(Default())
+	defer func() { stdFile = os.Stderr }()
+	logPath := filepath.Join(t.TempDir(), "count.log")
+	if err := Setup("warn", JSONFormat, logPath); err != nil {
+		t.Fatal(err)
+	}
+	Info("Writing counts")
+	Warn("Checkpoint not written", "reads", 100)
+	contents, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"msg":"Checkpoint not written","reads":100`) {
+		t.Errorf("log file = %q, want the warning only", contents)
+	}
+	if err := Setup("info", "xml", ""); err == nil {
+		t.Error("Setup with an unknown format did not return an error")
+	}
+}
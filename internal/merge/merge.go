@@ -0,0 +1,184 @@
+// Package merge combines the count files written by previous runs into a single merged count file
+package merge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// datePrefix matches the date which is added to the start of every output file name
+var datePrefix = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_`)
+
+// Counts holds the summed counts of every sample across the count files
+type Counts struct {
+	// barcodeNum is the number of Barcode_# columns, which must be the same for every count file
+	barcodeNum int
+	// counts is a map where the key is the sample ID, and the value is a map of comma separated barcodes to count
+	counts map[string]map[string]int
+}
+
+// NewCounts creates an empty Counts
+func NewCounts() *Counts {
+	return &Counts{counts: make(map[string]map[string]int)}
+}
+
+// AddFile adds the counts from the count file at path.  The file is either a single sample count file, where the sample ID
+// is taken from the file name, or a merged count file, where each sample has a column
+func (c *Counts) AddFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := c.Add(file, SampleName(path)); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
+
+// SampleName returns the sample ID of a single sample count file from its file name, ie 2021-01-01_Sample_1_counts.csv
+// returns Sample_1
+func SampleName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".csv")
+	name = strings.TrimSuffix(name, "_counts")
+	return datePrefix.ReplaceAllString(name, "")
+}
+
+// Add adds the counts read from reader.  sampleName is used as the sample ID when there is a single Count column.  Any
+// normalized or enrichment statistic columns of a merged count file are ignored
+func (c *Counts) Add(reader io.Reader, sampleName string) error {
+	scanner := bufio.NewScanner(reader)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("empty count file")
+	}
+	header := strings.Split(scanner.Text(), ",")
+	var barcodeNum int
+	for barcodeNum < len(header) && strings.HasPrefix(header[barcodeNum], "Barcode_") {
+		barcodeNum++
+	}
+	if barcodeNum == 0 {
+		return fmt.Errorf("line 1: header does not start with Barcode_ columns")
+	}
+	if c.barcodeNum == 0 {
+		c.barcodeNum = barcodeNum
+	} else if c.barcodeNum != barcodeNum {
+		return fmt.Errorf("line 1: %v barcode columns found where other count files have %v", barcodeNum, c.barcodeNum)
+	}
+
+	var samples []string
+	for _, column := range header[barcodeNum:] {
+		// The normalized columns of a merged count file start at the first CPM_ column
+		if strings.HasPrefix(column, "CPM_") {
+			break
+		}
+		samples = append(samples, column)
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("line 1: header does not have any count columns")
+	}
+	if len(samples) == 1 && samples[0] == "Count" {
+		samples[0] = sampleName
+	}
+	for _, sample := range samples {
+		if _, ok := c.counts[sample]; !ok {
+			c.counts[sample] = make(map[string]int)
+		}
+	}
+
+	lineNum := 1
+	for scanner.Scan() {
+		lineNum++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := strings.Split(scanner.Text(), ",")
+		if len(row) < barcodeNum+len(samples) {
+			return fmt.Errorf("line %v: expected %v columns, found %v", lineNum, barcodeNum+len(samples), len(row))
+		}
+		barcodes := strings.Join(row[:barcodeNum], ",")
+		for i, sample := range samples {
+			count, err := strconv.Atoi(row[barcodeNum+i])
+			if err != nil {
+				return fmt.Errorf("line %v: count '%v' is not an integer", lineNum, row[barcodeNum+i])
+			}
+			c.counts[sample][barcodes] += count
+		}
+	}
+	return scanner.Err()
+}
+
+// Samples returns the sorted sample IDs
+func (c *Counts) Samples() []string {
+	samples := make([]string, 0, len(c.counts))
+	for sample := range c.counts {
+		samples = append(samples, sample)
+	}
+	sort.Strings(samples)
+	return samples
+}
+
+// Write writes the merged counts to writer with the same layout as the merged output of the count subcommand.  Rows are
+// sorted by the barcodes
+func (c *Counts) Write(writer io.Writer) error {
+	samples := c.Samples()
+	barcodesFound := make(map[string]struct{})
+	for _, sampleCounts := range c.counts {
+		for barcodes := range sampleCounts {
+			barcodesFound[barcodes] = struct{}{}
+		}
+	}
+	rows := make([]string, 0, len(barcodesFound))
+	for barcodes := range barcodesFound {
+		rows = append(rows, barcodes)
+	}
+	sort.Strings(rows)
+
+	buffered := bufio.NewWriter(writer)
+	for i := 0; i < c.barcodeNum; i++ {
+		buffered.WriteString("Barcode_" + strconv.Itoa(i+1) + ",")
+	}
+	buffered.WriteString(strings.Join(samples, ","))
+	for _, barcodes := range rows {
+		buffered.WriteString("\n" + barcodes)
+		for _, sample := range samples {
+			buffered.WriteString("," + strconv.Itoa(c.counts[sample][barcodes]))
+		}
+	}
+	return buffered.Flush()
+}
+
+// Merge reads each count file within paths and writes the merged counts to outpath with the same file name as the merged
+// output of the count subcommand.  The name of the written file is returned
+func Merge(paths []string, outpath string) (string, error) {
+	counts := NewCounts()
+	for _, path := range paths {
+		if err := counts.AddFile(path); err != nil {
+			return "", err
+		}
+	}
+	today := time.Now().Local().Format("2006-01-02")
+	fileName := outpath + today + "_counts.all.csv"
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	if err := counts.Write(file); err != nil {
+		file.Close()
+		return "", fmt.Errorf("%v: %w", fileName, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("%v: %w", fileName, err)
+	}
+	return fileName, nil
+}
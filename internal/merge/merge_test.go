@@ -0,0 +1,52 @@
+package merge
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSampleName(t *testing.T) {
+	tests := map[string]string{
+		"out/2021-01-01_Sample_1_counts.csv": "Sample_1",
+		"2021-01-01_barcode_counts.csv":      "barcode",
+		"other.csv":                          "other",
+	}
+	for path, want := range tests {
+		if got := SampleName(path); got != want {
+			t.Errorf("SampleName(%v) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	counts := NewCounts()
+	if err := counts.Add(strings.NewReader("Barcode_1,Barcode_2,Count\na1,b1,3\na2,b1,1\n"), "s1"); err != nil {
+		t.Fatal(err)
+	}
+	merged := "Barcode_1,Barcode_2,s1,s2,CPM_s1,CPM_s2\na1,b1,2,5,1.0,1.0\na1,b2,0,4,1.0,1.0\n"
+	if err := counts.Add(strings.NewReader(merged), "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := counts.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := "Barcode_1,Barcode_2,s1,s2\na1,b1,5,5\na1,b2,0,4\na2,b1,1,0"
+	if out.String() != want {
+		t.Errorf("merged counts =\n%v\nwant\n%v", out.String(), want)
+	}
+
+	errorTests := []struct {
+		name, contents, want string
+	}{
+		{"barcode number", "Barcode_1,Count\na1,3\n", "1 barcode columns found where other count files have 2"},
+		{"not a count", "Barcode_1,Barcode_2,Count\na1,b1,x\n", "line 2: count 'x' is not an integer"},
+		{"missing column", "Barcode_1,Barcode_2,Count\na1,b1\n", "line 2: expected 3 columns, found 2"},
+	}
+	for _, test := range errorTests {
+		err := counts.Add(strings.NewReader(test.contents), "s1")
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package metrics serves the counters of a running count in the Prometheus text format, so that the throughput and error
+// rates of long counts can be monitored: the reads read and parsed, the parsed reads within each ParseErrors category, the
+// depth of the sequences channel, the memory used, and the stage timings when the stage timers are on
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
+)
+
+// Path is the path the metrics are served on
+const Path = "/metrics"
+
+// Metrics exposes the counters of a count.  Nothing is counted twice: the parsed reads are read from the ParseErrors, the
+// stage timings from the StageTimes, and the channel depth from the channel itself when the metrics are scraped
+type Metrics struct {
+	seqErrors *results.ParseErrors
+	timings   *timing.StageTimes
+	sequences chan input.Read
+	start     time.Time
+	// reads and bytesRead are updated by the reader goroutine with Update
+	reads     int64
+	bytesRead int64
+}
+
+// New creates the Metrics of a count which parses the reads posted to sequences into seqErrors.  timings is nil when the
+// stage timers are off, in which case the stage timings are not exposed
+func New(seqErrors *results.ParseErrors, timings *timing.StageTimes, sequences chan input.Read) *Metrics {
+	return &Metrics{seqErrors: seqErrors, timings: timings, sequences: sequences, start: time.Now()}
+}
+
+// Update sets the reads and the bytes of the reads file read so far.  It is called along with the input.ReadOptions Progress
+// function
+func (m *Metrics) Update(totalReads int, bytesRead int64) {
+	atomic.StoreInt64(&m.reads, int64(totalReads))
+	atomic.StoreInt64(&m.bytesRead, bytesRead)
+}
+
+// metric is a single metric family of the Prometheus text format
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	values []sample
+}
+
+// sample is a value of a metric, with an optional label
+type sample struct {
+	label string
+	value float64
+}
+
+// families returns the current value of every metric
+func (m *Metrics) families() []metric {
+	summary := m.seqErrors.Summary()
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	families := []metric{
+		{"barcode_count_reads_read_total", "Reads read from the reads file, updated every 10,000 reads.", "counter",
+			[]sample{{value: float64(atomic.LoadInt64(&m.reads))}}},
+		{"barcode_count_bytes_read_total", "Bytes of the reads file read, before decompression.", "counter",
+			[]sample{{value: float64(atomic.LoadInt64(&m.bytesRead))}}},
+		{"barcode_count_reads_processed_total", "Reads parsed and added to a ParseErrors category.", "counter",
+			[]sample{{value: float64(summary.Reads())}}},
+		{"barcode_count_reads_category_total", "Parsed reads within each ParseErrors category.", "counter", []sample{
+			{`category="correct"`, float64(summary.Correct)},
+			{`category="constant_error"`, float64(summary.Constant)},
+			{`category="sample_error"`, float64(summary.Sample)},
+			{`category="random_error"`, float64(summary.Random)},
+			{`category="counted_error"`, float64(summary.Counted)},
+			{`category="duplicate"`, float64(summary.Duplicate)},
+		}},
+		{"barcode_count_channel_depth", "Reads posted by the reader and waiting for a parsing thread.", "gauge",
+			[]sample{{value: float64(len(m.sequences))}}},
+		{"barcode_count_channel_capacity", "Reads the sequences channel holds before the reader waits.", "gauge",
+			[]sample{{value: float64(cap(m.sequences))}}},
+		{"barcode_count_elapsed_seconds", "Seconds since the count started.", "gauge",
+			[]sample{{value: time.Since(m.start).Seconds()}}},
+		{"go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", "gauge", []sample{{value: float64(memory.HeapAlloc)}}},
+		{"go_memstats_sys_bytes", "Bytes of memory obtained from the operating system.", "gauge", []sample{{value: float64(memory.Sys)}}},
+		{"go_goroutines", "Goroutines that currently exist.", "gauge", []sample{{value: float64(runtime.NumGoroutine())}}},
+	}
+	if m.timings != nil {
+		seconds := metric{name: "barcode_count_stage_seconds_total", help: "Time spent within each stage summed over the threads, updated every 10,000 reads per thread.", kind: "counter"}
+		calls := metric{name: "barcode_count_stage_calls_total", help: "Calls of each stage, updated every 10,000 reads per thread.", kind: "counter"}
+		for _, stage := range timing.Stages() {
+			label := `stage="` + stage.String() + `"`
+			seconds.values = append(seconds.values, sample{label, m.timings.Elapsed(stage).Seconds()})
+			calls.values = append(calls.values, sample{label, float64(m.timings.Calls(stage))})
+		}
+		families = append(families, seconds, calls)
+	}
+	return families
+}
+
+// Write writes every metric to out in the Prometheus text format
+func (m *Metrics) Write(out io.Writer) error {
+	writer := bufio.NewWriter(out)
+	for _, family := range m.families() {
+		fmt.Fprintf(writer, "# HELP %v %v\n# TYPE %v %v\n", family.name, family.help, family.name, family.kind)
+		for _, value := range family.values {
+			name := family.name
+			if value.label != "" {
+				name += "{" + value.label + "}"
+			}
+			fmt.Fprintf(writer, "%v %v\n", name, strconv.FormatFloat(value.value, 'f', -1, 64))
+		}
+	}
+	return writer.Flush()
+}
+
+// ServeHTTP writes the metrics for a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.Write(w); err != nil {
+		logging.Debug("Metrics not written", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// Server serves the metrics until it is closed
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Serve listens on addr, such as :9090 or localhost:9090, and serves the metrics on Path within its own goroutine.  An
+// error is returned when addr cannot be listened on
+func Serve(addr string, metrics *Metrics) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, metrics)
+	server := &Server{server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}, listener: listener}
+	go func() {
+		if err := server.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Warn("Metrics server stopped", "addr", listener.Addr(), "error", err)
+		}
+	}()
+	logging.Info("Serving metrics", "url", "http://"+listener.Addr().String()+Path)
+	return server, nil
+}
+
+// Addr returns the address listened on, which holds the port chosen when addr has port 0
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, waiting up to a second for a scrape in progress to finish
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
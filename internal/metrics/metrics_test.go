@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
+)
+
+// testMetrics returns Metrics of 2,000,003 correct reads, a constant error and a duplicate, with 2 reads waiting within a
+// channel of 4
+func testMetrics(timings *timing.StageTimes) *Metrics {
+	// the counts are large enough to check that they are not written with an exponent
+	var seqErrors results.ParseErrors
+	seqErrors.Restore(results.ErrorSummary{Correct: 2000003, Constant: 1, Duplicate: 1})
+	sequences := make(chan input.Read, 4)
+	sequences <- input.Read{}
+	sequences <- input.Read{}
+	metrics := New(&seqErrors, timings, sequences)
+	metrics.Update(7, 1024)
+	return metrics
+}
+
+func TestWrite(t *testing.T) {
+	timings := &timing.StageTimes{}
+	timer := timings.NewTimer()
+	timer.Add(timing.Match, 1500*time.Millisecond, 5)
+	timings.Add(timer)
+	tests := []struct {
+		name    string
+		timings *timing.StageTimes
+		want    []string
+		notWant []string
+	}{
+		{"stage timers off", nil, []string{
+			"# TYPE barcode_count_reads_read_total counter",
+			"barcode_count_reads_read_total 7",
+			"barcode_count_bytes_read_total 1024",
+			"barcode_count_reads_processed_total 2000005",
+			`barcode_count_reads_category_total{category="correct"} 2000003`,
+			`barcode_count_reads_category_total{category="constant_error"} 1`,
+			`barcode_count_reads_category_total{category="sample_error"} 0`,
+			`barcode_count_reads_category_total{category="random_error"} 0`,
+			`barcode_count_reads_category_total{category="duplicate"} 1`,
+			"# TYPE barcode_count_channel_depth gauge",
+			"barcode_count_channel_depth 2",
+			"barcode_count_channel_capacity 4",
+			"# TYPE go_memstats_heap_alloc_bytes gauge",
+		}, []string{"barcode_count_stage_seconds_total"}},
+		{"stage timers on", timings, []string{
+			`barcode_count_stage_seconds_total{stage="match"} 1.5`,
+			`barcode_count_stage_calls_total{stage="match"} 5`,
+			`barcode_count_stage_calls_total{stage="ReadFastq"} 0`,
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := testMetrics(test.timings).Write(&out); err != nil {
+				t.Fatal(err)
+			}
+			lines := make(map[string]bool)
+			for _, line := range strings.Split(out.String(), "\n") {
+				lines[line] = true
+			}
+			for _, want := range test.want {
+				if !lines[want] {
+					t.Errorf("metrics do not have the line %q:\n%v", want, out.String())
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(out.String(), notWant) {
+					t.Errorf("metrics have %v", notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	server, err := Serve("127.0.0.1:0", testMetrics(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Get("http://" + server.Addr() + Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "barcode_count_reads_processed_total 2000005\n") {
+		t.Errorf("GET %v = %v:\n%s", Path, response.Status, body)
+	}
+
+	// the address is still in use until the server is closed
+	if _, err := Serve(server.Addr(), testMetrics(nil)); err == nil {
+		t.Error("Serve on an address in use did not return an error")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + server.Addr() + Path); err == nil {
+		t.Error("metrics served after Close")
+	}
+}
@@ -1,140 +1,338 @@
 package parse
 
 import (
+	"context"
 	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
 	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
+	"math"
 	"strings"
 	"sync"
 )
 
-// ParseSequences iterates over the sequences which are added to a channel by a reader thread,
-// and then finds the barcodes within the sequence and, sequening errors are not above the threshold,
-// will add the counted barcode to the results.  This is meant to be threadsafe, so it can be spawned
-// multiple times to decrease computation time
-func ParseSequences(
-	// sequences is a channel which holds the sequences read by input.ReadFastq
-	sequences chan string,
-	wg *sync.WaitGroup,
-	// counts is the struct which holds the counted results
-	counts *results.Counts,
+// Stage is the parsing stage of a sequence.  A sequence which fails is reported at the stage it failed
+type Stage int
+
+const (
+	// ConstantStage is where the constant region is found, fixing sequencing errors when needed
+	ConstantStage Stage = iota
+	// SampleStage is where the sample barcode is matched to the sample barcodes
+	SampleStage
+	// RandomStage is where the random barcode is taken from its SAM or BAM tag
+	RandomStage
+	// CountedStage is where each counted barcode is matched to the counted barcodes
+	CountedStage
+	// Matched is used when every stage passed
+	Matched
+)
+
+// String returns the name of the stage
+func (s Stage) String() string {
+	switch s {
+	case ConstantStage:
+		return "constant"
+	case SampleStage:
+		return "sample"
+	case RandomStage:
+		return "random"
+	case CountedStage:
+		return "counted"
+	default:
+		return "matched"
+	}
+}
+
+// Match holds the result of parsing a single sequence
+type Match struct {
+	// Stage is the stage where the sequence failed, or Matched
+	Stage         Stage
+	SampleBarcode string
+	// CountedBarcodes is the comma separated counted barcodes
+	CountedBarcodes string
+	RandomBarcode   string
+	// Repaired is whether the constant region was fixed, and RepairOffset is then the start of the sequence format within
+	// the sequence
+	Repaired     bool
+	RepairOffset int
+}
+
+// Parser finds and error corrects the barcodes within a single sequence.  A Parser is not changed while parsing, so it can
+// be shared by multiple threads
+type Parser struct {
 	// format is a struct which holds information essential for finding barcodes and do sequence error correction
-	// This includes the regex used to search for barcodes
-	format input.SequenceFormat,
+	format input.SequenceFormat
+	// matcher finds the start of the sequence format within each sequence
+	matcher input.Matcher
 	// sampleBarcodes holds barcode conversion to ID for samples
-	sampleBarcodes input.SampleBarcodes,
+	sampleBarcodes input.SampleBarcodes
 	// countedBarcodesStruct holds barcode conversion to id for counted barcodes
-	countedBarcodesStruct input.CountedBarcodes,
-	// seqErrors is a struct which keeps track of the quantity of seequencing errors
-	seqErrors *results.ParseErrors,
+	countedBarcodesStruct input.CountedBarcodes
 	// maxErrors holds the maximum sequencing errors allowed per barcode
-	maxErrors results.MaxBarcodeErrorsAllowed,
-) {
-	defer wg.Done()
+	maxErrors results.MaxBarcodeErrorsAllowed
 	// a map:struct is created to check whether or not a sampleBarcode exists.  This is used in place
 	// of what would normally be a set.  Faster than checking the contents of a slice
+	sampleBarcodesCheck map[string]struct{}
+	// sample, random and counted hold the offset and size of the barcodes from the start of the sequence format.  sample and
+	// random have a size of 0 when the sequence format does not have them
+	sample, random barcodeRegion
+	counted        []barcodeRegion
+	// minOffset and maxOffset limit where the sequence format can start when the constant region is fixed
+	minOffset, maxOffset int
+}
+
+// barcodeRegion is the position of a barcode within the sequence format
+type barcodeRegion struct {
+	offset, size int
+}
+
+// NewParser creates a Parser.  matcher finds the sequence format within each sequence
+func NewParser(format input.SequenceFormat, sampleBarcodes input.SampleBarcodes, countedBarcodesStruct input.CountedBarcodes, maxErrors results.MaxBarcodeErrorsAllowed, matcher input.Matcher) *Parser {
 	sampleBarcodesCheck := make(map[string]struct{})
 	for _, sampleBarcode := range sampleBarcodes.Barcodes {
 		sampleBarcodesCheck[sampleBarcode] = struct{}{}
 	}
+	p := &Parser{
+		format:                format,
+		matcher:               matcher,
+		sampleBarcodes:        sampleBarcodes,
+		countedBarcodesStruct: countedBarcodesStruct,
+		maxErrors:             maxErrors,
+		sampleBarcodesCheck:   sampleBarcodesCheck,
+		maxOffset:             math.MaxInt,
+	}
+	var offset int
+	for _, region := range format.Regions {
+		switch region.Kind {
+		case input.SampleRegion:
+			// the first sample barcode is used, the same as the first 'sample' capture group of the regex
+			if p.sample.size == 0 {
+				p.sample = barcodeRegion{offset, region.Size}
+			}
+		case input.RandomRegion:
+			p.random = barcodeRegion{offset, region.Size}
+		case input.CountedRegion:
+			p.counted = append(p.counted, barcodeRegion{offset, region.Size})
+		}
+		offset += region.Size
+	}
+	return p
+}
 
-	for sequence := range sequences {
-		// If the regex does not work on the sequence, there's a good chance there are sequencing sequencing
-		// errors within the constant region.
-		if !format.FormatRegex.MatchString(sequence) {
-			sequence = fixConstant(sequence, format.FormatString, maxErrors.Constant)
+// LimitConstantOffsets limits the constant region repair to the sequence format starting within tolerance of expectedStart.
+// By default every start where the sequence format fits within the read is searched.  This must be called before parsing
+func (p *Parser) LimitConstantOffsets(expectedStart int, tolerance int) {
+	p.minOffset = expectedStart - tolerance
+	p.maxOffset = expectedStart + tolerance
+	logging.Debug("Constant region repair limited", "min_start", p.minOffset, "max_start", p.maxOffset)
+}
+
+// Parse finds the barcodes within the sequence and fixes any sequencing errors which are not above the threshold
+func (p *Parser) Parse(sequence string) Match {
+	return p.parse(input.Read{Sequence: sequence}, nil)
+}
+
+// parse is Parse of a read, which also holds the barcodes of the SAM or BAM tags, with the time of each stage added to
+// timer.  timer is nil when the stage timers are off
+func (p *Parser) parse(read input.Read, timer *timing.Timer) Match {
+	sequence := read.Sequence
+	startTime := timer.Start()
+	start := p.matcher.Find(sequence)
+	timer.Stop(timing.Match, startTime)
+	// If the sequence format is not found, there's a good chance there are sequencing sequencing
+	// errors within the constant region.
+	var match Match
+	if start == -1 {
+		startTime = timer.Start()
+		var offset int
+		sequence, offset = fixConstant(sequence, p.format.FormatString, p.maxErrors.Constant, p.minOffset, p.maxOffset)
+		if offset != -1 {
+			start = p.matcher.Find(sequence)
+		}
+		timer.Stop(timing.FixConstant, startTime)
+		if start == -1 {
+			return Match{Stage: ConstantStage}
+		}
+		match.Repaired = true
+		match.RepairOffset = offset
+	}
+	// barcode slices the barcode of the region from the sequence
+	barcode := func(region barcodeRegion) string {
+		return sequence[start+region.offset : start+region.offset+region.size]
+	}
+	// The sample barcode is found first so that it is known when any of the counted barcodes fail
+	if p.sample.size != 0 || p.format.Tags.Sample != "" {
+		if p.format.Tags.Sample == "" {
+			match.SampleBarcode = barcode(p.sample)
+		} else if len(read.SampleBarcode) == p.format.SampleSize {
+			// a tag which is missing or not the size of the sample barcodes is left empty, as it cannot be fixed
+			match.SampleBarcode = read.SampleBarcode
+		}
+		if match.SampleBarcode != "" && p.sampleBarcodes.Included {
+			if _, ok := p.sampleBarcodesCheck[match.SampleBarcode]; !ok {
+				startTime = timer.Start()
+				match.SampleBarcode = fixSequence(match.SampleBarcode, p.sampleBarcodes.Barcodes, p.maxErrors.Sample)
+				timer.Stop(timing.FixSequence, startTime)
+			}
 		}
+		// If fixSequence does not find a best match, it returns an empty string
+		if match.SampleBarcode == "" {
+			match.Stage = SampleStage
+			return match
+		}
+	}
+	if p.format.Tags.Random != "" {
+		// a read without the random tag cannot be deduplicated, so it is not counted
+		if read.RandomBarcode == "" {
+			match.Stage = RandomStage
+			return match
+		}
+		match.RandomBarcode = read.RandomBarcode
+	} else if p.random.size != 0 {
+		match.RandomBarcode = barcode(p.random)
+	}
+	// countedBarcodeNum is the index of the counted barcode within the counted barcodes
+	for countedBarcodeNum, region := range p.counted {
+		if countedBarcodeNum != 0 {
+			match.CountedBarcodes += ","
+		}
+		countedBarcode := barcode(region)
+		// When a counted barcodes file is not included hte conversion is not created
+		if p.countedBarcodesStruct.Included {
+			if _, ok := p.countedBarcodesStruct.Conversion[countedBarcodeNum][countedBarcode]; !ok {
+				startTime = timer.Start()
+				countedBarcode = fixSequence(countedBarcode, p.countedBarcodesStruct.Barcodes[countedBarcodeNum], p.maxErrors.Counted)
+				timer.Stop(timing.FixSequence, startTime)
+			}
+		}
+		// If fixSequence does not find a best match, it returns an empty string
+		if countedBarcode == "" {
+			match.Stage = CountedStage
+			return match
+		}
+		match.CountedBarcodes += countedBarcode
+	}
+	match.Stage = Matched
+	return match
+}
 
-		sequenceMatch := format.FormatRegex.FindStringSubmatch(sequence)
-		if sequenceMatch == nil {
+// ParseSequences iterates over the sequences which are added to a channel by a reader thread,
+// and then finds the barcodes within the sequence and, sequening errors are not above the threshold,
+// will add the counted barcode to the results.  This is meant to be threadsafe, so it can be spawned
+// multiple times to decrease computation time.  Once ctx is done, the remaining sequences are drained without being counted
+// until the channel is closed, so that the reader is not left waiting
+func ParseSequences(
+	ctx context.Context,
+	// sequences is a channel which holds the reads read by input.ReadFastq
+	sequences chan input.Read,
+	wg *sync.WaitGroup,
+	// counts is the struct which holds the counted results
+	counts *results.Counts,
+	// parser finds and error corrects the barcodes.  It is shared by all of the parsing threads
+	parser *Parser,
+	// seqErrors is a struct which keeps track of the quantity of seequencing errors
+	seqErrors *results.ParseErrors,
+	// timings holds the time of each parsing stage summed over the threads.  nil when the stage timers are off
+	timings *timing.StageTimes,
+) {
+	defer wg.Done()
+	sampleIncluded := parser.sampleBarcodes.Included
+	// timer is local to the thread so that timing each read does not need a lock
+	timer := timings.NewTimer()
+	defer timings.Add(timer)
+	// done is taken once, as it is checked for every read
+	done := ctx.Done()
+	// parsed is the reads parsed by this thread, used to add the stage times every timing.AddEvery reads
+	parsed := 0
+	for read := range sequences {
+		select {
+		case <-done:
+			continue
+		default:
+		}
+		match := parser.parse(read, timer)
+		if match.Repaired {
+			seqErrors.AddRepairOffset(match.RepairOffset)
+		}
+		switch match.Stage {
+		case ConstantStage:
 			seqErrors.AddConstantError()
-		} else {
-			var sampleBarcode, randomBarcode, countedBarcodes, countedBarcode string
-			// countedBarcodeNum holds the number of counted barcode that should be used as an index
-			// for the current barcode iteration
-			countedBarcodeNum := 0
-			// sequenceFail is used to end the iteratoin early if any of the sequencing errors fail to get fixed
-			sequenceFail := false
-			for i, name := range format.FormatRegex.SubexpNames() {
-				// the barcode name from the capture group exists as either sample, random, or counted_#
-				switch {
-				case name == "sample":
-					sampleBarcode = sequenceMatch[i]
-					if sampleBarcodes.Included {
-						if _, ok := sampleBarcodesCheck[sampleBarcode]; !ok {
-							sampleBarcode = fixSequence(sampleBarcode, sampleBarcodes.Barcodes, maxErrors.Sample)
-						}
-					}
-					// If fixSequence does not find a best match, it returns an empty string
-					if sampleBarcode == "" {
-						seqErrors.AddSampleError()
-						sequenceFail = true
-					}
-				case name == "random":
-					randomBarcode = sequenceMatch[i]
-				case strings.Contains(name, "counted"):
-					if countedBarcodeNum != 0 {
-						countedBarcodes += ","
-					}
-					countedBarcode = sequenceMatch[i]
-					// When a counted barcodes file is not included hte conversion is not created
-					if countedBarcodesStruct.Included {
-						if _, ok := countedBarcodesStruct.Conversion[countedBarcodeNum][countedBarcode]; !ok {
-							countedBarcode = fixSequence(countedBarcode, countedBarcodesStruct.Barcodes[countedBarcodeNum], maxErrors.Counted)
-						}
-					}
-					// If fixSequence does not find a best match, it returns an empty string
-					if countedBarcode == "" {
-						seqErrors.AddCountedError()
-						sequenceFail = true
-					} else {
-						countedBarcodes += countedBarcode
-						countedBarcodeNum++
-					}
-				}
-				if sequenceFail {
-					break
-				}
-			}
+		case SampleStage:
+			seqErrors.AddSampleError()
+		case RandomStage:
+			seqErrors.AddRandomError()
+		case CountedStage:
+			// the counts are added before the error category so that a read is fully counted once it is within a category,
+			// which checkpoints wait for
+			counts.AddUnmapped(match.SampleBarcode, sampleIncluded)
+			seqErrors.AddCountedError()
+		default:
 			// If none of the error corrections failed and good matches were found, add the count
-			if !sequenceFail {
-				if inserted := counts.AddCount(sampleBarcode, countedBarcodes, randomBarcode, sampleBarcodes.Included); inserted {
-					seqErrors.AddCorrect()
-				} else {
-					seqErrors.AddDuplicateError()
-				}
+			start := timer.Start()
+			inserted := counts.AddCount(match.SampleBarcode, match.CountedBarcodes, match.RandomBarcode, sampleIncluded)
+			timer.Stop(timing.AddCount, start)
+			if inserted {
+				seqErrors.AddCorrect()
+			} else {
+				seqErrors.AddDuplicateError()
 			}
 		}
+		parsed++
+		if timer != nil && parsed%timing.AddEvery == 0 {
+			timings.Add(timer)
+		}
 	}
 }
 
-// fixConstant fixes the constant region of the sequence when the regex search does not match
-func fixConstant(querySequence string, formatString string, maxErrors int) string {
-	lengthDiff := len(querySequence) - len(formatString)
-	var possibleSeqs []string
-	for i := 0; i < lengthDiff; i++ {
-		possibleSeqs = append(possibleSeqs, querySequence[i:i+len(formatString)])
+// fixConstant fixes the constant region of the sequence when the sequence format is not found.  The format string is
+// compared to the sequence at each offset from minOffset to maxOffset where it fits within the sequence, and the offset with
+// the fewest mismatches is used when the mismatches are not above maxErrors and no other offset ties.  The fixed sequence
+// and the offset are returned, or an empty string and -1 when no offset passes
+func fixConstant(querySequence string, formatString string, maxErrors int, minOffset int, maxOffset int) (string, int) {
+	if minOffset < 0 {
+		minOffset = 0
+	}
+	if lastOffset := len(querySequence) - len(formatString); maxOffset > lastOffset {
+		maxOffset = lastOffset
+	}
+	bestMismatches := maxErrors + 1
+	bestOffset := -1
+	for offset := minOffset; offset <= maxOffset; offset++ {
+		// the window is compared in place, in the same way as fixSequence, so that a substring is not created per offset
+		mismatches := 0
+		for i := 0; i < len(formatString) && mismatches <= bestMismatches; i++ {
+			if formatString[i] != querySequence[offset+i] && formatString[i] != 'N' && querySequence[offset+i] != 'N' {
+				mismatches++
+			}
+		}
+		if mismatches == bestMismatches {
+			bestOffset = -1
+		}
+		if mismatches < bestMismatches {
+			bestMismatches = mismatches
+			bestOffset = offset
+		}
 	}
-	bestSeqeunce := fixSequence(formatString, possibleSeqs, maxErrors)
-	if bestSeqeunce != "" {
-		fixedSequence := swapBarcodes(bestSeqeunce, formatString)
-		return fixedSequence
+	if bestOffset == -1 {
+		return "", -1
 	}
-	return ""
+	return swapBarcodes(querySequence[bestOffset:bestOffset+len(formatString)], formatString), bestOffset
 }
 
 // swapBarcodes creates a fixed sequence. It does this by using the formatString which
 // contains the sequencing format where the barcodes are replaced by Ns.  This funciton
-// swaps out the Ns for the barcodes found within the sequencing read.
+// swaps out the Ns for the barcodes found within the sequencing read.  The fixed sequence is built with a single allocation
 func swapBarcodes(bestSeqeunce string, formatString string) string {
-	var fixedSequence string
+	var fixedSequence strings.Builder
+	fixedSequence.Grow(len(formatString))
 	for i := 0; i < len(formatString); i++ {
 		if formatString[i] == 'N' {
-			fixedSequence += string(bestSeqeunce[i])
+			fixedSequence.WriteByte(bestSeqeunce[i])
 		} else {
-			fixedSequence += string(formatString[i])
+			fixedSequence.WriteByte(formatString[i])
 		}
 	}
-	return fixedSequence
+	return fixedSequence.String()
 }
 
 // fixSequence iterates through subjectSequences to find the best match to the querySequence.  maxErrors is 
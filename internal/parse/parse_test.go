@@ -0,0 +1,355 @@
+package parse
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
+)
+
+const (
+	testFormat  = "AGCTAGCT[6]TTGACAGT{8}CCTGA{8}GGACT(10)TTTTGCA\n"
+	testSamples = "Barcode,Sample_ID\nAAAAAA,s1\nCCCCCC,s2\nGGGGGG,s3\n"
+	testCounted = "Barcode,Barcode_ID,Barcode_Number\n" +
+		"ACGTACGT,a1,1\nTGCATGCA,a2,1\nGGTTCCAA,a3,1\n" +
+		"CCAAGGTT,b1,2\nATATCGCG,b2,2\nGCGCATAT,b3,2\n"
+	// testFlank is the number of nucleotides before and after the sequence format within each test read
+	testFlank = 4
+)
+
+// testParser creates a Parser of the test format and barcodes with the matcher selected by matcherName
+func testParser(tb testing.TB, matcherName string) *Parser {
+	tb.Helper()
+	format, err := input.ParseSequenceFormat(strings.NewReader(testFormat))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sampleBarcodes, err := input.ReadSampleBarcodes(strings.NewReader(testSamples), format)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	countedBarcodes, err := input.ReadCountedBarcodes(strings.NewReader(testCounted), format)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	matcher, err := input.NewMatcher(matcherName, format)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewParser(format, sampleBarcodes, countedBarcodes, results.NewMaxErrors(-1, -1, -1, format), matcher)
+}
+
+// testReads creates readNum reads which follow the sequence format of parser.  constantErrors and barcodeErrors are the
+// number of substitutions added to the first constant region and to each counted barcode
+func testReads(parser *Parser, readNum int, constantErrors int, barcodeErrors int) []string {
+	random := rand.New(rand.NewSource(1))
+	randomSequence := func(size int) []byte {
+		sequence := make([]byte, size)
+		for i := range sequence {
+			sequence[i] = "ATGC"[random.Intn(4)]
+		}
+		return sequence
+	}
+	// substitute changes the first errors nucleotides of the region
+	substitute := func(region []byte, errors int) []byte {
+		for i := 0; i < errors && i < len(region); i++ {
+			region[i] = "TACG"[strings.IndexByte("ATGC", region[i])]
+		}
+		return region
+	}
+	reads := make([]string, readNum)
+	for i := range reads {
+		read := randomSequence(testFlank)
+		constantNum := 0
+		for _, region := range parser.format.Regions {
+			var part []byte
+			switch region.Kind {
+			case input.ConstantRegion:
+				part = []byte(region.Sequence)
+				if constantNum == 0 {
+					part = substitute(part, constantErrors)
+				}
+				constantNum++
+			case input.SampleRegion:
+				part = []byte(parser.sampleBarcodes.Barcodes[random.Intn(len(parser.sampleBarcodes.Barcodes))])
+			case input.CountedRegion:
+				barcodes := parser.countedBarcodesStruct.Barcodes[region.Index-1]
+				part = substitute([]byte(barcodes[random.Intn(len(barcodes))]), barcodeErrors)
+			default:
+				part = randomSequence(region.Size)
+			}
+			read = append(read, part...)
+		}
+		reads[i] = string(append(read, randomSequence(testFlank)...))
+	}
+	return reads
+}
+
+func TestParse(t *testing.T) {
+	parser := testParser(t, input.AnchorMatcherName)
+	tests := []struct {
+		name           string
+		constantErrors int
+		barcodeErrors  int
+		want           Stage
+	}{
+		{"perfect", 0, 0, Matched},
+		{"constant errors fixed", 1, 0, Matched},
+		{"too many constant errors", 9, 0, ConstantStage},
+		{"barcode errors fixed", 0, 1, Matched},
+		{"too many barcode errors", 0, 3, CountedStage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, read := range testReads(parser, 20, test.constantErrors, test.barcodeErrors) {
+				if match := parser.Parse(read); match.Stage != test.want {
+					t.Errorf("Parse(%v) stage = %v, want %v", read, match.Stage, test.want)
+				}
+			}
+		})
+	}
+}
+
+// TestParseMatchers checks that the anchor and regex matchers parse every read the same way
+func TestParseMatchers(t *testing.T) {
+	anchorParser, regexParser := testParser(t, input.AnchorMatcherName), testParser(t, input.RegexMatcherName)
+	var reads []string
+	for _, errors := range [][2]int{{0, 0}, {1, 0}, {3, 0}, {9, 0}, {0, 1}, {0, 3}} {
+		reads = append(reads, testReads(anchorParser, 50, errors[0], errors[1])...)
+	}
+	for _, read := range reads {
+		if anchor, regex := anchorParser.Parse(read), regexParser.Parse(read); anchor != regex {
+			t.Errorf("Parse(%v) = %+v with the anchor matcher, %+v with the regex matcher", read, anchor, regex)
+		}
+	}
+}
+
+func TestParseStageTimers(t *testing.T) {
+	parser := testParser(t, input.AnchorMatcherName)
+	reads := append(testReads(parser, 10, 0, 0), testReads(parser, 5, 1, 1)...)
+	timings := &timing.StageTimes{}
+	timer := timings.NewTimer()
+	for _, read := range reads {
+		parser.parse(input.Read{Sequence: read}, timer)
+	}
+	timings.Add(timer)
+	want := map[timing.Stage]int{timing.Match: 15, timing.FixConstant: 5, timing.FixSequence: 10}
+	for stage, calls := range want {
+		if got := timings.Calls(stage); got != calls {
+			t.Errorf("%v calls = %v, want %v", stage, got, calls)
+		}
+	}
+}
+
+// TestParseSequencesCancel checks that the parsing threads drain the reads without counting them once ctx is done
+func TestParseSequencesCancel(t *testing.T) {
+	parser := testParser(t, input.AnchorMatcherName)
+	reads := testReads(parser, 20, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	var seqErrors results.ParseErrors
+	counts := results.NewCount(parser.sampleBarcodes.Barcodes)
+	sequences := make(chan input.Read, len(reads))
+	for _, read := range reads {
+		sequences <- input.Read{Sequence: read}
+	}
+	close(sequences)
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go ParseSequences(ctx, sequences, &wg, counts, parser, &seqErrors, nil)
+	}
+	wg.Wait()
+	if len(sequences) != 0 || seqErrors.Summary().Reads() != 0 {
+		t.Errorf("%v reads left and %v reads counted after ctx was done, want 0 and 0", len(sequences), seqErrors.Summary().Reads())
+	}
+}
+
+func TestFixConstant(t *testing.T) {
+	const format = "ACGTNNNNTTGG"
+	tests := []struct {
+		name                 string
+		sequence             string
+		maxErrors            int
+		minOffset, maxOffset int
+		want                 string
+		wantOffset           int
+	}{
+		{"same length as the format", "ACGAGGCCTTGG", 1, 0, math.MaxInt, "ACGTGGCCTTGG", 0},
+		{"last offset", "TTTACGAGGCCTTGG", 1, 0, math.MaxInt, "ACGTGGCCTTGG", 3},
+		{"first offset", "ACGAGGCCTTGGTTT", 1, 0, math.MaxInt, "ACGTGGCCTTGG", 0},
+		{"too many errors", "ACCAGGCCTTGG", 1, 0, math.MaxInt, "", -1},
+		{"tied offsets", "ACGAGGCCTTGGACGAGGCCTTGG", 1, 0, math.MaxInt, "", -1},
+		{"tie outside of the offset range", "ACGAGGCCTTGGACGAGGCCTTGG", 1, 10, 14, "ACGTGGCCTTGG", 12},
+		{"outside of the offset range", "TTTACGAGGCCTTGG", 1, 0, 2, "", -1},
+		{"shorter than the format", "ACGAGGCCTTG", 1, 0, math.MaxInt, "", -1},
+		{"N within the read matches", "ACGNGGCCTTGG", 0, 0, math.MaxInt, "ACGTGGCCTTGG", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, offset := fixConstant(test.sequence, format, test.maxErrors, test.minOffset, test.maxOffset)
+			if got != test.want || offset != test.wantOffset {
+				t.Errorf("fixConstant(%v) = %v, %v, want %v, %v", test.sequence, got, offset, test.want, test.wantOffset)
+			}
+		})
+	}
+}
+
+func TestParseRepairOffset(t *testing.T) {
+	parser := testParser(t, input.AnchorMatcherName)
+	read := testReads(parser, 1, 1, 0)[0]
+	if match := parser.Parse(read); !match.Repaired || match.RepairOffset != testFlank || match.Stage != Matched {
+		t.Errorf("Parse(%v) = %+v, want repaired at offset %v", read, match, testFlank)
+	}
+	parser.LimitConstantOffsets(0, testFlank-1)
+	if match := parser.Parse(read); match.Stage != ConstantStage {
+		t.Errorf("Parse(%v) stage = %v with the repair limited to offsets before %v, want %v", read, match.Stage, testFlank, ConstantStage)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	format, err := input.ParseSequenceFormat(strings.NewReader("AGCTAGCTTTGACAGT{8}CCTGA{8}GGACTTTTTGCA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := format.AddBarcodeTags(input.BarcodeTags{Sample: "BC", Random: "RX"}); err != nil {
+		t.Fatal(err)
+	}
+	sampleBarcodes, err := input.ReadSampleBarcodes(strings.NewReader(testSamples), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format.SampleSize = len(sampleBarcodes.Barcodes[0])
+	countedBarcodes, err := input.ReadCountedBarcodes(strings.NewReader(testCounted), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := NewParser(format, sampleBarcodes, countedBarcodes, results.NewMaxErrors(-1, -1, -1, format), input.NewAnchorMatcher(format))
+	sequence := testReads(parser, 1, 0, 0)[0]
+	tests := []struct {
+		name       string
+		sample     string
+		random     string
+		want       Stage
+		wantSample string
+	}{
+		{"sample tag", "CCCCCC", "ACGTACGT", Matched, "CCCCCC"},
+		{"sample tag fixed", "CCCACC", "ACGTACGT", Matched, "CCCCCC"},
+		{"missing sample tag", "", "ACGTACGT", SampleStage, ""},
+		{"sample tag of the wrong size", "CCCCCCCC", "ACGTACGT", SampleStage, ""},
+		{"missing random tag", "GGGGGG", "", RandomStage, "GGGGGG"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := parser.parse(input.Read{Sequence: sequence, SampleBarcode: test.sample, RandomBarcode: test.random}, nil)
+			if match.Stage != test.want || match.SampleBarcode != test.wantSample {
+				t.Errorf("parse() = %+v, want stage %v with sample barcode %v", match, test.want, test.wantSample)
+			}
+			if match.Stage == Matched && match.RandomBarcode != test.random {
+				t.Errorf("random barcode = %v, want %v", match.RandomBarcode, test.random)
+			}
+		})
+	}
+}
+
+// reportReadsPerSecond adds the reads per second of the benchmark to its output
+func reportReadsPerSecond(b *testing.B, start time.Time, reads int) {
+	b.ReportMetric(float64(reads)/time.Since(start).Seconds(), "reads/s")
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarks := []struct {
+		name                          string
+		constantErrors, barcodeErrors int
+	}{
+		{"perfect", 0, 0},
+		{"constant_errors", 1, 0},
+		{"barcode_errors", 0, 1},
+	}
+	for _, matcherName := range []string{input.AnchorMatcherName, input.RegexMatcherName} {
+		parser := testParser(b, matcherName)
+		for _, benchmark := range benchmarks {
+			b.Run(matcherName+"/"+benchmark.name, func(b *testing.B) {
+				reads := testReads(parser, 1000, benchmark.constantErrors, benchmark.barcodeErrors)
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					parser.Parse(reads[i%len(reads)])
+				}
+				reportReadsPerSecond(b, start, b.N)
+			})
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, matcherName := range []string{input.AnchorMatcherName, input.RegexMatcherName} {
+		b.Run(matcherName, func(b *testing.B) {
+			parser := testParser(b, matcherName)
+			reads := testReads(parser, 1000, 0, 0)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				parser.matcher.Find(reads[i%len(reads)])
+			}
+			reportReadsPerSecond(b, start, b.N)
+		})
+	}
+}
+
+func BenchmarkFixConstant(b *testing.B) {
+	parser := testParser(b, input.AnchorMatcherName)
+	reads := testReads(parser, 1000, 1, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		fixConstant(reads[i%len(reads)], parser.format.FormatString, parser.maxErrors.Constant, 0, math.MaxInt)
+	}
+	reportReadsPerSecond(b, start, b.N)
+}
+
+func BenchmarkFixSequence(b *testing.B) {
+	parser := testParser(b, input.AnchorMatcherName)
+	barcodes := parser.countedBarcodesStruct.Barcodes[0]
+	queries := make([]string, len(barcodes))
+	for i, barcode := range barcodes {
+		queries[i] = "N" + barcode[1:]
+	}
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		fixSequence(queries[i%len(queries)], barcodes, parser.maxErrors.Counted)
+	}
+	reportReadsPerSecond(b, start, b.N)
+}
+
+// BenchmarkParseSequences runs the parsing threads and counts in the same way as the count subcommand, without reading
+// the fastq file
+func BenchmarkParseSequences(b *testing.B) {
+	parser := testParser(b, input.AnchorMatcherName)
+	reads := testReads(parser, 1000, 0, 0)
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	var seqErrors results.ParseErrors
+	counts := results.NewCount(parser.sampleBarcodes.Barcodes)
+	sequences := make(chan input.Read)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go ParseSequences(context.Background(), sequences, &wg, counts, parser, &seqErrors, nil)
+	}
+	for i := 0; i < b.N; i++ {
+		sequences <- input.Read{Sequence: reads[i%len(reads)]}
+	}
+	close(sequences)
+	wg.Wait()
+	reportReadsPerSecond(b, start, b.N)
+}
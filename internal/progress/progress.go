@@ -0,0 +1,274 @@
+// Package progress reports the progress of a count while the reads are counted: the reads per second, the percent of the
+// reads file read, the time left, and the running pass rate of each ParseErrors category
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+// Mode names
+const (
+	// AutoMode is TTYMode when stderr is a terminal, and QuietMode otherwise
+	AutoMode = "auto"
+	// TTYMode rewrites a single progress line
+	TTYMode = "tty"
+	// JSONMode writes a JSON object per line, for workflow managers
+	JSONMode = "json"
+	// QuietMode does not report progress
+	QuietMode = "quiet"
+)
+
+// Modes are the progress modes in the order listed within the help
+var Modes = []string{AutoMode, TTYMode, JSONMode, QuietMode}
+
+// ResolveMode returns the mode used for mode.  AutoMode, which includes an empty mode, is TTYMode when out is a terminal and
+// QuietMode otherwise, so that progress lines are not written to log files
+func ResolveMode(mode string, out *os.File) string {
+	if mode != AutoMode && mode != "" {
+		return mode
+	}
+	if info, err := out.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return TTYMode
+	}
+	return QuietMode
+}
+
+// PassRates holds the fraction of the parsed reads within each ParseErrors category
+type PassRates struct {
+	Correct   float64 `json:"correct"`
+	Constant  float64 `json:"constant_error"`
+	Sample    float64 `json:"sample_error"`
+	Random    float64 `json:"random_error"`
+	Counted   float64 `json:"counted_error"`
+	Duplicate float64 `json:"duplicate"`
+}
+
+// newPassRates returns the pass rates of the parse errors summary
+func newPassRates(summary results.ErrorSummary) PassRates {
+	parsed := float64(summary.Reads())
+	if parsed == 0 {
+		return PassRates{}
+	}
+	return PassRates{
+		Correct:   float64(summary.Correct) / parsed,
+		Constant:  float64(summary.Constant) / parsed,
+		Sample:    float64(summary.Sample) / parsed,
+		Random:    float64(summary.Random) / parsed,
+		Counted:   float64(summary.Counted) / parsed,
+		Duplicate: float64(summary.Duplicate) / parsed,
+	}
+}
+
+// Event is a single progress report.  The percent and time left are only known when the size of the reads file is known, which
+// is not the case for stdin
+type Event struct {
+	// Event is "progress" while reading, and "done" once every read is counted
+	Event          string    `json:"event"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Reads          int       `json:"reads"`
+	ReadsPerSecond float64   `json:"reads_per_second"`
+	BytesRead      int64     `json:"bytes_read"`
+	BytesTotal     int64     `json:"bytes_total,omitempty"`
+	Percent        *float64  `json:"percent,omitempty"`
+	ETASeconds     *float64  `json:"eta_seconds,omitempty"`
+	Parsed         int       `json:"parsed"`
+	PassRates      PassRates `json:"pass_rates"`
+}
+
+// Reporter reports the progress of a count every interval until Stop is called
+type Reporter struct {
+	mode       string
+	out        io.Writer
+	interval   time.Duration
+	bytesTotal int64
+	seqErrors  *results.ParseErrors
+	start      time.Time
+	// reads and bytesRead are updated by the reader goroutine with Update
+	reads     int64
+	bytesRead int64
+	// lastReads and lastTime are the reads and time of the last report, used for the current reads per second
+	lastReads int
+	lastTime  time.Time
+	stop      chan struct{}
+	done      sync.WaitGroup
+	// newTicker returns the channel of the report times and the function which stops it.  It is replaced within tests so
+	// that the reports do not depend on the clock
+	newTicker func(interval time.Duration) (<-chan time.Time, func())
+	// mu is held while writing to out, so that the log messages written to the same terminal in TTYMode do not interleave
+	// with the progress line.  logWriter is the writer of the logger replaced while reporting, or nil
+	mu        sync.Mutex
+	logWriter io.Writer
+}
+
+// ttyLogWriter writes the log messages to the terminal of the progress line.  The progress line is cleared first, so that a
+// message does not start after it, and is written again at the next report
+type ttyLogWriter struct {
+	reporter *Reporter
+}
+
+// Write clears the progress line then writes the log message
+func (w ttyLogWriter) Write(p []byte) (int, error) {
+	w.reporter.mu.Lock()
+	defer w.reporter.mu.Unlock()
+	io.WriteString(w.reporter.out, "\r\x1b[K")
+	return w.reporter.out.Write(p)
+}
+
+// newTicker returns a time.Ticker channel of interval along with its Stop function
+func newTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// NewReporter creates a Reporter which writes to out in mode, which is TTYMode, JSONMode or QuietMode.  bytesTotal is the
+// size of the reads file, or 0 when it is not known.  The pass rates are taken from seqErrors.  An interval which is not
+// positive reports every second
+func NewReporter(mode string, out io.Writer, interval time.Duration, bytesTotal int64, seqErrors *results.ParseErrors) *Reporter {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Reporter{mode: mode, out: out, interval: interval, bytesTotal: bytesTotal, seqErrors: seqErrors, stop: make(chan struct{}),
+		newTicker: newTicker}
+}
+
+// Update sets the reads and the bytes of the reads file read so far.  It is used as the input.ReadOptions Progress function
+func (r *Reporter) Update(totalReads int, bytesRead int64) {
+	atomic.StoreInt64(&r.reads, int64(totalReads))
+	atomic.StoreInt64(&r.bytesRead, bytesRead)
+}
+
+// Start starts reporting every interval within its own goroutine.  In TTYMode, the log messages written to the same terminal
+// clear the progress line first until Stop is called
+func (r *Reporter) Start() {
+	r.start = time.Now()
+	r.lastTime = r.start
+	if r.mode == QuietMode {
+		return
+	}
+	if logger := logging.Default(); r.mode == TTYMode && logger.Writer() == r.out {
+		r.logWriter = r.out
+		logger.SetWriter(ttyLogWriter{reporter: r})
+	}
+	ticks, stopTicks := r.newTicker(r.interval)
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		defer stopTicks()
+		for {
+			select {
+			case <-ticks:
+				r.write(r.event("progress", time.Now()))
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reporting and writes the final report, once every read is counted
+func (r *Reporter) Stop() {
+	if r.mode == QuietMode {
+		return
+	}
+	close(r.stop)
+	r.done.Wait()
+	r.write(r.event("done", time.Now()))
+	if r.mode == TTYMode {
+		r.mu.Lock()
+		fmt.Fprintln(r.out)
+		r.mu.Unlock()
+	}
+	if r.logWriter != nil {
+		logging.Default().SetWriter(r.logWriter)
+		r.logWriter = nil
+	}
+}
+
+// event returns the progress at now.  The reads per second are since the last report while reading, and over the whole
+// count once done
+func (r *Reporter) event(name string, now time.Time) Event {
+	reads := int(atomic.LoadInt64(&r.reads))
+	bytesRead := atomic.LoadInt64(&r.bytesRead)
+	summary := r.seqErrors.Summary()
+	elapsed := now.Sub(r.start).Seconds()
+	event := Event{
+		Event:          name,
+		ElapsedSeconds: elapsed,
+		Reads:          reads,
+		BytesRead:      bytesRead,
+		BytesTotal:     r.bytesTotal,
+		Parsed:         summary.Reads(),
+		PassRates:      newPassRates(summary),
+	}
+	if name == "done" {
+		if elapsed > 0 {
+			event.ReadsPerSecond = float64(reads) / elapsed
+		}
+	} else if seconds := now.Sub(r.lastTime).Seconds(); seconds > 0 {
+		event.ReadsPerSecond = float64(reads-r.lastReads) / seconds
+	}
+	r.lastReads, r.lastTime = reads, now
+	if r.bytesTotal > 0 {
+		percent := 100 * float64(bytesRead) / float64(r.bytesTotal)
+		if percent > 100 {
+			percent = 100
+		}
+		event.Percent = &percent
+		// the time left assumes the rest of the file is read at the average rate so far
+		if bytesRead > 0 {
+			eta := elapsed * float64(r.bytesTotal-bytesRead) / float64(bytesRead)
+			if eta < 0 || name == "done" {
+				eta = 0
+			}
+			event.ETASeconds = &eta
+		}
+	}
+	return event
+}
+
+// write writes the event in the reporter mode
+func (r *Reporter) write(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.mode {
+	case JSONMode:
+		line, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(r.out, "%s\n", line)
+	case TTYMode:
+		// \x1b[K clears the rest of the last progress line
+		fmt.Fprintf(r.out, "\r%v\x1b[K", event.line())
+	}
+}
+
+// line returns the event as a single line of text for TTYMode
+func (e Event) line() string {
+	line := fmt.Sprintf("Reads: %v  %.0f reads/s", e.Reads, e.ReadsPerSecond)
+	if e.Percent != nil {
+		line += fmt.Sprintf("  %.1f%%", *e.Percent)
+	}
+	if e.ETASeconds != nil && e.Event != "done" {
+		line += "  ETA " + (time.Duration(*e.ETASeconds) * time.Second).String()
+	} else if e.Event == "done" {
+		line += "  " + (time.Duration(e.ElapsedSeconds) * time.Second).String()
+	}
+	rates := e.PassRates
+	line += fmt.Sprintf("  correct %.1f%%  constant %.1f%%  sample %.1f%%", 100*rates.Correct, 100*rates.Constant, 100*rates.Sample)
+	// random barcode tag errors only happen with --random-tag
+	if rates.Random != 0 {
+		line += fmt.Sprintf("  random %.1f%%", 100*rates.Random)
+	}
+	line += fmt.Sprintf("  counted %.1f%%  duplicate %.1f%%", 100*rates.Counted, 100*rates.Duplicate)
+	return line
+}
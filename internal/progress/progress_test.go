@@ -0,0 +1,136 @@
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+func TestEvent(t *testing.T) {
+	var seqErrors results.ParseErrors
+	for i := 0; i < 3; i++ {
+		seqErrors.AddCorrect()
+	}
+	seqErrors.AddConstantError()
+	tests := []struct {
+		name       string
+		bytesTotal int64
+		event      string
+		// wantPercent and wantETA are -1 when they are not known
+		wantPercent float64
+		wantETA     float64
+		wantRate    float64
+	}{
+		{"quarter of the file", 4000, "progress", 25, 30, 100},
+		{"stdin", 0, "progress", -1, -1, 100},
+		{"done", 1000, "done", 100, 0, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reporter := NewReporter(JSONMode, &bytes.Buffer{}, time.Second, test.bytesTotal, &seqErrors)
+			reporter.start = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+			reporter.lastTime = reporter.start
+			reporter.Update(1000, 1000)
+			event := reporter.event(test.event, reporter.start.Add(10*time.Second))
+			if event.Event != test.event || event.Reads != 1000 || event.ReadsPerSecond != test.wantRate || event.Parsed != 4 {
+				t.Errorf("event = %+v, want %v reads at %v reads/s with 4 parsed", event, 1000, test.wantRate)
+			}
+			if (event.Percent == nil) != (test.wantPercent == -1) || (event.Percent != nil && *event.Percent != test.wantPercent) {
+				t.Errorf("percent = %v, want %v", event.Percent, test.wantPercent)
+			}
+			if (event.ETASeconds == nil) != (test.wantETA == -1) || (event.ETASeconds != nil && *event.ETASeconds != test.wantETA) {
+				t.Errorf("ETA = %v, want %v", event.ETASeconds, test.wantETA)
+			}
+			if want := (PassRates{Correct: 0.75, Constant: 0.25}); event.PassRates != want {
+				t.Errorf("pass rates = %+v, want %+v", event.PassRates, want)
+			}
+		})
+	}
+}
+
+func TestReporterModes(t *testing.T) {
+	for _, mode := range []string{TTYMode, JSONMode, QuietMode} {
+		t.Run(mode, func(t *testing.T) {
+			var seqErrors results.ParseErrors
+			var out bytes.Buffer
+			reporter := NewReporter(mode, &out, time.Second, 100, &seqErrors)
+			// the reports are driven by ticks sent from the test.  A send returns once the report goroutine takes the tick,
+			// and the report is written before the next tick or Stop is taken
+			ticks := make(chan time.Time)
+			reporter.newTicker = func(time.Duration) (<-chan time.Time, func()) { return ticks, func() {} }
+			reporter.Start()
+			reporter.Update(10000, 50)
+			if mode != QuietMode {
+				ticks <- time.Now()
+				ticks <- time.Now()
+			}
+			seqErrors.AddCorrect()
+			reporter.Update(20000, 100)
+			reporter.Stop()
+			switch mode {
+			case QuietMode:
+				if out.Len() != 0 {
+					t.Errorf("quiet output = %q, want none", out.String())
+				}
+			case TTYMode:
+				if !strings.HasPrefix(out.String(), "\rReads: ") || !strings.HasSuffix(out.String(), "\n") || strings.Count(out.String(), "\n") != 1 {
+					t.Errorf("tty output = %q, want progress lines which rewrite a single line", out.String())
+				}
+				if last := out.String()[strings.LastIndex(out.String(), "\r"):]; !strings.Contains(last, "Reads: 20000") || !strings.Contains(last, "100.0%") {
+					t.Errorf("last tty line = %q, want 20000 reads at 100%%", last)
+				}
+			case JSONMode:
+				var events []Event
+				scanner := bufio.NewScanner(&out)
+				for scanner.Scan() {
+					var event Event
+					if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+						t.Fatalf("line %q: %v", scanner.Text(), err)
+					}
+					events = append(events, event)
+				}
+				if len(events) != 3 || events[0].Event != "progress" || events[0].Reads != 10000 {
+					t.Fatalf("events = %+v, want progress events then done", events)
+				}
+				last := events[len(events)-1]
+				if last.Event != "done" || last.Reads != 20000 || *last.Percent != 100 || last.PassRates.Correct != 1 {
+					t.Errorf("last event = %+v, want done with 20000 reads", last)
+				}
+			}
+		})
+	}
+}
+
+// TestReporterLogs checks that a log message written to the terminal of a TTYMode progress line clears the line first, and
+// that the logger is restored once the reporter stops
+func TestReporterLogs(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := logging.Default()
+	defer logging.SetDefault(defaultLogger)
+	logger := logging.New(&out, logging.InfoLevel, logging.TextFormat)
+	logging.SetDefault(logger)
+
+	var seqErrors results.ParseErrors
+	reporter := NewReporter(TTYMode, &out, time.Second, 100, &seqErrors)
+	ticks := make(chan time.Time)
+	reporter.newTicker = func(time.Duration) (<-chan time.Time, func()) { return ticks, func() {} }
+	reporter.Start()
+	reporter.Update(10000, 50)
+	ticks <- time.Now()
+	// the second tick waits for the first report to be written
+	ticks <- time.Now()
+	logging.Warn("Skipped malformed FASTQ record")
+	reporter.Stop()
+	if !strings.Contains(out.String(), "\x1b[K\r\x1b[K") || !strings.Contains(out.String(), "\r\x1b[K20") {
+		t.Errorf("tty output = %q, want the progress line cleared before the log message", out.String())
+	}
+	if logger.Writer() != &out {
+		t.Error("logger writer not restored once the reporter stopped")
+	}
+}
@@ -0,0 +1,127 @@
+package results
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+// WriteCrispr writes the MAGeCK compatible guide count table, the gene level summed counts, and a per sample QC file.
+// Every guide within the library is included, even when it was not observed
+func (c *Counts) WriteCrispr(outpath string, library input.CrisprLibrary, sampleBarcodes input.SampleBarcodes) error {
+	sampleIds, sampleBarcodesSorted := sortSamples(sampleBarcodes)
+	today := time.Now().Local().Format("2006-01-02")
+	fmt.Println("-WRITING CRISPR COUNTS-")
+
+	var guideOut, geneOut, qcOut strings.Builder
+	guideOut.WriteString("sgRNA\tGene\t" + strings.Join(sampleIds, "\t"))
+	geneOut.WriteString("Gene\t" + strings.Join(sampleIds, "\t"))
+	qcOut.WriteString("Sample,Guides,Zero_Count_Guides,Gini_Index,Mapped_Reads,Unmapped_Reads,Mapped_Fraction")
+
+	// spilledCounts holds the merged counts of each guide when the counts were spilled to disk, in the same order as the sorted
+	// sample barcodes
+	var spilledCounts map[string][]int
+	if c.spilled() {
+		var err error
+		if spilledCounts, err = c.spilledGuides(library, sampleBarcodesSorted); err != nil {
+			return err
+		}
+	}
+
+	// guideCounts holds the counts of every guide for each sample, in library order, for the QC stats
+	guideCounts := make([][]int, len(sampleBarcodesSorted))
+	geneCounts := make(map[string][]int)
+	for _, guide := range library.Guides {
+		gene := library.Genes[guide]
+		if _, ok := geneCounts[gene]; !ok {
+			geneCounts[gene] = make([]int, len(sampleBarcodesSorted))
+		}
+		guideOut.WriteString("\n" + library.GuideIds[guide] + "\t" + gene)
+		for i, sampleBarcode := range sampleBarcodesSorted {
+			var count int
+			if spilledCounts == nil {
+				count = c.SampleCount(sampleBarcode, guide)
+			} else if counts, ok := spilledCounts[guide]; ok {
+				count = counts[i]
+			}
+			guideCounts[i] = append(guideCounts[i], count)
+			geneCounts[gene][i] += count
+			guideOut.WriteString("\t" + strconv.Itoa(count))
+		}
+	}
+	for _, gene := range library.GeneOrder {
+		geneOut.WriteString("\n" + gene)
+		for _, count := range geneCounts[gene] {
+			geneOut.WriteString("\t" + strconv.Itoa(count))
+		}
+	}
+
+	for i, sampleBarcode := range sampleBarcodesSorted {
+		var zeroGuides int
+		for _, count := range guideCounts[i] {
+			if count == 0 {
+				zeroGuides++
+			}
+		}
+		// the guide counts are unique random barcodes when a random barcode is used, so the mapped reads are counted before
+		// the duplicates are removed to be in the same unit as the unmapped reads
+		mapped, unmapped := c.mapped[sampleBarcode], c.unmapped[sampleBarcode]
+		var mappedFraction float64
+		if mapped+unmapped != 0 {
+			mappedFraction = float64(mapped) / float64(mapped+unmapped)
+		}
+		gini := giniIndex(guideCounts[i])
+		fmt.Printf("%v\nZero count guides: %v/%v\nGini index: %.4f\nMapped fraction: %.4f\n\n", sampleIds[i], zeroGuides, len(library.Guides), gini, mappedFraction)
+		qcOut.WriteString(fmt.Sprintf("\n%v,%v,%v,%.6f,%v,%v,%.6f", sampleIds[i], len(library.Guides), zeroGuides, gini, mapped, unmapped, mappedFraction))
+	}
+
+	if err := writeFile(outpath+today+"_counts.mageck.txt", guideOut.String()); err != nil {
+		return err
+	}
+	if err := writeFile(outpath+today+"_gene_counts.mageck.txt", geneOut.String()); err != nil {
+		return err
+	}
+	return writeFile(outpath+today+"_crispr_qc.csv", qcOut.String())
+}
+
+// spilledGuides merges the count runs and returns the counts of the library guides for each sample in the same order as
+// sampleBarcodesSorted.  Only the guides are held, so the memory is limited to the size of the library
+func (c *Counts) spilledGuides(library input.CrisprLibrary, sampleBarcodesSorted []string) (map[string][]int, error) {
+	spilledCounts := make(map[string][]int)
+	_, err := c.mergeRuns(func(countedBarcodes string, counts map[string]spillCount) error {
+		if _, ok := library.Genes[countedBarcodes]; !ok {
+			return nil
+		}
+		guideCounts := make([]int, len(sampleBarcodesSorted))
+		for i, sampleBarcode := range sampleBarcodesSorted {
+			guideCounts[i] = c.spill.sampleCount(sampleBarcode, counts[sampleBarcode])
+		}
+		spilledCounts[countedBarcodes] = guideCounts
+		return nil
+	})
+	return spilledCounts, err
+}
+
+// giniIndex returns the Gini index of the counts.  0 is a perfectly even distribution of counts across guides, and values
+// approaching 1 mean the counts are dominated by few guides
+func giniIndex(counts []int) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	sorted := append([]int(nil), counts...)
+	sort.Ints(sorted)
+	var total, weighted float64
+	for i, count := range sorted {
+		total += float64(count)
+		weighted += float64(i+1) * float64(count)
+	}
+	if total == 0 {
+		return 0
+	}
+	n := float64(len(sorted))
+	return 2*weighted/(n*total) - (n+1)/n
+}
@@ -0,0 +1,68 @@
+package results
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+func TestGiniIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"all zero", []int{0, 0, 0}, 0},
+		{"even", []int{5, 5, 5, 5}, 0},
+		{"single guide", []int{0, 0, 0, 12}, 0.75},
+		{"uneven", []int{1, 2, 3, 4}, 0.25},
+	}
+	for _, test := range tests {
+		if got := giniIndex(test.counts); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%v: giniIndex(%v) = %v, want %v", test.name, test.counts, got, test.want)
+		}
+	}
+}
+
+// TestWriteCrisprMappedFraction checks that the mapped fraction of a sample with random barcodes counts the mapped reads
+// before the duplicates are removed, in the same unit as the unmapped reads
+func TestWriteCrisprMappedFraction(t *testing.T) {
+	library := input.CrisprLibrary{
+		Guides:    []string{"AAAA", "CCCC"},
+		GuideIds:  map[string]string{"AAAA": "guide_1", "CCCC": "guide_2"},
+		Genes:     map[string]string{"AAAA": "gene_1", "CCCC": "gene_1"},
+		GeneOrder: []string{"gene_1"},
+		Included:  true,
+	}
+	sampleBarcodes := input.SampleBarcodes{Conversion: map[string]string{"GGGG": "sample_1"}, Barcodes: []string{"GGGG"}, Included: true}
+	counts := NewCount(sampleBarcodes.Barcodes)
+	// 6 mapped reads, 2 of which are duplicates, so the guide counts sum to 4 unique random barcodes
+	for _, random := range []string{"R1", "R2", "R3", "R1", "R1"} {
+		counts.AddCount("GGGG", "AAAA", random, true)
+	}
+	counts.AddCount("GGGG", "CCCC", "R1", true)
+	for i := 0; i < 2; i++ {
+		counts.AddUnmapped("GGGG", true)
+	}
+	outDir := t.TempDir() + string(os.PathSeparator)
+	if err := counts.WriteCrispr(outDir, library, sampleBarcodes); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(outDir, "*_crispr_qc.csv"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("crispr QC files = %v, %v, want 1", files, err)
+	}
+	contents, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Sample,Guides,Zero_Count_Guides,Gini_Index,Mapped_Reads,Unmapped_Reads,Mapped_Fraction\nsample_1,2,0,0.250000,6,2,0.750000"
+	if strings.TrimSpace(string(contents)) != want {
+		t.Errorf("crispr QC = %q, want %q", contents, want)
+	}
+}
@@ -0,0 +1,208 @@
+package results
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+)
+
+// enrichNames holds the file name used for each enrichment subset size.  Sizes not included are named '<size>Barcode'
+var enrichNames = map[int]string{1: "Single", 2: "Double", 3: "Triple", 4: "Quadruple"}
+
+// enrichName returns the name used within the enrichment file names for the subset size
+func enrichName(size int) string {
+	if name, ok := enrichNames[size]; ok {
+		return name
+	}
+	return strconv.Itoa(size) + "Barcode"
+}
+
+// combinations returns the indices of every subset of size k out of n barcodes in lexicographic order
+func combinations(n int, k int) [][]int {
+	var allCombinations [][]int
+	combination := make([]int, k)
+	var recurse func(start int, depth int)
+	recurse = func(start int, depth int) {
+		if depth == k {
+			allCombinations = append(allCombinations, append([]int(nil), combination...))
+			return
+		}
+		for i := start; i <= n-(k-depth); i++ {
+			combination[depth] = i
+			recurse(i+1, depth+1)
+		}
+	}
+	recurse(0, 0)
+	return allCombinations
+}
+
+// maxEnrichBarcodes is the most counted barcodes that an enrichment key can hold
+const maxEnrichBarcodes = 16
+
+// enrichKey identifies an enrichment row.  Each slot holds one more than the index of the counted barcode within
+// enrichBarcodes for that position, and 0 when the barcode is outside of the subset
+type enrichKey [maxEnrichBarcodes]int32
+
+// enrichIndex returns the slot value of the counted barcode at the position, adding the barcode if it is new
+func (c *Counts) enrichIndex(position int, barcode string) int32 {
+	if index, ok := c.enrichIndices[position][barcode]; ok {
+		return index
+	}
+	c.enrichBarcodes[position] = append(c.enrichBarcodes[position], barcode)
+	index := int32(len(c.enrichBarcodes[position]))
+	c.enrichIndices[position][barcode] = index
+	return index
+}
+
+// enrichRow creates the enrichment row for the key.  Barcodes outside of the subset are left empty so that the row keeps
+// one column per counted barcode
+func (c *Counts) enrichRow(key enrichKey) string {
+	var row strings.Builder
+	for i := 0; i < c.barcodeNum; i++ {
+		if i != 0 {
+			row.WriteByte(',')
+		}
+		if key[i] != 0 {
+			row.WriteString(c.enrichBarcodes[i][key[i]-1])
+		}
+	}
+	return row.String()
+}
+
+// setupEnrichment creates the enrichment maps and subset combinations for each requested subset size.  Subset sizes must be
+// at least 1 and less than the number of counted barcodes, otherwise they are skipped
+func (c *Counts) setupEnrichment(enrichSizes []int) {
+	c.enrichSizes = nil
+	c.enriched = make(map[int]map[string]map[enrichKey]int)
+	c.enrichCombinations = make(map[int][][]int)
+	c.enrichIndices = make([]map[string]int32, c.barcodeNum)
+	c.enrichBarcodes = make([][]string, c.barcodeNum)
+	for i := range c.enrichIndices {
+		c.enrichIndices[i] = make(map[string]int32)
+	}
+	if len(enrichSizes) != 0 && c.barcodeNum > maxEnrichBarcodes {
+		logging.Warn(fmt.Sprintf("Enrichment skipped.  At most %v counted barcodes are supported", maxEnrichBarcodes))
+		return
+	}
+	for _, size := range enrichSizes {
+		if _, ok := c.enriched[size]; ok {
+			continue
+		}
+		if size < 1 || size >= c.barcodeNum {
+			logging.Warn(fmt.Sprintf("Enrichment of %v barcodes skipped.  Must be between 1 and %v", size, c.barcodeNum-1))
+			continue
+		}
+		c.enrichSizes = append(c.enrichSizes, size)
+		c.enrichCombinations[size] = combinations(c.barcodeNum, size)
+		c.enriched[size] = make(map[string]map[enrichKey]int)
+		for sampleBarcode := range c.NoRandom {
+			c.enriched[size][sampleBarcode] = make(map[enrichKey]int)
+		}
+	}
+}
+
+// addEnrichment adds the count of the counted barcodes to every barcode subset of each enrichment size
+func (c *Counts) addEnrichment(sampleBarcode string, convertedBarcodes string, count int) {
+	var barcodes enrichKey
+	for i := 0; i < c.barcodeNum; i++ {
+		barcode := convertedBarcodes
+		if end := strings.IndexByte(convertedBarcodes, ','); end != -1 {
+			barcode, convertedBarcodes = convertedBarcodes[:end], convertedBarcodes[end+1:]
+		}
+		barcodes[i] = c.enrichIndex(i, barcode)
+	}
+	for _, size := range c.enrichSizes {
+		for _, combination := range c.enrichCombinations[size] {
+			var key enrichKey
+			for _, i := range combination {
+				key[i] = barcodes[i]
+			}
+			c.enriched[size][sampleBarcode][key] += count
+		}
+	}
+}
+
+// writeEnriched writes a file per sample for each enrichment size, and a merged file for each enrichment size if merge is called
+func (c *Counts) writeEnriched(outpath string, today string, headerStart string, sampleIds []string, sampleBarcodes input.SampleBarcodes) error {
+	sampleHeader := headerStart + "Count"
+	mergeHeader := headerStart + strings.Join(sampleIds, ",")
+	for _, size := range c.enrichSizes {
+		name := enrichName(size)
+		var sampleOut, mergeOut strings.Builder
+		// finished holds what enrichment rows have already been added to the merge file
+		finished := make(map[enrichKey]bool)
+		if c.merge {
+			mergeOut.WriteString(mergeHeader)
+		}
+		for _, sampleBarcode := range c.sampleBarcodesSorted {
+			sampleOut.WriteString(sampleHeader)
+			total := c.gatherEnriched(sampleBarcode, size, &sampleOut, &mergeOut, finished)
+
+			if total != 0 {
+				outFileName := outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts." + name + ".csv"
+				logging.Info("Writing enriched counts", "sample", sampleBarcodes.Conversion[sampleBarcode], "enrichment", strings.ToLower(name), "rows", total, "file", outFileName)
+				if err := writeFile(outFileName, sampleOut.String()); err != nil {
+					return err
+				}
+			}
+			sampleOut.Reset()
+		}
+		// If merge is called, write the merge file
+		if c.merge {
+			if err := writeFile(outpath+today+"_counts.all."+name+".csv", mergeOut.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gatherEnriched adds the enrichment rows of the subset size for the sample to sampleOut, and to mergeOut if merge is called.
+// Rows are sorted so that the output is the same between runs.  It returns the total number of different enrichment rows
+func (c *Counts) gatherEnriched(sampleBarcode string, size int, sampleOut *strings.Builder, mergeOut *strings.Builder, finished map[enrichKey]bool) int {
+	rows := make(map[string]enrichKey, len(c.enriched[size][sampleBarcode]))
+	enrichedSorted := make([]string, 0, len(c.enriched[size][sampleBarcode]))
+	for key := range c.enriched[size][sampleBarcode] {
+		row := c.enrichRow(key)
+		rows[row] = key
+		enrichedSorted = append(enrichedSorted, row)
+	}
+	sort.Strings(enrichedSorted)
+
+	total := 0
+	for _, enrichedBarcodes := range enrichedSorted {
+		key := rows[enrichedBarcodes]
+		count := c.enriched[size][sampleBarcode][key]
+		total++
+		sampleOut.WriteString("\n" + enrichedBarcodes + "," + strconv.Itoa(count))
+		if c.merge {
+			if _, ok := finished[key]; !ok {
+				mergeRow := "\n" + enrichedBarcodes
+				for _, sampleBarcode := range c.sampleBarcodesSorted {
+					mergeRow += "," + strconv.Itoa(c.enriched[size][sampleBarcode][key])
+				}
+				mergeOut.WriteString(mergeRow)
+				finished[key] = true
+			}
+		}
+	}
+	return total
+}
+
+// writeFile creates the file at fileName and writes contents
+func writeFile(fileName string, contents string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,239 @@
+package results
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+var update = flag.Bool("update", false, "update the golden files within testdata")
+
+func TestCombinations(t *testing.T) {
+	tests := []struct {
+		n, k int
+		want [][]int
+	}{
+		{1, 1, [][]int{{0}}},
+		{2, 1, [][]int{{0}, {1}}},
+		{3, 2, [][]int{{0, 1}, {0, 2}, {1, 2}}},
+		{4, 3, [][]int{{0, 1, 2}, {0, 1, 3}, {0, 2, 3}, {1, 2, 3}}},
+	}
+	for _, test := range tests {
+		got := combinations(test.n, test.k)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("combinations(%v, %v) = %v, want %v", test.n, test.k, got, test.want)
+		}
+	}
+}
+
+func TestEnrichRow(t *testing.T) {
+	counts := NewCount([]string{"AAAA"})
+	counts.barcodeNum = 4
+	counts.setupEnrichment(nil)
+	barcodes := []string{"a", "b", "c", "d"}
+	var all enrichKey
+	for i, barcode := range barcodes {
+		all[i] = counts.enrichIndex(i, barcode)
+	}
+	tests := []struct {
+		combination []int
+		want        string
+	}{
+		{[]int{0}, "a,,,"},
+		{[]int{3}, ",,,d"},
+		{[]int{1, 2}, ",b,c,"},
+		{[]int{0, 3}, "a,,,d"},
+		{[]int{0, 1, 3}, "a,b,,d"},
+	}
+	for _, test := range tests {
+		var key enrichKey
+		for _, i := range test.combination {
+			key[i] = all[i]
+		}
+		if got := counts.enrichRow(key); got != test.want {
+			t.Errorf("enrichRow(%v) = %q, want %q", test.combination, got, test.want)
+		}
+	}
+}
+
+// enrichedRows returns the enrichment counts of the subset size for the sample keyed by their rows
+func enrichedRows(counts *Counts, size int, sampleBarcode string) map[string]int {
+	rows := make(map[string]int)
+	for key, count := range counts.enriched[size][sampleBarcode] {
+		rows[counts.enrichRow(key)] = count
+	}
+	return rows
+}
+
+func TestAddEnrichment(t *testing.T) {
+	counts := NewCount([]string{"AAAA"})
+	counts.barcodeNum = 3
+	counts.setupEnrichment([]int{1, 2, 3})
+	if !reflect.DeepEqual(counts.enrichSizes, []int{1, 2}) {
+		t.Fatalf("enrichSizes = %v, want [1 2]", counts.enrichSizes)
+	}
+	counts.addEnrichment("AAAA", "a,b,c", 2)
+	counts.addEnrichment("AAAA", "a,x,c", 3)
+
+	wantSingle := map[string]int{"a,,": 5, ",b,": 2, ",x,": 3, ",,c": 5}
+	if got := enrichedRows(counts, 1, "AAAA"); !reflect.DeepEqual(got, wantSingle) {
+		t.Errorf("single enrichment = %v, want %v", got, wantSingle)
+	}
+	wantDouble := map[string]int{"a,b,": 2, "a,x,": 3, "a,,c": 5, ",b,c": 2, ",x,c": 3}
+	if got := enrichedRows(counts, 2, "AAAA"); !reflect.DeepEqual(got, wantDouble) {
+		t.Errorf("double enrichment = %v, want %v", got, wantDouble)
+	}
+}
+
+// testBarcodes creates the counted barcodes for a format with barcodeNum counted barcodes, each with two possible barcodes
+func testBarcodes(barcodeNum int) input.CountedBarcodes {
+	dna := []string{"ACGT", "TGCA"}
+	countedBarcodes := input.CountedBarcodes{NumBarcodes: barcodeNum, Included: true}
+	for i := 0; i < barcodeNum; i++ {
+		conversion := make(map[string]string)
+		for j, barcode := range dna {
+			conversion[barcode] = fmt.Sprintf("bb%v_%v", i+1, j+1)
+		}
+		countedBarcodes.Conversion = append(countedBarcodes.Conversion, conversion)
+		countedBarcodes.Barcodes = append(countedBarcodes.Barcodes, dna)
+	}
+	return countedBarcodes
+}
+
+// testCounts fills the counts for two samples.  The second sample uses random barcodes so that both NoRandom and
+// Random counts are enriched
+func testCounts(countedBarcodes input.CountedBarcodes) *Counts {
+	counts := NewCount([]string{"AAAA", "CCCC"})
+	members := enumerateTest(countedBarcodes.Barcodes)
+	for i, member := range members {
+		for j := 0; j <= i; j++ {
+			counts.AddCount("AAAA", member, "", true)
+		}
+		for j := 0; j < len(members)-i; j++ {
+			counts.AddCount("CCCC", member, fmt.Sprintf("R%v", j), true)
+		}
+		// duplicates are not counted
+		counts.AddCount("CCCC", member, "R0", true)
+	}
+	return counts
+}
+
+// enumerateTest returns every combination of the counted barcodes in order
+func enumerateTest(barcodes [][]string) []string {
+	members := []string{""}
+	for i, position := range barcodes {
+		var next []string
+		for _, member := range members {
+			for _, barcode := range position {
+				if i == 0 {
+					next = append(next, barcode)
+				} else {
+					next = append(next, member+","+barcode)
+				}
+			}
+		}
+		members = next
+	}
+	return members
+}
+
+// enrichedFiles returns the enrichment files written to outDir.  The key is the file name without the date prefix
+func enrichedFiles(t *testing.T, outDir string) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(outDir, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrichFiles := make(map[string]string)
+	for _, file := range files {
+		base := filepath.Base(file)
+		parts := strings.Split(base, ".")
+		if len(parts) < 3 {
+			continue
+		}
+		for _, enrichName := range enrichNames {
+			if parts[len(parts)-2] == enrichName {
+				enrichFiles[base[strings.Index(base, "_")+1:]] = file
+			}
+		}
+	}
+	return enrichFiles
+}
+
+func TestWriteCsvEnrichGolden(t *testing.T) {
+	sampleBarcodes := input.SampleBarcodes{
+		Conversion: map[string]string{"AAAA": "sample_1", "CCCC": "sample_2"},
+		Barcodes:   []string{"AAAA", "CCCC"},
+		Included:   true,
+	}
+	tests := []struct {
+		name        string
+		barcodeNum  int
+		enrichSizes []int
+		wantFiles   []string
+	}{
+		{"one_barcode", 1, []int{1, 2}, nil},
+		{"two_barcodes", 2, []int{1, 2}, []string{"sample_1_counts.Single.csv", "sample_2_counts.Single.csv", "counts.all.Single.csv"}},
+		{"three_barcodes", 3, []int{1, 2}, []string{
+			"sample_1_counts.Single.csv", "sample_2_counts.Single.csv", "counts.all.Single.csv",
+			"sample_1_counts.Double.csv", "sample_2_counts.Double.csv", "counts.all.Double.csv",
+		}},
+		{"four_barcodes", 4, []int{1, 2, 3}, []string{
+			"sample_1_counts.Single.csv", "sample_2_counts.Single.csv", "counts.all.Single.csv",
+			"sample_1_counts.Double.csv", "sample_2_counts.Double.csv", "counts.all.Double.csv",
+			"sample_1_counts.Triple.csv", "sample_2_counts.Triple.csv", "counts.all.Triple.csv",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			countedBarcodes := testBarcodes(test.barcodeNum)
+			counts := testCounts(countedBarcodes)
+			outDir := t.TempDir() + string(os.PathSeparator)
+			if err := counts.WriteCsv(context.Background(), outDir, true, test.enrichSizes, countedBarcodes, sampleBarcodes); err != nil {
+				t.Fatal(err)
+			}
+
+			enrichFiles := enrichedFiles(t, outDir)
+			var gotFiles []string
+			for name := range enrichFiles {
+				gotFiles = append(gotFiles, name)
+			}
+			sort.Strings(gotFiles)
+			sort.Strings(test.wantFiles)
+			if !reflect.DeepEqual(gotFiles, test.wantFiles) {
+				t.Fatalf("enrichment files = %v, want %v", gotFiles, test.wantFiles)
+			}
+
+			for name, enrichFile := range enrichFiles {
+				got, err := os.ReadFile(enrichFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				goldenPath := filepath.Join("testdata", "enrich", test.name, name)
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(goldenPath), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(goldenPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%v does not match golden file\ngot:\n%s\nwant:\n%s", name, got, want)
+				}
+			}
+		})
+	}
+}
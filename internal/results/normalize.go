@@ -0,0 +1,139 @@
+package results
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+// pseudocount is added to each count before calculating fold enrichment so that zero counts do not cause a division by zero
+const pseudocount = 0.5
+
+// zCritical is the two sided 95% critical value of the standard normal distribution used for the fold enrichment bounds
+const zCritical = 1.959964
+
+// normalization holds the information needed to add normalized counts and enrichment statistics to the merge output
+type normalization struct {
+	included bool
+	// controlIndex is the index of the control sample within the sorted sample barcodes
+	controlIndex int
+	// librarySizes is the total count of each sample, in the same order as the sorted sample barcodes
+	librarySizes []int
+	// meanLibrarySize is used to scale each sample to the same library size
+	meanLibrarySize float64
+}
+
+// setupNormalization finds the control sample and calculates the library size of each sample
+func (c *Counts) setupNormalization(sampleBarcodes input.SampleBarcodes) error {
+	c.normalization = normalization{included: true, controlIndex: -1}
+	var totalSize int
+	for i, sampleBarcode := range c.sampleBarcodesSorted {
+		if sampleBarcodes.Conversion[sampleBarcode] == c.controlSample {
+			c.normalization.controlIndex = i
+		}
+		var librarySize int
+		if c.spilled() {
+			librarySize = c.spill.librarySize(sampleBarcode)
+		} else if len(c.Random[sampleBarcode]) == 0 {
+			for _, count := range c.NoRandom[sampleBarcode] {
+				librarySize += count
+			}
+		} else {
+			for _, randomBarcodes := range c.Random[sampleBarcode] {
+				librarySize += len(randomBarcodes)
+			}
+		}
+		c.normalization.librarySizes = append(c.normalization.librarySizes, librarySize)
+		totalSize += librarySize
+	}
+	if c.normalization.controlIndex == -1 {
+		return fmt.Errorf("control sample '%v' not found within the sample barcodes file", c.controlSample)
+	}
+	c.normalization.meanLibrarySize = float64(totalSize) / float64(len(c.sampleBarcodesSorted))
+	return nil
+}
+
+// header returns the extra merge output columns.  Each sample gets a CPM and a library size scaled column, and each
+// sample other than the control gets fold enrichment, lower and upper 95% bounds, and a z-score against the control
+func (n normalization) header(sampleIds []string) string {
+	var header strings.Builder
+	for _, sampleId := range sampleIds {
+		header.WriteString(",CPM_" + sampleId)
+	}
+	for _, sampleId := range sampleIds {
+		header.WriteString(",Scaled_" + sampleId)
+	}
+	for i, sampleId := range sampleIds {
+		if i == n.controlIndex {
+			continue
+		}
+		header.WriteString(",Fold_" + sampleId + ",Fold_Lower_" + sampleId + ",Fold_Upper_" + sampleId + ",Z_" + sampleId)
+	}
+	return header.String()
+}
+
+// columns returns the extra merge output values for a row with sampleCounts in the same order as the sorted sample barcodes
+func (n normalization) columns(sampleCounts []int) string {
+	var columns strings.Builder
+	for i, count := range sampleCounts {
+		columns.WriteString(fmt.Sprintf(",%.4f", cpm(count, n.librarySizes[i])))
+	}
+	for i, count := range sampleCounts {
+		columns.WriteString(fmt.Sprintf(",%.4f", scaledCount(count, n.librarySizes[i], n.meanLibrarySize)))
+	}
+	controlCount := sampleCounts[n.controlIndex]
+	controlSize := n.librarySizes[n.controlIndex]
+	for i, count := range sampleCounts {
+		if i == n.controlIndex {
+			continue
+		}
+		fold, lower, upper := foldEnrichment(count, n.librarySizes[i], controlCount, controlSize)
+		z := poissonZ(count, n.librarySizes[i], controlCount, controlSize)
+		columns.WriteString(fmt.Sprintf(",%.4f,%.4f,%.4f,%.4f", fold, lower, upper, z))
+	}
+	return columns.String()
+}
+
+// cpm returns the counts per million reads of the sample
+func cpm(count int, librarySize int) float64 {
+	if librarySize == 0 {
+		return 0
+	}
+	return float64(count) / float64(librarySize) * 1e6
+}
+
+// scaledCount scales the count so that every sample has the mean library size
+func scaledCount(count int, librarySize int, meanLibrarySize float64) float64 {
+	if librarySize == 0 {
+		return 0
+	}
+	return float64(count) * meanLibrarySize / float64(librarySize)
+}
+
+// foldEnrichment returns the library size normalized fold enrichment of the sample over the control along with the
+// lower and upper 95% bounds.  The bounds use the normal approximation of the Poisson log rate ratio
+func foldEnrichment(count int, librarySize int, controlCount int, controlSize int) (float64, float64, float64) {
+	if librarySize == 0 || controlSize == 0 {
+		return 0, 0, 0
+	}
+	sampleRate := (float64(count) + pseudocount) / float64(librarySize)
+	controlRate := (float64(controlCount) + pseudocount) / float64(controlSize)
+	logFold := math.Log(sampleRate / controlRate)
+	standardError := math.Sqrt(1/(float64(count)+pseudocount) + 1/(float64(controlCount)+pseudocount))
+	return math.Exp(logFold), math.Exp(logFold - zCritical*standardError), math.Exp(logFold + zCritical*standardError)
+}
+
+// poissonZ returns the z-score of the sample count against the control count.  Conditioned on the combined count, the
+// sample count is binomial with the probability equal to the sample's fraction of the combined library size when the
+// sample and control have the same rate
+func poissonZ(count int, librarySize int, controlCount int, controlSize int) float64 {
+	total := float64(count + controlCount)
+	if total == 0 || librarySize == 0 || controlSize == 0 {
+		return 0
+	}
+	probability := float64(librarySize) / float64(librarySize+controlSize)
+	expected := total * probability
+	return (float64(count) - expected) / math.Sqrt(total*probability*(1-probability))
+}
@@ -0,0 +1,85 @@
+package results
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+func TestNormalizationMath(t *testing.T) {
+	tests := []struct {
+		name                                          string
+		count, librarySize, controlCount, controlSize int
+		wantCpm, wantFold, wantZ                      float64
+	}{
+		{"equal", 10, 1000, 10, 1000, 10000, 1, 0},
+		{"enriched", 99, 1000, 9, 1000, 99000, 10.4737, 8.6603},
+		{"depleted with larger library", 5, 2000, 20, 1000, 2500, 0.1341, -4.9497},
+		{"zero counts", 0, 1000, 0, 1000, 0, 1, 0},
+		{"empty library", 0, 0, 5, 1000, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cpm(test.count, test.librarySize); math.Abs(got-test.wantCpm) > 1e-4 {
+				t.Errorf("cpm = %v, want %v", got, test.wantCpm)
+			}
+			fold, lower, upper := foldEnrichment(test.count, test.librarySize, test.controlCount, test.controlSize)
+			if math.Abs(fold-test.wantFold) > 1e-4 {
+				t.Errorf("fold = %v, want %v", fold, test.wantFold)
+			}
+			if lower > fold || upper < fold {
+				t.Errorf("fold %v not within bounds %v-%v", fold, lower, upper)
+			}
+			if got := poissonZ(test.count, test.librarySize, test.controlCount, test.controlSize); math.Abs(got-test.wantZ) > 1e-4 {
+				t.Errorf("z = %v, want %v", got, test.wantZ)
+			}
+		})
+	}
+}
+
+func TestWriteCsvControl(t *testing.T) {
+	countedBarcodes := testBarcodes(1)
+	sampleBarcodes := input.SampleBarcodes{
+		Conversion: map[string]string{"AAAA": "control", "CCCC": "target"},
+		Barcodes:   []string{"AAAA", "CCCC"},
+		Included:   true,
+	}
+	counts := NewCount(sampleBarcodes.Barcodes)
+	// the control library size is 40 and the target library size is 80, so the mean library size is 60
+	sampleCounts := map[string]map[string]int{"AAAA": {"ACGT": 30, "TGCA": 10}, "CCCC": {"ACGT": 10, "TGCA": 70}}
+	for sampleBarcode, barcodeCounts := range sampleCounts {
+		for countedBarcodes, count := range barcodeCounts {
+			for i := 0; i < count; i++ {
+				counts.AddCount(sampleBarcode, countedBarcodes, "", true)
+			}
+		}
+	}
+	counts.AddControl("control")
+
+	outDir := t.TempDir()
+	if err := counts.WriteCsv(context.Background(), outDir+string(os.PathSeparator), true, nil, countedBarcodes, sampleBarcodes); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(outDir, "*_counts.all.csv"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("merge files = %v, %v", files, err)
+	}
+	got, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CPM is count / library size * 1e6 and the scaled count is count * 60 / library size.  Fold is
+	// ((target + 0.5) / 80) / ((control + 0.5) / 40), ie (10.5 / 80) / (30.5 / 40) = 0.1721, with bounds of
+	// exp(ln(fold) -+ 1.959964 * sqrt(1/(target + 0.5) + 1/(control + 0.5))).  Z is (target - total * 2/3) /
+	// sqrt(total * 2/9) where total is the target and control count, ie (10 - 40 * 2/3) / sqrt(40 * 2/9) = -5.5902
+	want := "Barcode_1,control,target,CPM_control,CPM_target,Scaled_control,Scaled_target,Fold_target,Fold_Lower_target,Fold_Upper_target,Z_target" +
+		"\nbb1_1,30,10,750000.0000,125000.0000,45.0000,7.5000,0.1721,0.0854,0.3471,-5.5902" +
+		"\nbb1_2,10,70,250000.0000,875000.0000,15.0000,52.5000,3.3571,1.7555,6.4201,3.9528"
+	if string(got) != want {
+		t.Errorf("merge file =\n%v\nwant\n%v", string(got), want)
+	}
+}
@@ -2,16 +2,17 @@ package results
 
 import (
 	// "bufio"
+	"context"
 	"fmt"
-	"log"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
 )
 
 const NoSampleName = "barcode"
@@ -26,21 +27,35 @@ type Counts struct {
 	NoRandom map[string]map[string]int
 	// Random holds counts when there is a random barcode
 	Random map[string]map[string]map[string]bool
-	// single holds counts for single barcode enrichment
-	single map[string]map[string]int
-	// double holds counts for double barcode enrichment
-	double                  map[string]map[string]int
+	// enriched holds counts for barcode subset enrichment.  The first key is the number of barcodes within the subset,
+	// then the sample barcode, then the key of the counted barcodes within the subset
+	enriched map[int]map[string]map[enrichKey]int
+	// enrichIndices and enrichBarcodes convert between the counted barcodes at each position and their enrichKey slot values
+	enrichIndices  []map[string]int32
+	enrichBarcodes [][]string
+	// enrichCombinations holds the barcode indices of every subset for each subset size within enrichSizes
+	enrichCombinations      map[int][][]int
+	enrichSizes             []int
 	sampleOut               strings.Builder
-	sampleOutSingle         strings.Builder
-	sampleOutDouble         strings.Builder
 	mergeOut                strings.Builder
-	mergeOutSingle          strings.Builder
-	mergeOutDouble          strings.Builder
 	countedBarcodesFinished map[string]bool
 	sampleBarcodesSorted    []string
 	merge                   bool
-	enrich                  bool
 	barcodeNum              int
+	// library holds the expected library members.  When included, zero count rows are written for unobserved members
+	library input.Library
+	// coverageOut holds the library coverage summary per sample
+	coverageOut strings.Builder
+	// unmapped holds the number of reads per sample where the counted barcodes could not be matched
+	unmapped map[string]int
+	// mapped holds the number of reads per sample where the counted barcodes were matched, including random barcode duplicates,
+	// so that the mapped fraction is in reads like unmapped
+	mapped map[string]int
+	// controlSample is the sample ID used as the control for normalized enrichment statistics within the merge output
+	controlSample string
+	normalization normalization
+	// spill, if not nil, writes the counts to temporary files once the memory budget is reached
+	spill *spill
 }
 
 // NewCount creates a new Counts struct.  It inserts the sampleBarcodes into NoRandom and Random maps to prevent a nil map insert
@@ -48,74 +63,145 @@ type Counts struct {
 func NewCount(sampleBarcodes []string) *Counts {
 	var count Counts
 	count.NoRandom = make(map[string]map[string]int)
-	count.single = make(map[string]map[string]int)
-	count.double = make(map[string]map[string]int)
 	count.Random = make(map[string]map[string]map[string]bool)
+	count.unmapped = make(map[string]int)
+	count.mapped = make(map[string]int)
 	for _, sampleBarcode := range sampleBarcodes {
 		count.NoRandom[sampleBarcode] = make(map[string]int)
-		count.single[sampleBarcode] = make(map[string]int)
-		count.double[sampleBarcode] = make(map[string]int)
 		count.Random[sampleBarcode] = make(map[string]map[string]bool)
 	}
 	return &count
 }
 
+// CountsState holds the counts which change while counting, which are saved within checkpoints
+type CountsState struct {
+	NoRandom map[string]map[string]int
+	Random   map[string]map[string]map[string]bool
+	Unmapped map[string]int
+	Mapped   map[string]int
+}
+
+// State returns the counts which change while counting.  The maps are not copied, so nothing can be counted while the state
+// is used
+func (c *Counts) State() CountsState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CountsState{NoRandom: c.NoRandom, Random: c.Random, Unmapped: c.unmapped, Mapped: c.mapped}
+}
+
+// Restore replaces the counts with the state saved within a checkpoint.  This is called before counting
+func (c *Counts) Restore(state CountsState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the sample barcodes from NewCount are kept, as empty maps are not always within the saved state
+	for sampleBarcode := range c.NoRandom {
+		if state.NoRandom[sampleBarcode] == nil {
+			if state.NoRandom == nil {
+				state.NoRandom = make(map[string]map[string]int)
+			}
+			state.NoRandom[sampleBarcode] = make(map[string]int)
+		}
+		if state.Random[sampleBarcode] == nil {
+			if state.Random == nil {
+				state.Random = make(map[string]map[string]map[string]bool)
+			}
+			state.Random[sampleBarcode] = make(map[string]map[string]bool)
+		}
+	}
+	if state.Unmapped == nil {
+		state.Unmapped = make(map[string]int)
+	}
+	if state.Mapped == nil {
+		state.Mapped = make(map[string]int)
+	}
+	c.NoRandom, c.Random, c.unmapped, c.mapped = state.NoRandom, state.Random, state.Unmapped, state.Mapped
+}
+
 // AddCount adds 1 to NoRandom map if a random barcode is not included.  Adds the random barcode to the Random map if a
 // random barcode is included.  This is done in a thread safe manner using mutex locks part of the Counts struct.  A bool
 // is returned if the insertion or addition was successful.  This is used for when the random barcode already exists for the
 // sample:countedBarcodes.  When this is the case false is returned.  This false is used elsewhere to record how many duplicates
-// occured.
+// occured.  When SetMemoryBudget is used, a random barcode already written to a count run is only found to be a duplicate by
+// MergeSpills
 func (c *Counts) AddCount(sampleBarcode string, countedBarcodes string, randomBarcode string, samplBarcodeIncluded bool) bool {
 	if !samplBarcodeIncluded {
 		sampleBarcode = NoSampleName
 	}
+	inserted := true
+	c.mu.Lock()
+	c.mapped[sampleBarcode]++
 	if randomBarcode == "" {
-		c.mu.Lock()
+		if c.spill != nil {
+			if _, ok := c.NoRandom[sampleBarcode][countedBarcodes]; !ok {
+				c.spill.add(countedBarcodes)
+			}
+		}
 		c.NoRandom[sampleBarcode][countedBarcodes]++
-		c.mu.Unlock()
+	} else if randomBarcodes, ok := c.Random[sampleBarcode][countedBarcodes]; !ok {
+		newMap := make(map[string]bool)
+		newMap[randomBarcode] = true
+		c.Random[sampleBarcode][countedBarcodes] = newMap
+		if c.spill != nil {
+			c.spill.add(countedBarcodes, randomBarcode)
+		}
+	} else if _, ok := randomBarcodes[randomBarcode]; ok {
+		inserted = false
 	} else {
-		c.mu.Lock()
-		if _, ok := c.Random[sampleBarcode][countedBarcodes]; !ok {
-			newMap := make(map[string]bool)
-			newMap[randomBarcode] = true
-			c.Random[sampleBarcode][countedBarcodes] = newMap
-			c.mu.Unlock()
-		} else {
-			if _, ok := c.Random[sampleBarcode][countedBarcodes][randomBarcode]; ok {
-				c.mu.Unlock()
-				return false
-			} else {
-				c.Random[sampleBarcode][countedBarcodes][randomBarcode] = true
-				c.mu.Unlock()
-			}
+		randomBarcodes[randomBarcode] = true
+		if c.spill != nil {
+			c.spill.add(randomBarcode)
 		}
 	}
-	return true
+	if c.spill != nil && c.spill.used >= c.spill.budget {
+		c.spillRun()
+	}
+	c.mu.Unlock()
+	return inserted
+}
+
+// AddUnmapped adds 1 to the unmapped reads of the sample.  This is called when the sample barcode is found but the counted
+// barcodes could not be matched, and is used for the mapped fraction of each sample
+func (c *Counts) AddUnmapped(sampleBarcode string, samplBarcodeIncluded bool) {
+	if !samplBarcodeIncluded {
+		sampleBarcode = NoSampleName
+	}
+	c.mu.Lock()
+	c.unmapped[sampleBarcode]++
+	c.mu.Unlock()
+}
+
+// AddLibrary adds the expected library members so that WriteCsv includes zero count rows and a library coverage summary
+func (c *Counts) AddLibrary(library input.Library) {
+	// the members are sorted and deduplicated so that zero count rows are in the same order as the counted barcodes
+	members := append([]string(nil), library.Members...)
+	sort.Strings(members)
+	library.Members = members[:0]
+	for i, member := range members {
+		if i == 0 || member != members[i-1] {
+			library.Members = append(library.Members, member)
+		}
+	}
+	c.library = library
+}
+
+// AddControl sets the control sample ID.  When merge is called, the merge output then includes normalized counts and
+// enrichment statistics of each sample against the control sample
+func (c *Counts) AddControl(controlSample string) {
+	c.controlSample = controlSample
 }
 
 // WriteCsv writes the counts to csv files.  It creates a separate file for each sample.  If the --merge flag is called, it also outputs a csv
 // which merges the results into one file where each sample gets a column.  This method works for both Random and NoRandom results.  The method is
-// split when starting to need to use either map due to the different formats of the two datasets
-func (c *Counts) WriteCsv(outpath string, merge bool, enrich bool, countedBarcodesStruct input.CountedBarcodes, sampleBarcodes input.SampleBarcodes) {
+// split when starting to need to use either map due to the different formats of the two datasets.  enrichSizes holds the number of barcodes
+// within each subset to write enrichment files for, and is empty when enrichment is not used.  Once ctx is done, writing stops
+// before the next file with the error of ctx.  Counts spilled to disk are written from the count runs once MergeSpills is called
+func (c *Counts) WriteCsv(ctx context.Context, outpath string, merge bool, enrichSizes []int, countedBarcodesStruct input.CountedBarcodes, sampleBarcodes input.SampleBarcodes) error {
 	c.merge = merge
-	c.enrich = enrich
+	c.barcodeNum = countedBarcodesStruct.NumBarcodes
+	c.setupEnrichment(enrichSizes)
 
-	// sampleBarcodes will be unordered.  The following orders the sampleBarcodes by the order of the sampleIDs.  This is necessary
-	// for clean merged file output
 	var sampleIds []string
-	for key := range sampleBarcodes.Conversion {
-		sampleIds = append(sampleIds, sampleBarcodes.Conversion[key])
-	}
-	sort.Strings(sampleIds)
-
-	for _, sampleId := range sampleIds {
-		for key, value := range sampleBarcodes.Conversion {
-			if value == sampleId {
-				c.sampleBarcodesSorted = append(c.sampleBarcodesSorted, key)
-				break
-			}
-		}
-	}
+	sampleIds, c.sampleBarcodesSorted = sortSamples(sampleBarcodes)
 
 	// headerStart holds the header for the CSV files.  It will generally be Barcode_1,Barcode_2,..,Barcode_N.
 	// This is then used to create the final header.  For the smaple files, the next column is Count.  For
@@ -139,11 +225,47 @@ func (c *Counts) WriteCsv(outpath string, merge bool, enrich bool, countedBarcod
 			}
 			mergeHeader += sampleId
 		}
+		if c.controlSample != "" {
+			if err := c.setupNormalization(sampleBarcodes); err != nil {
+				return err
+			}
+			mergeHeader += c.normalization.header(sampleIds)
+		}
 		c.mergeOut.WriteString(mergeHeader)
 	}
+	if c.library.Included {
+		c.coverageOut.WriteString("Sample,Members,Observed,Observed_Fraction,Observed_10,Observed_10_Fraction")
+	}
 	today := time.Now().Local().Format("2006-01-02")
+	// counts spilled to disk are written while the count runs are merged
+	write := c.writeInMemory
+	if c.spilled() {
+		write = c.writeSpilled
+	}
+	if err := write(ctx, outpath, today, sampleHeader, countedBarcodesStruct, sampleBarcodes); err != nil {
+		return err
+	}
+	fmt.Println()
+	if c.library.Included {
+		coverageFileName := outpath + today + "_library_coverage.csv"
+		if err := writeFile(coverageFileName, c.coverageOut.String()); err != nil {
+			return err
+		}
+		c.coverageOut.Reset()
+		fmt.Println()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(c.enrichSizes) != 0 {
+		return c.writeEnriched(outpath, today, headerStart, sampleIds, sampleBarcodes)
+	}
+	return nil
+}
+
+// writeInMemory writes the sample files, and the merge file if merge is called, from NoRandom and Random
+func (c *Counts) writeInMemory(ctx context.Context, outpath string, today string, sampleHeader string, countedBarcodesStruct input.CountedBarcodes, sampleBarcodes input.SampleBarcodes) error {
 	for _, sampleBarcode := range c.sampleBarcodesSorted {
-		fmt.Printf("Gathering for %v\n", sampleBarcodes.Conversion[sampleBarcode])
 		c.sampleOut.WriteString(sampleHeader)
 		var total int
 		// If there were no random barcodes use gatherCounts, otherwise use gatherRandom
@@ -152,122 +274,71 @@ func (c *Counts) WriteCsv(outpath string, merge bool, enrich bool, countedBarcod
 		} else {
 			total = c.gatherRandom(sampleBarcode, countedBarcodesStruct)
 		}
+		if c.library.Included {
+			c.addCoverage(sampleBarcode, sampleBarcodes.Conversion[sampleBarcode])
+		}
 
-		// After the gathering is finished, the final count is printed
-		fmt.Printf("\rTotal: %v\nWriting...\n", total)
-		outFileName := outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts.csv"
-		file, err := os.Create(outFileName)
-		if err != nil {
-			log.Fatal(err)
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		_, writeErr := file.WriteString(c.sampleOut.String())
-		if writeErr != nil {
-			log.Fatal(err)
+		outFileName := outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts.csv"
+		logging.Info("Writing counts", "sample", sampleBarcodes.Conversion[sampleBarcode], "rows", total, "file", outFileName)
+		if err := writeFile(outFileName, c.sampleOut.String()); err != nil {
+			return err
 		}
 		c.sampleOut.Reset()
 	}
-	fmt.Println()
+	// Library members which were not observed within any sample still need a merged row of zeros
+	if c.library.Included && c.merge {
+		c.gatherMergeZeros(countedBarcodesStruct)
+	}
 	// If merge is called, write the merge file
 	if c.merge {
 		mergeFileName := outpath + today + "_counts.all.csv"
-		mergeFile, mergeErr := os.Create(mergeFileName)
-		if mergeErr != nil {
-			log.Fatal(mergeErr)
-		}
-		_, mergeWriteErr := mergeFile.WriteString(c.mergeOut.String())
-		if mergeWriteErr != nil {
-			log.Fatal(mergeWriteErr)
+		if err := writeFile(mergeFileName, c.mergeOut.String()); err != nil {
+			return err
 		}
 		c.mergeOut.Reset()
 	}
-	if c.enrich {
-		if c.merge {
-			// countedBarcodesFinished holds what comma separated counted barcodes have already been done.  This is
-			// used while creating the merge file so that countedBarcodes are not repeatedly counted
-			for k := range c.countedBarcodesFinished {
-				delete(c.countedBarcodesFinished, k)
-			}
+	return nil
+}
 
-			mergeHeader := headerStart
-			for i, sampleId := range sampleIds {
-				if i != 0 {
-					mergeHeader += ","
-				}
-				mergeHeader += sampleId
-			}
-			c.mergeOutSingle.WriteString(mergeHeader)
-			c.mergeOutDouble.WriteString(mergeHeader)
-		}
-		for _, sampleBarcode := range c.sampleBarcodesSorted {
-			fmt.Printf("Gathering for single/double enriched %v\n", sampleBarcodes.Conversion[sampleBarcode])
-			c.sampleOutSingle.WriteString(sampleHeader)
-			c.sampleOutDouble.WriteString(sampleHeader)
-
-			totalSingle, totalDouble := c.gatherEnriched(sampleBarcode)
-
-			// After the gathering is finished, the final count is printed
-			fmt.Printf("\rTotal single enriched: %v\nTotal double enriched: %v\n", totalSingle, totalDouble)
-			if totalSingle != 0 {
-				outFileNameSingle := outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts.Single.csv"
-				file, err := os.Create(outFileNameSingle)
-				if err != nil {
-					log.Fatal(err)
-				}
-				_, writeErr := file.WriteString(c.sampleOutSingle.String())
-				if writeErr != nil {
-					log.Fatal(err)
-				}
-				c.sampleOutSingle.Reset()
-			}
-			if totalDouble != 0 {
-				outFileNameDouble := outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts.Double.csv"
-				file, err := os.Create(outFileNameDouble)
-				if err != nil {
-					log.Fatal(err)
-				}
-				_, writeErr := file.WriteString(c.sampleOutDouble.String())
-				if writeErr != nil {
-					log.Fatal(err)
-				}
-				c.sampleOutDouble.Reset()
-			}
-		}
-		fmt.Println()
-		// If merge is called, write the merge file
-		if c.merge {
-			if c.barcodeNum > 1 {
-				mergeFileNameSingle := outpath + today + "_counts.all.Single.csv"
-				mergeFile, mergeErr := os.Create(mergeFileNameSingle)
-				if mergeErr != nil {
-					log.Fatal(mergeErr)
-				}
-				_, mergeWriteErr := mergeFile.WriteString(c.mergeOutSingle.String())
-				if mergeWriteErr != nil {
-					log.Fatal(mergeWriteErr)
-				}
-				c.mergeOutSingle.Reset()
-			}
-			if c.barcodeNum > 2 {
-				mergeFileNameDouble := outpath + today + "_counts.all.Double.csv"
-				mergeFile, mergeErr := os.Create(mergeFileNameDouble)
-				if mergeErr != nil {
-					log.Fatal(mergeErr)
-				}
-				_, mergeWriteErr := mergeFile.WriteString(c.mergeOutDouble.String())
-				if mergeWriteErr != nil {
-					log.Fatal(mergeWriteErr)
-				}
-				c.mergeOutDouble.Reset()
+// sortSamples returns the sorted sample IDs and the sample barcodes in the same order.  sampleBarcodes will be unordered, so this
+// is necessary for clean merged file output
+func sortSamples(sampleBarcodes input.SampleBarcodes) ([]string, []string) {
+	var sampleIds, sampleBarcodesSorted []string
+	for key := range sampleBarcodes.Conversion {
+		sampleIds = append(sampleIds, sampleBarcodes.Conversion[key])
+	}
+	sort.Strings(sampleIds)
+
+	for _, sampleId := range sampleIds {
+		for key, value := range sampleBarcodes.Conversion {
+			if value == sampleId {
+				sampleBarcodesSorted = append(sampleBarcodesSorted, key)
+				break
 			}
 		}
 	}
+	return sampleIds, sampleBarcodesSorted
 }
 
 // gatherCounts is a method for gathering all counts into a comma separated string which, when written to a file,
 // will create a csv file.  It returns the total number of different countedBarcodes to record to stdout later
 func (c *Counts) gatherCounts(sampleBarcode string, countedBarcodesStruct input.CountedBarcodes) int {
 	total := 0
-	for countedBarcodes, count := range c.NoRandom[sampleBarcode] {
+	// the counted barcodes are sorted so that the output files are the same between runs
+	sorted := make([]string, 0, len(c.NoRandom[sampleBarcode]))
+	for countedBarcodes := range c.NoRandom[sampleBarcode] {
+		sorted = append(sorted, countedBarcodes)
+	}
+	zeros := c.gatherZeros(sampleBarcode)
+	for member := range zeros {
+		sorted = append(sorted, member)
+	}
+	sort.Strings(sorted)
+	for _, countedBarcodes := range sorted {
+		count := c.NoRandom[sampleBarcode][countedBarcodes]
 		total++
 		var convertedBarcodes string
 		if countedBarcodesStruct.Included {
@@ -276,22 +347,18 @@ func (c *Counts) gatherCounts(sampleBarcode string, countedBarcodesStruct input.
 			convertedBarcodes = countedBarcodes
 		}
 		c.sampleOut.WriteString("\n" + convertedBarcodes + "," + strconv.Itoa(count))
+		// unobserved library members only need the zero count row.  Their merged rows are added by gatherMergeZeros
+		if zeros[countedBarcodes] {
+			continue
+		}
 		if c.merge {
 			if _, ok := c.countedBarcodesFinished[countedBarcodes]; !ok {
-				mergeRow := "\n" + convertedBarcodes
-				for _, sampleBarcode := range c.sampleBarcodesSorted {
-					mergeRow += "," + strconv.Itoa(c.NoRandom[sampleBarcode][countedBarcodes])
-				}
-				c.mergeOut.WriteString(mergeRow)
-				c.countedBarcodesFinished[countedBarcodes] = true
+				c.addMergeRow(countedBarcodes, convertedBarcodes)
 			}
 		}
-		if c.enrich {
+		if len(c.enrichSizes) != 0 {
 			c.addEnrichment(sampleBarcode, convertedBarcodes, count)
 		}
-		if total%10000 == 0 {
-			fmt.Printf("\rTotal: %v", total)
-		}
 	}
 	return total
 }
@@ -300,8 +367,18 @@ func (c *Counts) gatherCounts(sampleBarcode string, countedBarcodesStruct input.
 // used this for the count.  It returns the total number of different countedBarcodes to record to stdout later
 func (c *Counts) gatherRandom(sampleBarcode string, countedBarcodesStruct input.CountedBarcodes) int {
 	total := 0
-	for countedBarcodes, randomBarcodesMap := range c.Random[sampleBarcode] {
-		count := len(randomBarcodesMap)
+	// the counted barcodes are sorted so that the output files are the same between runs
+	sorted := make([]string, 0, len(c.Random[sampleBarcode]))
+	for countedBarcodes := range c.Random[sampleBarcode] {
+		sorted = append(sorted, countedBarcodes)
+	}
+	zeros := c.gatherZeros(sampleBarcode)
+	for member := range zeros {
+		sorted = append(sorted, member)
+	}
+	sort.Strings(sorted)
+	for _, countedBarcodes := range sorted {
+		count := len(c.Random[sampleBarcode][countedBarcodes])
 		total++
 		var convertedBarcodes string
 		if countedBarcodesStruct.Included {
@@ -310,163 +387,321 @@ func (c *Counts) gatherRandom(sampleBarcode string, countedBarcodesStruct input.
 			convertedBarcodes = countedBarcodes
 		}
 		c.sampleOut.WriteString("\n" + convertedBarcodes + "," + strconv.Itoa(count))
+		// unobserved library members only need the zero count row.  Their merged rows are added by gatherMergeZeros
+		if zeros[countedBarcodes] {
+			continue
+		}
 		if c.merge {
 			if _, ok := c.countedBarcodesFinished[countedBarcodes]; !ok {
-				mergeRow := "\n" + convertedBarcodes
-				for _, sampleBarcode := range c.sampleBarcodesSorted {
-					sampleCount := len(c.Random[sampleBarcode][countedBarcodes])
-					mergeRow += "," + strconv.Itoa(sampleCount)
-				}
-				c.mergeOut.WriteString(mergeRow)
-				c.countedBarcodesFinished[countedBarcodes] = true
+				c.addMergeRow(countedBarcodes, convertedBarcodes)
 			}
 		}
-		if c.enrich {
+		if len(c.enrichSizes) != 0 {
 			c.addEnrichment(sampleBarcode, convertedBarcodes, count)
 		}
-		if total%10000 == 0 {
-			fmt.Printf("\rTotal: %v", total)
-		}
 	}
 	return total
 }
 
-// convertCounted splits the countedBarcodes string by the ','s, converts the DNA barcode to barcode ID,
-// which could be a SMILES string for DEL or whatever identifier is used.  It then combines it back to a
-// comma separated string of converted barcodes
-func convertCounted(countedBarcodes string, countedBarcodesStruct input.CountedBarcodes) string {
-	var convertedBarcodes string
-	for i, countedBarcode := range strings.Split(countedBarcodes, ",") {
-		if len(convertedBarcodes) != 0 {
-			convertedBarcodes += ","
+// SampleCount returns the count for the sample:countedBarcodes.  When random barcodes are used, this is the number of unique
+// random barcodes
+func (c *Counts) SampleCount(sampleBarcode string, countedBarcodes string) int {
+	if len(c.Random[sampleBarcode]) == 0 {
+		return c.NoRandom[sampleBarcode][countedBarcodes]
+	}
+	return len(c.Random[sampleBarcode][countedBarcodes])
+}
+
+// gatherZeros returns the expected library members not observed within the sample, which are written as zero count rows
+// sorted together with the observed counts
+func (c *Counts) gatherZeros(sampleBarcode string) map[string]bool {
+	zeros := make(map[string]bool)
+	if !c.library.Included {
+		return zeros
+	}
+	for _, member := range c.library.Members {
+		if c.SampleCount(sampleBarcode, member) == 0 {
+			zeros[member] = true
 		}
-		convertedBarcodes += countedBarcodesStruct.Conversion[i][countedBarcode]
 	}
-	return convertedBarcodes
+	return zeros
 }
 
-func (c *Counts) addEnrichment(sampleBarcode string, convertedBarcodes string, count int) {
-	barcodesSplit := strings.Split(convertedBarcodes, ",")
-	c.barcodeNum = len(barcodesSplit)
-	if c.barcodeNum > 1 {
-		for i, barcode := range barcodesSplit {
-			var barcodeString string
-			for j := 0; j < c.barcodeNum; j++ {
-				if j != 0 {
-					barcodeString += ","
-				}
-				if i == j {
-					barcodeString += barcode
-				}
-			}
-			c.single[sampleBarcode][barcodeString] += count
-		}
-	}
-	if c.barcodeNum > 2 {
-		for firstBarcodeIndex := 0; firstBarcodeIndex < (c.barcodeNum - 1); firstBarcodeIndex++ {
-			for nextBarcodeAdd := 1; nextBarcodeAdd < (c.barcodeNum - firstBarcodeIndex); nextBarcodeAdd++ {
-				var doubleBarcodeString string
-				for columnIndex := 0; columnIndex < c.barcodeNum; columnIndex++ {
-					if columnIndex != 0 {
-						doubleBarcodeString += ","
-					}
-					if columnIndex == firstBarcodeIndex {
-						doubleBarcodeString += barcodesSplit[firstBarcodeIndex]
-					}
-					if columnIndex == (firstBarcodeIndex + nextBarcodeAdd) {
-						doubleBarcodeString += barcodesSplit[(firstBarcodeIndex + nextBarcodeAdd)]
-					}
-				}
-				c.double[sampleBarcode][doubleBarcodeString] += count
-			}
+// gatherMergeZeros adds a merged row of zeros for each expected library member not observed within any sample
+func (c *Counts) gatherMergeZeros(countedBarcodesStruct input.CountedBarcodes) {
+	for _, member := range c.library.Members {
+		if _, ok := c.countedBarcodesFinished[member]; ok {
+			continue
 		}
+		c.addMergeRow(member, convertCounted(member, countedBarcodesStruct))
 	}
 }
 
-func (c *Counts) gatherEnriched(sampleBarcode string) (int, int) {
-	var totalSingle, totalDouble int
-	if len(c.single[sampleBarcode]) != 0 {
-		for convertedBarcodes, count := range c.single[sampleBarcode] {
-			totalSingle++
-			c.sampleOutSingle.WriteString("\n" + convertedBarcodes + "," + strconv.Itoa(count))
-			if c.merge {
-				if _, ok := c.countedBarcodesFinished[convertedBarcodes]; !ok {
-					mergeRow := "\n" + convertedBarcodes
-					for _, sampleBarcode := range c.sampleBarcodesSorted {
-						mergeRow += "," + strconv.Itoa(c.single[sampleBarcode][convertedBarcodes])
-					}
-					c.mergeOutSingle.WriteString(mergeRow)
-					c.countedBarcodesFinished[convertedBarcodes] = true
-				}
-			}
-			if totalSingle%10000 == 0 {
-				fmt.Printf("\rTotal: %v", totalSingle)
-			}
+// addMergeRow adds the row of counts for every sample to the merge output
+func (c *Counts) addMergeRow(countedBarcodes string, convertedBarcodes string) {
+	sampleCounts := make([]int, len(c.sampleBarcodesSorted))
+	for i, sampleBarcode := range c.sampleBarcodesSorted {
+		sampleCounts[i] = c.SampleCount(sampleBarcode, countedBarcodes)
+	}
+	c.mergeOut.WriteString(c.mergeRow(convertedBarcodes, sampleCounts))
+	c.countedBarcodesFinished[countedBarcodes] = true
+}
+
+// mergeRow returns the merge output row of sampleCounts, which are in the same order as the sorted sample barcodes.  If a
+// control sample is included, the normalized counts and enrichment statistics are added as extra columns
+func (c *Counts) mergeRow(convertedBarcodes string, sampleCounts []int) string {
+	mergeRow := "\n" + convertedBarcodes
+	for _, count := range sampleCounts {
+		mergeRow += "," + strconv.Itoa(count)
+	}
+	if c.normalization.included {
+		mergeRow += c.normalization.columns(sampleCounts)
+	}
+	return mergeRow
+}
+
+// addCoverage records the fraction of expected library members observed at least 1 and at least 10 times within the sample
+func (c *Counts) addCoverage(sampleBarcode string, sampleId string) {
+	var observed, observedTen int
+	for _, member := range c.library.Members {
+		count := c.SampleCount(sampleBarcode, member)
+		if count >= 1 {
+			observed++
+		}
+		if count >= 10 {
+			observedTen++
 		}
 	}
-	if len(c.double[sampleBarcode]) != 0 {
-		for convertedBarcodes, count := range c.double[sampleBarcode] {
-			totalDouble++
-			c.sampleOutDouble.WriteString("\n" + convertedBarcodes + "," + strconv.Itoa(count))
-			if c.merge {
-				if _, ok := c.countedBarcodesFinished[convertedBarcodes]; !ok {
-					mergeRow := "\n" + convertedBarcodes
-					for _, sampleBarcode := range c.sampleBarcodesSorted {
-						mergeRow += "," + strconv.Itoa(c.single[sampleBarcode][convertedBarcodes])
-					}
-					c.mergeOutDouble.WriteString(mergeRow)
-					c.countedBarcodesFinished[convertedBarcodes] = true
-				}
-			}
-			if totalDouble%10000 == 0 {
-				fmt.Printf("\rTotal: %v", totalDouble)
-			}
+	c.writeCoverage(sampleId, observed, observedTen)
+}
+
+// writeCoverage prints and adds to the coverage output the number of library members observed at least 1 and at least 10
+// times within the sample
+func (c *Counts) writeCoverage(sampleId string, observed int, observedTen int) {
+	members := len(c.library.Members)
+	var fraction, fractionTen float64
+	if members != 0 {
+		fraction = float64(observed) / float64(members)
+		fractionTen = float64(observedTen) / float64(members)
+	}
+	fmt.Printf("Library coverage: %v/%v (%.4f) >= 1 read, %v/%v (%.4f) >= 10 reads\n", observed, members, fraction, observedTen, members, fractionTen)
+	c.coverageOut.WriteString(fmt.Sprintf("\n%v,%v,%v,%.6f,%v,%.6f", sampleId, members, observed, fraction, observedTen, fractionTen))
+}
+
+// convertCounted splits the countedBarcodes string by the ','s, converts the DNA barcode to barcode ID,
+// which could be a SMILES string for DEL or whatever identifier is used.  It then combines it back to a
+// comma separated string of converted barcodes
+func convertCounted(countedBarcodes string, countedBarcodesStruct input.CountedBarcodes) string {
+	var convertedBarcodes string
+	for i, countedBarcode := range strings.Split(countedBarcodes, ",") {
+		if len(convertedBarcodes) != 0 {
+			convertedBarcodes += ","
 		}
+		convertedBarcodes += countedBarcodesStruct.Conversion[i][countedBarcode]
 	}
-	return totalSingle, totalDouble
+	return convertedBarcodes
 }
 
 type ParseErrors struct {
 	correct     int
 	constant    int
 	sample      int
+	random      int
 	counted     int
 	duplicate   int
 	correctMu   sync.Mutex
 	constantMu  sync.Mutex
 	sampleMu    sync.Mutex
+	randomMu    sync.Mutex
 	countedMu   sync.Mutex
 	duplicateMu sync.Mutex
+	// repairOffsets holds the number of reads at each start of the sequence format where the constant region was fixed
+	repairOffsets map[int]int
+	repairMu      sync.Mutex
+	// parsed is the reads within every category, updated atomically after the category.  waitReads is the parsed reads
+	// WaitReads waits for, or 0, and waitDone is closed once they are parsed.  waitMu guards waitDone
+	parsed    int64
+	waitReads int64
+	waitDone  chan struct{}
+	waitMu    sync.Mutex
+}
+
+// added adds a read to the parsed reads once it is within a category, and wakes WaitReads once its reads are parsed
+func (p *ParseErrors) added() {
+	parsed := atomic.AddInt64(&p.parsed, 1)
+	if waitReads := atomic.LoadInt64(&p.waitReads); waitReads != 0 && parsed >= waitReads {
+		p.wake()
+	}
+}
+
+// wake closes waitDone when the reads WaitReads waits for are parsed
+func (p *ParseErrors) wake() {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	if p.waitDone != nil && atomic.LoadInt64(&p.parsed) >= atomic.LoadInt64(&p.waitReads) {
+		close(p.waitDone)
+		p.waitDone = nil
+		atomic.StoreInt64(&p.waitReads, 0)
+	}
+}
+
+// WaitReads waits until reads reads are within a category, or returns the error of ctx once it is done.  Only a single
+// goroutine, the reader which writes the checkpoints, waits at a time
+func (p *ParseErrors) WaitReads(ctx context.Context, reads int) error {
+	if reads <= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	p.waitMu.Lock()
+	p.waitDone = done
+	atomic.StoreInt64(&p.waitReads, int64(reads))
+	p.waitMu.Unlock()
+	// the reads can be parsed before waitReads is set, in which case no parsing thread wakes the wait
+	p.wake()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.waitMu.Lock()
+		p.waitDone = nil
+		atomic.StoreInt64(&p.waitReads, 0)
+		p.waitMu.Unlock()
+		return ctx.Err()
+	}
 }
 
 func (p *ParseErrors) AddCorrect() {
 	p.correctMu.Lock()
 	p.correct++
 	p.correctMu.Unlock()
+	p.added()
 }
 
 func (p *ParseErrors) AddConstantError() {
 	p.constantMu.Lock()
 	p.constant++
 	p.constantMu.Unlock()
+	p.added()
 }
 
 func (p *ParseErrors) AddSampleError() {
 	p.sampleMu.Lock()
 	p.sample++
 	p.sampleMu.Unlock()
+	p.added()
+}
+
+// AddRandomError adds a read without the SAM or BAM tag of the random barcode
+func (p *ParseErrors) AddRandomError() {
+	p.randomMu.Lock()
+	p.random++
+	p.randomMu.Unlock()
+	p.added()
 }
 
 func (p *ParseErrors) AddCountedError() {
 	p.countedMu.Lock()
 	p.counted++
 	p.countedMu.Unlock()
+	p.added()
 }
 
 func (p *ParseErrors) AddDuplicateError() {
 	p.duplicateMu.Lock()
 	p.duplicate++
 	p.duplicateMu.Unlock()
+	p.added()
+}
+
+// AddRepairOffset adds a read where the constant region was fixed with the sequence format starting at offset
+func (p *ParseErrors) AddRepairOffset(offset int) {
+	p.repairMu.Lock()
+	if p.repairOffsets == nil {
+		p.repairOffsets = make(map[int]int)
+	}
+	p.repairOffsets[offset]++
+	p.repairMu.Unlock()
+}
+
+// ErrorSummary holds the final number of reads within each ParseErrors category
+type ErrorSummary struct {
+	Correct   int
+	Constant  int
+	Sample    int
+	Random    int
+	Counted   int
+	Duplicate int
+	// RepairOffsets holds the number of reads at each start of the sequence format where the constant region was fixed
+	RepairOffsets map[int]int
+}
+
+// Summary returns the number of reads within each category
+func (p *ParseErrors) Summary() ErrorSummary {
+	p.correctMu.Lock()
+	p.constantMu.Lock()
+	p.sampleMu.Lock()
+	p.randomMu.Lock()
+	p.countedMu.Lock()
+	p.duplicateMu.Lock()
+	defer p.correctMu.Unlock()
+	defer p.constantMu.Unlock()
+	defer p.sampleMu.Unlock()
+	defer p.randomMu.Unlock()
+	defer p.countedMu.Unlock()
+	defer p.duplicateMu.Unlock()
+	p.repairMu.Lock()
+	defer p.repairMu.Unlock()
+	repairOffsets := make(map[int]int, len(p.repairOffsets))
+	for offset, reads := range p.repairOffsets {
+		repairOffsets[offset] = reads
+	}
+	return ErrorSummary{Correct: p.correct, Constant: p.constant, Sample: p.sample, Random: p.random, Counted: p.counted,
+		Duplicate: p.duplicate, RepairOffsets: repairOffsets}
+}
+
+// MoveToDuplicates moves reads from the correct reads to the duplicates.  This is used for the duplicate random barcodes found
+// while merging the counts spilled to disk, which were counted as correct when they were added
+func (p *ParseErrors) MoveToDuplicates(reads int) {
+	p.correctMu.Lock()
+	p.duplicateMu.Lock()
+	p.correct -= reads
+	p.duplicate += reads
+	p.duplicateMu.Unlock()
+	p.correctMu.Unlock()
+}
+
+// Reads returns the number of reads within every category, which is the number of reads parsed
+func (s ErrorSummary) Reads() int {
+	return s.Correct + s.Constant + s.Sample + s.Random + s.Counted + s.Duplicate
+}
+
+// Restore sets the number of reads within each category from the summary saved within a checkpoint.  This is called before
+// counting
+func (p *ParseErrors) Restore(summary ErrorSummary) {
+	p.correctMu.Lock()
+	p.constantMu.Lock()
+	p.sampleMu.Lock()
+	p.randomMu.Lock()
+	p.countedMu.Lock()
+	p.duplicateMu.Lock()
+	defer p.correctMu.Unlock()
+	defer p.constantMu.Unlock()
+	defer p.sampleMu.Unlock()
+	defer p.randomMu.Unlock()
+	defer p.countedMu.Unlock()
+	defer p.duplicateMu.Unlock()
+	p.repairMu.Lock()
+	defer p.repairMu.Unlock()
+	p.correct, p.constant, p.sample, p.counted, p.duplicate = summary.Correct, summary.Constant, summary.Sample, summary.Counted, summary.Duplicate
+	p.random = summary.Random
+	atomic.StoreInt64(&p.parsed, int64(summary.Reads()))
+	p.repairOffsets = nil
+	if len(summary.RepairOffsets) != 0 {
+		p.repairOffsets = make(map[int]int, len(summary.RepairOffsets))
+		for offset, reads := range summary.RepairOffsets {
+			p.repairOffsets[offset] = reads
+		}
+	}
 }
 
 func (p *ParseErrors) Print() {
@@ -474,8 +709,25 @@ func (p *ParseErrors) Print() {
 		"Constant region errrors:     %v\n"+
 		"Sample barcode errors:       %v\n"+
 		"Counted barcode errors:      %v\n"+
-		"Duplicates:                  %v\n\n",
+		"Duplicates:                  %v\n",
 		p.correct, p.constant, p.sample, p.counted, p.duplicate)
+	// reads without the random barcode tag only happen with --random-tag
+	if p.random != 0 {
+		fmt.Printf("Random barcode tag errors:   %v\n", p.random)
+	}
+	if len(p.repairOffsets) != 0 {
+		offsets := make([]int, 0, len(p.repairOffsets))
+		for offset := range p.repairOffsets {
+			offsets = append(offsets, offset)
+		}
+		sort.Ints(offsets)
+		var distribution []string
+		for _, offset := range offsets {
+			distribution = append(distribution, fmt.Sprintf("%v:%v", offset, p.repairOffsets[offset]))
+		}
+		fmt.Printf("Constant repair offsets:     %v\n", strings.Join(distribution, " "))
+	}
+	fmt.Println()
 }
 
 type MaxBarcodeErrorsAllowed struct {
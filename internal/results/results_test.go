@@ -0,0 +1,107 @@
+package results
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+func BenchmarkAddCount(b *testing.B) {
+	members := enumerateTest(testBarcodes(3).Barcodes)
+	benchmarks := []struct {
+		name string
+		// random is whether each read has a random barcode, which is added to the Random counts
+		random bool
+	}{
+		{"no_random", false},
+		{"random", true},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			counts := NewCount([]string{"AAAA", "CCCC"})
+			randomBarcodes := make([]string, 1000)
+			for i := range randomBarcodes {
+				if benchmark.random {
+					randomBarcodes[i] = fmt.Sprintf("R%v", i)
+				}
+			}
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				counts.AddCount("AAAA", members[i%len(members)], randomBarcodes[i%len(randomBarcodes)], true)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "reads/s")
+		})
+	}
+}
+
+func TestWaitReads(t *testing.T) {
+	var seqErrors ParseErrors
+	seqErrors.AddCorrect()
+	if err := seqErrors.WaitReads(context.Background(), 1); err != nil {
+		t.Errorf("WaitReads of the reads already parsed = %v", err)
+	}
+
+	// the parsing threads wake the wait once every read is within a category
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 250; j++ {
+				seqErrors.AddConstantError()
+			}
+		}()
+	}
+	if err := seqErrors.WaitReads(context.Background(), 1001); err != nil {
+		t.Fatal(err)
+	}
+	if reads := seqErrors.Summary().Reads(); reads != 1001 {
+		t.Errorf("WaitReads returned with %v reads parsed, want 1001", reads)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := seqErrors.WaitReads(ctx, 2000); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitReads with a done ctx = %v, want context.Canceled", err)
+	}
+	seqErrors.AddCorrect()
+	if err := seqErrors.WaitReads(context.Background(), 1002); err != nil {
+		t.Errorf("WaitReads after a canceled wait = %v", err)
+	}
+}
+
+func TestWriteCsvZeros(t *testing.T) {
+	countedBarcodes := testBarcodes(2)
+	sampleBarcodes := input.SampleBarcodes{Conversion: map[string]string{"AAAA": "sample_1"}, Barcodes: []string{"AAAA"}, Included: true}
+	counts := NewCount([]string{"AAAA"})
+	counts.AddCount("AAAA", "ACGT,TGCA", "", true)
+	counts.AddCount("AAAA", "ACGT,TGCA", "", true)
+	// the members are unsorted and include a duplicate
+	counts.AddLibrary(input.Library{Members: []string{"TGCA,TGCA", "ACGT,ACGT", "TGCA,ACGT", "ACGT,TGCA", "ACGT,ACGT"}, Included: true})
+
+	outDir := t.TempDir()
+	if err := counts.WriteCsv(context.Background(), outDir+string(os.PathSeparator), false, nil, countedBarcodes, sampleBarcodes); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(outDir, "*_sample_1_counts.csv"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("sample files = %v, %v", files, err)
+	}
+	got, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Barcode_1,Barcode_2,Count\nbb1_1,bb2_1,0\nbb1_1,bb2_2,2\nbb1_2,bb2_1,0\nbb1_2,bb2_2,0"
+	if string(got) != want {
+		t.Errorf("sample file = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,493 @@
+package results
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+)
+
+// spillEntryBytes is the estimated memory of a map entry, not including the barcode strings.  It is used with the barcode sizes
+// to estimate the memory held by the counts
+const spillEntryBytes = 64
+
+// spill holds the partial count runs written to temporary files once the estimated memory of the counts reaches budget
+type spill struct {
+	dir    string
+	budget int64
+	// used is the estimated memory of the counts held in memory
+	used int64
+	runs []string
+	// err is the first error from writing a run, which is returned by MergeSpills
+	err error
+	// merged is set once MergeSpills found the sizes of the runs.  The runs are then written by WriteCsv and WriteCrispr
+	merged bool
+	// sizes holds the summed counts of each sample within the runs
+	sizes map[string]spillCount
+}
+
+// spillCount holds the merged counts of a sample from every count run
+type spillCount struct {
+	noRandom int
+	// random is the number of unique random barcodes
+	random int
+}
+
+// sampleCount returns the merged count of the sample.  Like WriteCsv, a sample with random barcodes only uses the random
+// barcode counts
+func (s *spill) sampleCount(sampleBarcode string, count spillCount) int {
+	if s.sizes[sampleBarcode].random != 0 {
+		return count.random
+	}
+	return count.noRandom
+}
+
+// librarySize returns the total merged count of the sample
+func (s *spill) librarySize(sampleBarcode string) int {
+	return s.sampleCount(sampleBarcode, s.sizes[sampleBarcode])
+}
+
+// add adds the estimated memory of a new map entry holding the barcodes
+func (s *spill) add(barcodes ...string) {
+	s.used += spillEntryBytes
+	for _, barcode := range barcodes {
+		s.used += int64(len(barcode))
+	}
+}
+
+// SetMemoryBudget limits the estimated memory of the counts to budget bytes.  Once the budget is reached, the counts are sorted
+// and written to a temporary file within dir, or the default temporary directory when dir is empty, and counting starts again
+// from empty maps.  MergeSpills needs to be called once every read is counted, and DiscardSpills once the counts are written
+func (c *Counts) SetMemoryBudget(budget int64, dir string) error {
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+	}
+	c.mu.Lock()
+	c.spill = &spill{dir: dir, budget: budget}
+	c.mu.Unlock()
+	return nil
+}
+
+// spillRun writes the counts to a temporary file sorted by counted barcodes, sample barcode, then random barcode, and resets the
+// counts.  Each line is a count record of the sample barcode, counted barcodes, random barcode and count separated by tabs.
+// Reads without a random barcode have an empty random barcode, and each random barcode has a count of 1.  The lock is held
+func (c *Counts) spillRun() {
+	if c.spill.err != nil {
+		return
+	}
+	file, err := os.CreateTemp(c.spill.dir, "barcode-count-*.run")
+	if err != nil {
+		c.spill.err = err
+		return
+	}
+	c.spill.runs = append(c.spill.runs, file.Name())
+	writer := bufio.NewWriterSize(file, 1<<20)
+	// keys holds every sample:countedBarcodes, which are sorted by the counted barcodes first so that the merge can write
+	// the row of every sample for the counted barcodes together
+	var keys []spillRecord
+	for sampleBarcode, counts := range c.NoRandom {
+		for countedBarcodes := range counts {
+			keys = append(keys, spillRecord{sampleBarcode: sampleBarcode, countedBarcodes: countedBarcodes})
+		}
+	}
+	for sampleBarcode, counts := range c.Random {
+		for countedBarcodes := range counts {
+			if _, ok := c.NoRandom[sampleBarcode][countedBarcodes]; !ok {
+				keys = append(keys, spillRecord{sampleBarcode: sampleBarcode, countedBarcodes: countedBarcodes})
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	for _, key := range keys {
+		sampleBarcode, countedBarcodes := key.sampleBarcode, key.countedBarcodes
+		if count, ok := c.NoRandom[sampleBarcode][countedBarcodes]; ok {
+			fmt.Fprintf(writer, "%v\t%v\t\t%v\n", sampleBarcode, countedBarcodes, count)
+		}
+		randomSorted := make([]string, 0, len(c.Random[sampleBarcode][countedBarcodes]))
+		for randomBarcode := range c.Random[sampleBarcode][countedBarcodes] {
+			randomSorted = append(randomSorted, randomBarcode)
+		}
+		sort.Strings(randomSorted)
+		for _, randomBarcode := range randomSorted {
+			fmt.Fprintf(writer, "%v\t%v\t%v\t1\n", sampleBarcode, countedBarcodes, randomBarcode)
+		}
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.spill.err = err
+		return
+	}
+	// the sample barcodes are kept to prevent a nil map insert
+	noRandom := make(map[string]map[string]int, len(c.NoRandom))
+	random := make(map[string]map[string]map[string]bool, len(c.Random))
+	for sampleBarcode := range c.NoRandom {
+		noRandom[sampleBarcode] = make(map[string]int)
+		random[sampleBarcode] = make(map[string]map[string]bool)
+	}
+	for sampleBarcode := range c.Random {
+		noRandom[sampleBarcode] = make(map[string]int)
+		random[sampleBarcode] = make(map[string]map[string]bool)
+	}
+	logging.Debug("Spilled counts to disk", "run", len(c.spill.runs), "file", file.Name(), "estimated_bytes", c.spill.used)
+	c.NoRandom, c.Random = noRandom, random
+	c.spill.used = 0
+}
+
+// spillRecord is a single line of a count run
+type spillRecord struct {
+	sampleBarcode   string
+	countedBarcodes string
+	randomBarcode   string
+	count           int
+}
+
+// less returns whether the record is sorted before other
+func (r spillRecord) less(other spillRecord) bool {
+	if r.countedBarcodes != other.countedBarcodes {
+		return r.countedBarcodes < other.countedBarcodes
+	}
+	if r.sampleBarcode != other.sampleBarcode {
+		return r.sampleBarcode < other.sampleBarcode
+	}
+	return r.randomBarcode < other.randomBarcode
+}
+
+// runReader reads the records of a count run in order
+type runReader struct {
+	path    string
+	file    *os.File
+	scanner *bufio.Scanner
+	record  spillRecord
+}
+
+// next reads the next record.  false is returned at the end of the run or on an error, which is returned by scanner.Err
+func (r *runReader) next() (bool, error) {
+	if !r.scanner.Scan() {
+		return false, r.scanner.Err()
+	}
+	fields := strings.Split(r.scanner.Text(), "\t")
+	if len(fields) != 4 {
+		return false, fmt.Errorf("%v: malformed count record %q", r.path, r.scanner.Text())
+	}
+	count, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", r.path, err)
+	}
+	r.record = spillRecord{sampleBarcode: fields[0], countedBarcodes: fields[1], randomBarcode: fields[2], count: count}
+	return true, nil
+}
+
+// runHeap orders the run readers by their current record for the k-way merge
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].record.less(h[j].record) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	reader := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return reader
+}
+
+// MergeSpills merges the count runs written after the memory budget was reached with the counts still in memory.  The merged
+// counts are not held in memory.  Instead the size of each sample is found here, and WriteCsv and WriteCrispr merge the runs
+// again as they write each row.  A random barcode within more than one run is a duplicate which was counted as correct when
+// it was added, so these duplicates are moved from the correct reads to the duplicates of seqErrors.  Nothing is done when
+// the budget was never reached
+func (c *Counts) MergeSpills(seqErrors *ParseErrors) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spill == nil {
+		return nil
+	}
+	if len(c.spill.runs) != 0 {
+		c.spillRun()
+	}
+	if c.spill.err != nil {
+		c.removeRuns()
+		return c.spill.err
+	}
+	if len(c.spill.runs) == 0 {
+		return nil
+	}
+	logging.Debug("Merging spilled counts", "runs", len(c.spill.runs))
+
+	sizes := make(map[string]spillCount)
+	duplicates, err := c.mergeRuns(func(countedBarcodes string, counts map[string]spillCount) error {
+		for sampleBarcode, count := range counts {
+			size := sizes[sampleBarcode]
+			size.noRandom += count.noRandom
+			size.random += count.random
+			sizes[sampleBarcode] = size
+		}
+		return nil
+	})
+	if err != nil {
+		c.removeRuns()
+		return err
+	}
+	c.spill.sizes = sizes
+	c.spill.merged = true
+	seqErrors.MoveToDuplicates(duplicates)
+	return nil
+}
+
+// spilled returns whether the counts are held within merged count runs in place of NoRandom and Random
+func (c *Counts) spilled() bool {
+	return c.spill != nil && c.spill.merged
+}
+
+// mergeRuns merges the count runs and calls emit with the merged count of each sample for every counted barcodes in sorted
+// order.  counts is reused after emit returns.  The number of random barcodes within more than one run is returned
+func (c *Counts) mergeRuns(emit func(countedBarcodes string, counts map[string]spillCount) error) (int, error) {
+	var runs runHeap
+	defer func() {
+		for _, reader := range runs {
+			reader.file.Close()
+		}
+	}()
+	for _, path := range c.spill.runs {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		reader := &runReader{path: path, file: file, scanner: bufio.NewScanner(bufio.NewReaderSize(file, 1<<20))}
+		ok, err := reader.next()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		if !ok {
+			file.Close()
+			continue
+		}
+		runs = append(runs, reader)
+	}
+	heap.Init(&runs)
+
+	counts := make(map[string]spillCount)
+	duplicates := 0
+	var previous spillRecord
+	for len(runs) != 0 {
+		reader := runs[0]
+		record := reader.record
+		if len(counts) != 0 && record.countedBarcodes != previous.countedBarcodes {
+			if err := emit(previous.countedBarcodes, counts); err != nil {
+				return 0, err
+			}
+			for sampleBarcode := range counts {
+				delete(counts, sampleBarcode)
+			}
+		}
+		count := counts[record.sampleBarcode]
+		if record.randomBarcode == "" {
+			count.noRandom += record.count
+		} else if record == previous {
+			// each run holds a random barcode once, so the same record from another run is a duplicate
+			duplicates++
+		} else {
+			count.random++
+		}
+		counts[record.sampleBarcode] = count
+		previous = record
+		ok, err := reader.next()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			heap.Fix(&runs, 0)
+		} else {
+			reader.file.Close()
+			heap.Pop(&runs)
+		}
+	}
+	if len(counts) != 0 {
+		if err := emit(previous.countedBarcodes, counts); err != nil {
+			return 0, err
+		}
+	}
+	return duplicates, nil
+}
+
+// writeSpilled writes the sample files, and the merge file if merge is called, from the merged count runs.  Each row is written
+// as the runs are merged, so only the counts of a single counted barcodes are held in memory.  A merged row is first written to
+// a temporary file for the first sample with a count, or the last temporary file for a library member without any counts,
+// then the temporary files are joined so that the rows are in the same order as the merge file of in-memory counts
+func (c *Counts) writeSpilled(ctx context.Context, outpath string, today string, sampleHeader string, countedBarcodesStruct input.CountedBarcodes, sampleBarcodes input.SampleBarcodes) error {
+	samples := len(c.sampleBarcodesSorted)
+	sampleFiles := make([]*os.File, samples)
+	sampleOut := make([]*bufio.Writer, samples)
+	var mergeFiles []*os.File
+	var mergeOut []*bufio.Writer
+	defer func() {
+		for _, file := range sampleFiles {
+			if file != nil {
+				file.Close()
+			}
+		}
+		for _, file := range mergeFiles {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	for i, sampleBarcode := range c.sampleBarcodesSorted {
+		file, err := os.Create(outpath + today + "_" + sampleBarcodes.Conversion[sampleBarcode] + "_counts.csv")
+		if err != nil {
+			return err
+		}
+		sampleFiles[i] = file
+		sampleOut[i] = bufio.NewWriter(file)
+		sampleOut[i].WriteString(sampleHeader)
+	}
+	if c.merge {
+		for i := 0; i <= samples; i++ {
+			file, err := os.CreateTemp(c.spill.dir, "barcode-count-*.merge")
+			if err != nil {
+				return err
+			}
+			mergeFiles = append(mergeFiles, file)
+			mergeOut = append(mergeOut, bufio.NewWriter(file))
+		}
+	}
+
+	totals := make([]int, samples)
+	observed := make([]int, samples)
+	observedTen := make([]int, samples)
+	sampleCounts := make([]int, samples)
+	// writeRow writes the row of the counted barcodes to each sample file with a count, or every sample file for a library member
+	writeRow := func(countedBarcodes string, counts map[string]spillCount, member bool) {
+		convertedBarcodes := countedBarcodes
+		if countedBarcodesStruct.Included {
+			convertedBarcodes = convertCounted(countedBarcodes, countedBarcodesStruct)
+		}
+		first := samples
+		for i, sampleBarcode := range c.sampleBarcodesSorted {
+			count := c.spill.sampleCount(sampleBarcode, counts[sampleBarcode])
+			sampleCounts[i] = count
+			if count == 0 && !member {
+				continue
+			}
+			if count != 0 && first == samples {
+				first = i
+			}
+			totals[i]++
+			sampleOut[i].WriteString("\n" + convertedBarcodes + "," + strconv.Itoa(count))
+			if member && count >= 1 {
+				observed[i]++
+			}
+			if member && count >= 10 {
+				observedTen[i]++
+			}
+			if count != 0 && len(c.enrichSizes) != 0 {
+				c.addEnrichment(sampleBarcode, convertedBarcodes, count)
+			}
+		}
+		// counts only within samples which use their random barcode counts do not have a merged row, the same as in memory
+		if c.merge && (first != samples || member) {
+			mergeOut[first].WriteString(c.mergeRow(convertedBarcodes, sampleCounts))
+		}
+	}
+
+	// members are the library members not yet written, which are sorted the same as the runs
+	var members []string
+	if c.library.Included {
+		members = c.library.Members
+	}
+	_, err := c.mergeRuns(func(countedBarcodes string, counts map[string]spillCount) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for len(members) != 0 && members[0] < countedBarcodes {
+			writeRow(members[0], nil, true)
+			members = members[1:]
+		}
+		member := len(members) != 0 && members[0] == countedBarcodes
+		if member {
+			members = members[1:]
+		}
+		writeRow(countedBarcodes, counts, member)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		writeRow(member, nil, true)
+	}
+
+	for i, sampleBarcode := range c.sampleBarcodesSorted {
+		err := sampleOut[i].Flush()
+		if closeErr := sampleFiles[i].Close(); err == nil {
+			err = closeErr
+		}
+		sampleFiles[i] = nil
+		if err != nil {
+			return err
+		}
+		logging.Info("Writing counts", "sample", sampleBarcodes.Conversion[sampleBarcode], "rows", totals[i], "file", outpath+today+"_"+sampleBarcodes.Conversion[sampleBarcode]+"_counts.csv")
+		if c.library.Included {
+			c.writeCoverage(sampleBarcodes.Conversion[sampleBarcode], observed[i], observedTen[i])
+		}
+	}
+	if !c.merge {
+		return nil
+	}
+	mergeFile, err := os.Create(outpath + today + "_counts.all.csv")
+	if err != nil {
+		return err
+	}
+	defer mergeFile.Close()
+	if _, err := mergeFile.WriteString(c.mergeOut.String()); err != nil {
+		return err
+	}
+	c.mergeOut.Reset()
+	for i, file := range mergeFiles {
+		if err := mergeOut[i].Flush(); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(mergeFile, file); err != nil {
+			return err
+		}
+	}
+	return mergeFile.Close()
+}
+
+// DiscardSpills removes the count runs.  This is called once the merged counts are written, or without merging for a count which
+// stops before every read is counted
+func (c *Counts) DiscardSpills() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spill != nil {
+		c.removeRuns()
+	}
+}
+
+// removeRuns removes the count run files
+func (c *Counts) removeRuns() {
+	for _, path := range c.spill.runs {
+		os.Remove(path)
+	}
+	c.spill.runs = nil
+}
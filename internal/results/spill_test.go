@@ -0,0 +1,174 @@
+package results
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+// TestMergeSpills counts the same reads in memory and with memory budgets which spill after every read, after a few reads, and
+// never.  The written counts and the duplicates must match the in-memory counts, without the merged counts held in memory
+func TestMergeSpills(t *testing.T) {
+	samples := []string{"AAAA", "CCCC", "GGGG"}
+	sampleBarcodes := input.SampleBarcodes{
+		Conversion: map[string]string{"AAAA": "sample_1", "CCCC": "sample_2", "GGGG": "sample_3"},
+		Barcodes:   samples,
+		Included:   true,
+	}
+	countedBarcodes := testBarcodes(3)
+	members := enumerateTest(countedBarcodes.Barcodes)
+	tests := []struct {
+		name   string
+		budget int64
+		// random is whether the reads have a random barcode
+		random bool
+	}{
+		{"every read", 1, false},
+		{"every read random", 1, true},
+		{"few reads", 300, false},
+		{"few reads random", 1000, true},
+		{"never", 1 << 30, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spillDir := t.TempDir()
+			inMemory := NewCount(samples)
+			spilled := NewCount(samples)
+			if err := spilled.SetMemoryBudget(test.budget, spillDir); err != nil {
+				t.Fatal(err)
+			}
+			var inMemoryErrors, spilledErrors ParseErrors
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 2000; i++ {
+				sampleBarcode := samples[random.Intn(len(samples))]
+				// the last members are never counted so that they are written as zero count rows
+				countedBarcodes := members[random.Intn(len(members)-2)]
+				var randomBarcode string
+				if test.random {
+					randomBarcode = string("ACGT"[random.Intn(4)]) + string("ACGT"[random.Intn(4)])
+				}
+				addTestCount(inMemory, &inMemoryErrors, sampleBarcode, countedBarcodes, randomBarcode)
+				addTestCount(spilled, &spilledErrors, sampleBarcode, countedBarcodes, randomBarcode)
+			}
+			if spilledRuns := len(spilled.spill.runs); (spilledRuns == 0) != (test.budget == 1<<30) {
+				t.Errorf("%v count runs spilled with a budget of %v bytes", spilledRuns, test.budget)
+			}
+			if err := spilled.MergeSpills(&spilledErrors); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := spilledErrors.Summary(), inMemoryErrors.Summary(); got.Correct != want.Correct || got.Duplicate != want.Duplicate {
+				t.Errorf("correct, duplicates = %v, %v, want %v, %v", got.Correct, got.Duplicate, want.Correct, want.Duplicate)
+			}
+			if test.budget != 1<<30 {
+				checkBounded(t, spilled)
+			}
+
+			inMemoryDir, spilledDir := t.TempDir(), t.TempDir()
+			for _, counts := range []*Counts{inMemory, spilled} {
+				counts.AddLibrary(input.Library{Members: members, Included: true})
+				counts.AddControl("sample_1")
+			}
+			if err := inMemory.WriteCsv(context.Background(), inMemoryDir+string(os.PathSeparator), true, []int{1}, countedBarcodes, sampleBarcodes); err != nil {
+				t.Fatal(err)
+			}
+			if err := spilled.WriteCsv(context.Background(), spilledDir+string(os.PathSeparator), true, []int{1}, countedBarcodes, sampleBarcodes); err != nil {
+				t.Fatal(err)
+			}
+			if test.budget != 1<<30 {
+				checkBounded(t, spilled)
+			}
+			want, got := readDir(t, inMemoryDir), readDir(t, spilledDir)
+			if len(want) == 0 || !reflect.DeepEqual(got, want) {
+				t.Errorf("spilled count files = %v, want %v", got, want)
+			}
+
+			spilled.DiscardSpills()
+			runs, err := os.ReadDir(spillDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 0 {
+				t.Errorf("%v count runs left within the spill directory", len(runs))
+			}
+		})
+	}
+}
+
+// TestMergeSpillsDuplicate adds the same random barcode before and after a spill.  The count run does not find the second read
+// to be a duplicate, so MergeSpills needs to move it from the correct reads to the duplicates
+func TestMergeSpillsDuplicate(t *testing.T) {
+	counts := NewCount([]string{"AAAA"})
+	if err := counts.SetMemoryBudget(1, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer counts.DiscardSpills()
+	var seqErrors ParseErrors
+	addTestCount(counts, &seqErrors, "AAAA", "ACGT", "RR")
+	addTestCount(counts, &seqErrors, "AAAA", "ACGT", "RR")
+	addTestCount(counts, &seqErrors, "AAAA", "ACGT", "GG")
+	if summary := seqErrors.Summary(); summary.Correct != 3 || summary.Duplicate != 0 {
+		t.Fatalf("before the merge correct, duplicates = %v, %v, want 3, 0", summary.Correct, summary.Duplicate)
+	}
+	if err := counts.MergeSpills(&seqErrors); err != nil {
+		t.Fatal(err)
+	}
+	if summary := seqErrors.Summary(); summary.Correct != 2 || summary.Duplicate != 1 {
+		t.Errorf("correct, duplicates = %v, %v, want 2, 1", summary.Correct, summary.Duplicate)
+	}
+	if size := counts.spill.librarySize("AAAA"); size != 2 {
+		t.Errorf("library size = %v, want 2", size)
+	}
+}
+
+// addTestCount adds the count and records it within seqErrors the same as the parsing threads
+func addTestCount(counts *Counts, seqErrors *ParseErrors, sampleBarcode string, countedBarcodes string, randomBarcode string) {
+	if counts.AddCount(sampleBarcode, countedBarcodes, randomBarcode, true) {
+		seqErrors.AddCorrect()
+	} else {
+		seqErrors.AddDuplicateError()
+	}
+}
+
+// checkBounded fails the test if the counts spilled to disk are held within NoRandom or Random
+func checkBounded(t *testing.T, counts *Counts) {
+	t.Helper()
+	for sampleBarcode := range counts.NoRandom {
+		if len(counts.NoRandom[sampleBarcode]) != 0 || len(counts.Random[sampleBarcode]) != 0 {
+			t.Errorf("sample %v holds %v counts and %v random counts in memory, want none", sampleBarcode, len(counts.NoRandom[sampleBarcode]), len(counts.Random[sampleBarcode]))
+		}
+	}
+}
+
+// readDir returns the contents of every file within dir by the file name
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(contents)
+	}
+	return files
+}
+
+func TestSetMemoryBudget(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := NewCount(nil).SetMemoryBudget(1, file.Name()); err == nil {
+		t.Error("SetMemoryBudget with a file as the spill directory did not return an error")
+	}
+}
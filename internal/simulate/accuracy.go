@@ -0,0 +1,129 @@
+package simulate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+)
+
+// StageAccuracy holds the number of correct and incorrect calls of a parsing stage
+type StageAccuracy struct {
+	Stage string
+	// TruePositives are reads which passed the stage with the right barcodes.  FalsePositives are reads which passed the
+	// stage but should not have, or passed with the wrong barcodes.  FalseNegatives are reads which should have passed the
+	// stage with the right barcodes but did not
+	TruePositives, FalsePositives, FalseNegatives int
+}
+
+// Recall returns the fraction of reads which should have passed the stage that passed with the right barcodes
+func (a StageAccuracy) Recall() float64 {
+	if a.TruePositives+a.FalseNegatives == 0 {
+		return 0
+	}
+	return float64(a.TruePositives) / float64(a.TruePositives+a.FalseNegatives)
+}
+
+// Precision returns the fraction of reads which passed the stage that should have passed with the same barcodes
+func (a StageAccuracy) Precision() float64 {
+	if a.TruePositives+a.FalsePositives == 0 {
+		return 0
+	}
+	return float64(a.TruePositives) / float64(a.TruePositives+a.FalsePositives)
+}
+
+// add records a single read where expected is whether the read should pass the stage and passed is whether it passed with
+// the right barcodes.  called is whether it passed the stage at all
+func (a *StageAccuracy) add(expected bool, called bool, passed bool) {
+	switch {
+	case expected && passed:
+		a.TruePositives++
+	case called:
+		a.FalsePositives++
+	}
+	if expected && !passed {
+		a.FalseNegatives++
+	}
+}
+
+// Evaluator parses simulated reads and compares the results to the truth of each read.  The stages are the constant region,
+// the sample barcode, the counted barcodes, and, when there is a random barcode, the removal of duplicates
+type Evaluator struct {
+	parser                           *parse.Parser
+	sampleIncluded, randomIncluded   bool
+	constant, sample, counted, dedup StageAccuracy
+	// found holds the sample, counted and random barcodes already counted, in the same way as the counter removes duplicates
+	found map[string]struct{}
+}
+
+// NewEvaluator creates an Evaluator which uses parser on each read
+func NewEvaluator(parser *parse.Parser, format input.SequenceFormat) *Evaluator {
+	evaluator := &Evaluator{
+		parser:   parser,
+		constant: StageAccuracy{Stage: parse.ConstantStage.String()},
+		sample:   StageAccuracy{Stage: parse.SampleStage.String()},
+		counted:  StageAccuracy{Stage: parse.CountedStage.String()},
+		dedup:    StageAccuracy{Stage: "duplicate"},
+		found:    make(map[string]struct{}),
+	}
+	for _, region := range format.Regions {
+		switch region.Kind {
+		case input.SampleRegion:
+			evaluator.sampleIncluded = true
+		case input.RandomRegion:
+			evaluator.randomIncluded = true
+		}
+	}
+	return evaluator
+}
+
+// Add parses the read and records the result of each stage
+func (e *Evaluator) Add(read TruthRead) {
+	match := e.parser.Parse(read.Sequence)
+	formatted := read.Type != OffTargetRead
+	e.constant.add(formatted, match.Stage > parse.ConstantStage, formatted && match.Stage > parse.ConstantStage)
+
+	sampleCorrect := match.SampleBarcode == read.Sample
+	if e.sampleIncluded {
+		called := match.Stage > parse.SampleStage
+		e.sample.add(formatted, called, formatted && called && sampleCorrect)
+	}
+
+	// chimeras join two molecules, so they should not be counted
+	member := read.Type == TargetRead || read.Type == DuplicateRead
+	called := match.Stage == parse.Matched
+	correct := called && sampleCorrect && match.CountedBarcodes == strings.Join(read.Counted, ",")
+	e.counted.add(member, called, member && correct)
+
+	if e.randomIncluded && called {
+		key := match.SampleBarcode + "," + match.CountedBarcodes + "," + match.RandomBarcode
+		_, duplicate := e.found[key]
+		e.found[key] = struct{}{}
+		e.dedup.add(read.Type == TargetRead && correct, !duplicate, read.Type == TargetRead && correct && !duplicate)
+	}
+}
+
+// Accuracy returns the accuracy of each stage.  The sample and duplicate stages are only included when the sequence format
+// has a sample or random barcode
+func (e *Evaluator) Accuracy() []StageAccuracy {
+	accuracy := []StageAccuracy{e.constant}
+	if e.sampleIncluded {
+		accuracy = append(accuracy, e.sample)
+	}
+	accuracy = append(accuracy, e.counted)
+	if e.randomIncluded {
+		accuracy = append(accuracy, e.dedup)
+	}
+	return accuracy
+}
+
+// Print outputs the recall and precision of each stage to stdout
+func (e *Evaluator) Print() {
+	fmt.Println("-ACCURACY-")
+	fmt.Printf("%-10v %-8v %-9v %-9v %-9v %v\n", "Stage", "Recall", "Precision", "True_Pos", "False_Pos", "False_Neg")
+	for _, stage := range e.Accuracy() {
+		fmt.Printf("%-10v %-8.4f %-9.4f %-9v %-9v %v\n", stage.Stage, stage.Recall(), stage.Precision(), stage.TruePositives, stage.FalsePositives, stage.FalseNegatives)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,260 @@
+// Package simulate generates synthetic sequencing reads from the sequence format and barcode files.  Each read is recorded
+// within a truth table so that the accuracy of the counter can be measured
+package simulate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+)
+
+// nucleotides is used to pick random nucleotides for substitutions, random barcodes, and barcodes without a barcode file
+const nucleotides = "ATGC"
+
+// Options holds the settings of the simulated reads.  Each rate is a probability between 0 and 1
+type Options struct {
+	Reads int
+	Seed  int64
+	// SubstitutionRate, InsertionRate and DeletionRate are the chance of each nucleotide of the read having the error
+	SubstitutionRate float64
+	InsertionRate    float64
+	DeletionRate     float64
+	// DuplicationRate is the chance of a read being a PCR duplicate of an earlier molecule, with the same random barcode
+	DuplicationRate float64
+	// ChimeraRate is the chance of a read joining the start of one molecule with the end of another
+	ChimeraRate float64
+	// OffTargetRate is the chance of a read being random sequence which does not follow the sequence format
+	OffTargetRate float64
+	// Flank is the number of random nucleotides before and after the sequence format within each read
+	Flank int
+}
+
+// ReadType is the kind of molecule a simulated read came from
+type ReadType int
+
+const (
+	// TargetRead is a read of a new molecule
+	TargetRead ReadType = iota
+	// DuplicateRead is a read of an earlier molecule.  It should not be counted again when there is a random barcode
+	DuplicateRead
+	// ChimeraRead joins two molecules, so it does not represent a real library member
+	ChimeraRead
+	// OffTargetRead is random sequence and should not be counted
+	OffTargetRead
+)
+
+// String returns the name of the read type used within the truth table
+func (t ReadType) String() string {
+	switch t {
+	case TargetRead:
+		return "target"
+	case DuplicateRead:
+		return "duplicate"
+	case ChimeraRead:
+		return "chimera"
+	default:
+		return "off_target"
+	}
+}
+
+// TruthRead is a simulated read along with the barcodes it was created from and the errors added to it
+type TruthRead struct {
+	Name     string
+	Sequence string
+	Type     ReadType
+	// Sample is the sample DNA barcode, or empty when the sequence format does not have a sample barcode
+	Sample string
+	// Counted holds each counted DNA barcode
+	Counted []string
+	// Random is the random DNA barcode, or empty when the sequence format does not have a random barcode
+	Random                               string
+	Substitutions, Insertions, Deletions int
+}
+
+// molecule holds the sequence of each region of the sequence format before sequencing errors are added
+type molecule []string
+
+// Simulator creates reads which follow the sequence format.  The sample and counted barcodes are picked from the barcode
+// files when included, otherwise random barcodes are used
+type Simulator struct {
+	format          input.SequenceFormat
+	sampleBarcodes  input.SampleBarcodes
+	countedBarcodes input.CountedBarcodes
+	options         Options
+	random          *rand.Rand
+	// variable holds the index of each sample, counted and random region, which a chimera breakpoint falls between
+	variable []int
+	// molecules holds every molecule created so far so that duplicates and chimeras can be made from them
+	molecules []molecule
+	readNum   int
+}
+
+// NewSimulator creates a Simulator.  The same options and barcode files always create the same reads
+func NewSimulator(format input.SequenceFormat, sampleBarcodes input.SampleBarcodes, countedBarcodes input.CountedBarcodes, options Options) *Simulator {
+	var variable []int
+	for i, region := range format.Regions {
+		if region.Kind != input.ConstantRegion {
+			variable = append(variable, i)
+		}
+	}
+	return &Simulator{
+		format:          format,
+		sampleBarcodes:  sampleBarcodes,
+		countedBarcodes: countedBarcodes,
+		options:         options,
+		random:          rand.New(rand.NewSource(options.Seed)),
+		variable:        variable,
+	}
+}
+
+// Read returns the next simulated read
+func (s *Simulator) Read() TruthRead {
+	s.readNum++
+	read := TruthRead{Name: "simulated_" + strconv.Itoa(s.readNum)}
+	var parts molecule
+	choice := s.random.Float64()
+	switch {
+	case choice < s.options.OffTargetRate:
+		read.Type = OffTargetRead
+		read.Sequence = s.randomSequence(len(s.format.FormatString))
+	case choice < s.options.OffTargetRate+s.options.ChimeraRate && len(s.molecules) != 0 && len(s.variable) > 1:
+		read.Type = ChimeraRead
+		first, second := s.molecules[s.random.Intn(len(s.molecules))], s.newMolecule()
+		// the breakpoint falls between two variable regions so that each molecule adds at least one variable region
+		after := 1 + s.random.Intn(len(s.variable)-1)
+		breakpoint := s.variable[after-1] + 1 + s.random.Intn(s.variable[after]-s.variable[after-1])
+		parts = append(append(molecule(nil), first[:breakpoint]...), second[breakpoint:]...)
+	case choice < s.options.OffTargetRate+s.options.ChimeraRate+s.options.DuplicationRate && len(s.molecules) != 0:
+		read.Type = DuplicateRead
+		parts = s.molecules[s.random.Intn(len(s.molecules))]
+	default:
+		read.Type = TargetRead
+		parts = s.newMolecule()
+		s.molecules = append(s.molecules, parts)
+	}
+	if parts != nil {
+		for i, region := range s.format.Regions {
+			switch region.Kind {
+			case input.SampleRegion:
+				read.Sample = parts[i]
+			case input.CountedRegion:
+				read.Counted = append(read.Counted, parts[i])
+			case input.RandomRegion:
+				read.Random = parts[i]
+			}
+		}
+		read.Sequence = strings.Join(parts, "")
+	}
+	read.Sequence = s.randomSequence(s.options.Flank) + s.addErrors(read.Sequence, &read) + s.randomSequence(s.options.Flank)
+	return read
+}
+
+// newMolecule creates the sequence of each region of the sequence format
+func (s *Simulator) newMolecule() molecule {
+	parts := make(molecule, len(s.format.Regions))
+	for i, region := range s.format.Regions {
+		switch {
+		case region.Kind == input.ConstantRegion:
+			parts[i] = region.Sequence
+		case region.Kind == input.SampleRegion && s.sampleBarcodes.Included:
+			parts[i] = s.sampleBarcodes.Barcodes[s.random.Intn(len(s.sampleBarcodes.Barcodes))]
+		case region.Kind == input.CountedRegion && s.countedBarcodes.Included:
+			barcodes := s.countedBarcodes.Barcodes[region.Index-1]
+			parts[i] = barcodes[s.random.Intn(len(barcodes))]
+		default:
+			parts[i] = s.randomSequence(region.Size)
+		}
+	}
+	return parts
+}
+
+// randomSequence returns a random DNA sequence of size nucleotides
+func (s *Simulator) randomSequence(size int) string {
+	sequence := make([]byte, size)
+	for i := range sequence {
+		sequence[i] = nucleotides[s.random.Intn(len(nucleotides))]
+	}
+	return string(sequence)
+}
+
+// addErrors adds substitutions, insertions and deletions to the sequence at the option rates, and records the number of
+// each within read
+func (s *Simulator) addErrors(sequence string, read *TruthRead) string {
+	if s.options.SubstitutionRate <= 0 && s.options.InsertionRate <= 0 && s.options.DeletionRate <= 0 {
+		return sequence
+	}
+	mutated := make([]byte, 0, len(sequence)+2)
+	for i := 0; i < len(sequence); i++ {
+		if s.random.Float64() < s.options.InsertionRate {
+			mutated = append(mutated, nucleotides[s.random.Intn(len(nucleotides))])
+			read.Insertions++
+		}
+		if s.random.Float64() < s.options.DeletionRate {
+			read.Deletions++
+			continue
+		}
+		nucleotide := sequence[i]
+		if s.random.Float64() < s.options.SubstitutionRate {
+			replacement := nucleotides[s.random.Intn(len(nucleotides))]
+			for replacement == nucleotide {
+				replacement = nucleotides[s.random.Intn(len(nucleotides))]
+			}
+			nucleotide = replacement
+			read.Substitutions++
+		}
+		mutated = append(mutated, nucleotide)
+	}
+	return string(mutated)
+}
+
+// TruthHeader returns the header of the truth table
+func (s *Simulator) TruthHeader() string {
+	header := "Read,Type,Sample"
+	for i := 0; i < s.format.CountedBarcodeNum; i++ {
+		header += ",Barcode_" + strconv.Itoa(i+1)
+	}
+	return header + ",Random,Substitutions,Insertions,Deletions"
+}
+
+// TruthRow returns the truth table row of the read
+func (s *Simulator) TruthRow(read TruthRead) string {
+	counted := read.Counted
+	if counted == nil {
+		// off target reads do not have counted barcodes
+		counted = make([]string, s.format.CountedBarcodeNum)
+	}
+	return fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v", read.Name, read.Type, read.Sample, strings.Join(counted, ","), read.Random,
+		read.Substitutions, read.Insertions, read.Deletions)
+}
+
+// WriteFastq writes options.Reads simulated reads to fastqWriter as FASTQ records.  The truth table is written to
+// truthWriter, and each read is added to evaluator, when they are not nil
+func (s *Simulator) WriteFastq(fastqWriter io.Writer, truthWriter io.Writer, evaluator *Evaluator) error {
+	fastq := bufio.NewWriter(fastqWriter)
+	var truth *bufio.Writer
+	if truthWriter != nil {
+		truth = bufio.NewWriter(truthWriter)
+		truth.WriteString(s.TruthHeader())
+	}
+	for i := 0; i < s.options.Reads; i++ {
+		read := s.Read()
+		fmt.Fprintf(fastq, "@%v\n%v\n+\n%v\n", read.Name, read.Sequence, strings.Repeat("I", len(read.Sequence)))
+		if truth != nil {
+			truth.WriteString("\n" + s.TruthRow(read))
+		}
+		if evaluator != nil {
+			evaluator.Add(read)
+		}
+	}
+	if truth != nil {
+		if err := truth.Flush(); err != nil {
+			return err
+		}
+	}
+	return fastq.Flush()
+}
@@ -0,0 +1,127 @@
+package simulate
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+const (
+	testFormat  = "AGCTAGCT[6]TTGACAGT{8}CCTGA{8}GGACT(10)TTTTGCA\n"
+	testSamples = "Barcode,Sample_ID\nAAAAAA,s1\nCCCCCC,s2\nGGGGGG,s3\n"
+	testCounted = "Barcode,Barcode_ID,Barcode_Number\n" +
+		"ACGTACGT,a1,1\nTGCATGCA,a2,1\nGGTTCCAA,a3,1\n" +
+		"CCAAGGTT,b1,2\nATATCGCG,b2,2\nGCGCATAT,b3,2\n"
+)
+
+func testInputs(t *testing.T) (input.SequenceFormat, input.SampleBarcodes, input.CountedBarcodes) {
+	t.Helper()
+	format, err := input.ParseSequenceFormat(strings.NewReader(testFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleBarcodes, err := input.ReadSampleBarcodes(strings.NewReader(testSamples), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countedBarcodes, err := input.ReadCountedBarcodes(strings.NewReader(testCounted), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return format, sampleBarcodes, countedBarcodes
+}
+
+func TestSimulatorDeterministic(t *testing.T) {
+	format, sampleBarcodes, countedBarcodes := testInputs(t)
+	options := Options{Reads: 200, Seed: 7, SubstitutionRate: 0.01, DuplicationRate: 0.2, ChimeraRate: 0.05, OffTargetRate: 0.05, Flank: 3}
+	var firstFastq, firstTruth, secondFastq, secondTruth bytes.Buffer
+	if err := NewSimulator(format, sampleBarcodes, countedBarcodes, options).WriteFastq(&firstFastq, &firstTruth, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSimulator(format, sampleBarcodes, countedBarcodes, options).WriteFastq(&secondFastq, &secondTruth, nil); err != nil {
+		t.Fatal(err)
+	}
+	if firstFastq.String() != secondFastq.String() || firstTruth.String() != secondTruth.String() {
+		t.Error("the same seed created different reads")
+	}
+	if lines := strings.Count(firstFastq.String(), "\n"); lines != 4*options.Reads {
+		t.Errorf("fastq has %v lines, want %v", lines, 4*options.Reads)
+	}
+	truth := strings.Split(firstTruth.String(), "\n")
+	if truth[0] != "Read,Type,Sample,Barcode_1,Barcode_2,Random,Substitutions,Insertions,Deletions" || len(truth) != options.Reads+1 {
+		t.Errorf("truth table header = %v with %v rows", truth[0], len(truth)-1)
+	}
+	for _, readType := range []string{",target,", ",duplicate,", ",chimera,", ",off_target,"} {
+		if !strings.Contains(firstTruth.String(), readType) {
+			t.Errorf("truth table does not have a %v read", readType)
+		}
+	}
+}
+
+func TestChimeraBreakpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		chimeras bool
+	}{
+		{"two variable regions", "AGCTAGCT{8}CCTGA{8}GGACTTTTTGCA\n", true},
+		// a chimera needs a variable region from each molecule, so a single variable region does not make chimeras
+		{"one variable region", "AGCTAGCT{8}CCTGAGGACTTTTTGCA\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, err := input.ParseSequenceFormat(strings.NewReader(test.format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := Options{Reads: 200, Seed: 3, ChimeraRate: 0.5}
+			var truth bytes.Buffer
+			if err := NewSimulator(format, input.SampleBarcodes{}, input.CountedBarcodes{}, options).WriteFastq(&bytes.Buffer{}, &truth, nil); err != nil {
+				t.Fatal(err)
+			}
+			if chimeras := strings.Contains(truth.String(), ",chimera,"); chimeras != test.chimeras {
+				t.Errorf("truth table has chimera reads = %v, want %v", chimeras, test.chimeras)
+			}
+		})
+	}
+}
+
+func TestPerfectReadsAccuracy(t *testing.T) {
+	format, sampleBarcodes, countedBarcodes := testInputs(t)
+	maxErrors := results.NewMaxErrors(-1, -1, -1, format)
+	evaluator := NewEvaluator(parse.NewParser(format, sampleBarcodes, countedBarcodes, maxErrors, input.NewAnchorMatcher(format)), format)
+	options := Options{Reads: 500, Seed: 1, DuplicationRate: 0.2, Flank: 5}
+	if err := NewSimulator(format, sampleBarcodes, countedBarcodes, options).WriteFastq(&bytes.Buffer{}, nil, evaluator); err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range evaluator.Accuracy() {
+		if stage.Recall() != 1 || stage.Precision() != 1 {
+			t.Errorf("%v recall = %v, precision = %v, want 1", stage.Stage, stage.Recall(), stage.Precision())
+		}
+	}
+}
+
+func TestErrorReadsAccuracy(t *testing.T) {
+	format, sampleBarcodes, countedBarcodes := testInputs(t)
+	maxErrors := results.NewMaxErrors(-1, -1, -1, format)
+	evaluator := NewEvaluator(parse.NewParser(format, sampleBarcodes, countedBarcodes, maxErrors, input.NewAnchorMatcher(format)), format)
+	options := Options{Reads: 5000, Seed: 1, SubstitutionRate: 0.01, DuplicationRate: 0.3, ChimeraRate: 0.02, OffTargetRate: 0.05, Flank: 5}
+	if err := NewSimulator(format, sampleBarcodes, countedBarcodes, options).WriteFastq(&bytes.Buffer{}, nil, evaluator); err != nil {
+		t.Fatal(err)
+	}
+	accuracy := evaluator.Accuracy()
+	if len(accuracy) != 4 {
+		t.Fatalf("%v stages, want constant, sample, counted and duplicate", len(accuracy))
+	}
+	for _, stage := range accuracy {
+		// chimeras can not be told apart from real library members, and duplicates with an error within the random barcode are
+		// counted as new molecules, so the precision of the later stages is lower
+		if stage.Recall() < 0.9 || stage.Precision() < 0.85 {
+			t.Errorf("%v recall = %.4f, precision = %.4f", stage.Stage, stage.Recall(), stage.Precision())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package timing measures the time spent within each stage of the count so that the throughput of each stage can be
+// reported within the run summary
+package timing
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stage is a timed stage of the count
+type Stage int
+
+const (
+	// Read is reading and decompressing the fastq file
+	Read Stage = iota
+	// Match is the search for the sequence format within each read by the anchor or regex matcher
+	Match
+	// FixConstant is fixing the constant region of reads which the matcher did not match, including the second search
+	FixConstant
+	// FixSequence is error correcting a sample or counted barcode which is not within the barcode files
+	FixSequence
+	// AddCount is adding the barcodes of a matched read to the counts
+	AddCount
+	stageNum
+)
+
+// String returns the name of the stage used within the run summary
+func (s Stage) String() string {
+	switch s {
+	case Read:
+		return "ReadFastq"
+	case Match:
+		return "match"
+	case FixConstant:
+		return "fixConstant"
+	case FixSequence:
+		return "fixSequence"
+	default:
+		return "AddCount"
+	}
+}
+
+// Stages returns every stage in the order of the run summary
+func Stages() []Stage {
+	stages := make([]Stage, 0, stageNum)
+	for stage := Stage(0); stage < stageNum; stage++ {
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// Timer sums the time spent within each stage by a single goroutine, so that the hot path does not need a lock.  A nil
+// Timer does not measure anything, which lets the stages be timed without checking whether the stage timers are on
+type Timer struct {
+	elapsed [stageNum]time.Duration
+	calls   [stageNum]int
+}
+
+// Start returns the start time of a stage, or the zero time when the Timer is nil
+func (t *Timer) Start() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Stop adds the time since start to the stage as a single call
+func (t *Timer) Stop(stage Stage, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.elapsed[stage] += time.Since(start)
+	t.calls[stage]++
+}
+
+// Add adds elapsed time and calls to the stage.  This is used when a stage is timed separately from its calls, such as
+// the reads of the fastq file
+func (t *Timer) Add(stage Stage, elapsed time.Duration, calls int) {
+	if t == nil {
+		return
+	}
+	t.elapsed[stage] += elapsed
+	t.calls[stage] += calls
+}
+
+// AddEvery is the number of reads between the Adds of a running goroutine's Timer
+const AddEvery = 10000
+
+// StageTimes holds the sum of the Timers from every goroutine.  A nil StageTimes is used when the stage timers are off
+type StageTimes struct {
+	total Timer
+	mu    sync.Mutex
+}
+
+// NewTimer returns a Timer for a single goroutine, or nil when the StageTimes is nil
+func (s *StageTimes) NewTimer() *Timer {
+	if s == nil {
+		return nil
+	}
+	return &Timer{}
+}
+
+// Add adds the times of a goroutine's Timer, then resets the Timer.  Since the Timer is reset, a goroutine can add its times
+// while it runs, so that the stage times are up to date before every goroutine finishes
+func (s *StageTimes) Add(timer *Timer) {
+	if s == nil || timer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for stage := Stage(0); stage < stageNum; stage++ {
+		s.total.elapsed[stage] += timer.elapsed[stage]
+		s.total.calls[stage] += timer.calls[stage]
+	}
+	*timer = Timer{}
+}
+
+// Elapsed returns the total time of the stage summed over every goroutine
+func (s *StageTimes) Elapsed(stage Stage) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total.elapsed[stage]
+}
+
+// Calls returns the number of times the stage ran
+func (s *StageTimes) Calls(stage Stage) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total.calls[stage]
+}
+
+// PerSecond returns the number of calls of the stage which a single thread finishes per second, or 0 when the stage did
+// not run
+func (s *StageTimes) PerSecond(stage Stage) float64 {
+	elapsed := s.Elapsed(stage)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Calls(stage)) / elapsed.Seconds()
+}
+
+// Print outputs the calls, total time, and single thread calls per second of each stage.  The calls of ReadFastq,
+// match and AddCount are reads, while fixConstant and fixSequence only run on the reads and barcodes which need
+// error correction
+func (s *StageTimes) Print() {
+	fmt.Println("-STAGE TIMES-")
+	fmt.Printf("%-14v%12v%14v%16v\n", "Stage", "Calls", "Time", "Per second")
+	for stage := Stage(0); stage < stageNum; stage++ {
+		fmt.Printf("%-14v%12v%14v%16.0f\n", stage, s.Calls(stage), s.Elapsed(stage).Round(time.Millisecond), s.PerSecond(stage))
+	}
+	fmt.Println()
+}
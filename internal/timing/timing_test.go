@@ -0,0 +1,46 @@
+package timing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageTimes(t *testing.T) {
+	timings := &StageTimes{}
+	for i := 0; i < 2; i++ {
+		timer := timings.NewTimer()
+		timer.Add(Read, time.Second, 10)
+		timer.Stop(Match, timer.Start())
+		timings.Add(timer)
+	}
+	if calls, elapsed := timings.Calls(Read), timings.Elapsed(Read); calls != 20 || elapsed != 2*time.Second {
+		t.Errorf("ReadFastq = %v calls in %v, want 20 calls in 2s", calls, elapsed)
+	}
+	// the Timer is reset by Add, so adding it again while the goroutine runs does not count its times twice
+	timer := timings.NewTimer()
+	timer.Add(Read, time.Second, 10)
+	timings.Add(timer)
+	timings.Add(timer)
+	if calls := timings.Calls(Read); calls != 30 {
+		t.Errorf("ReadFastq = %v calls after adding a Timer twice, want 30", calls)
+	}
+	if perSecond := timings.PerSecond(Read); perSecond != 10 {
+		t.Errorf("ReadFastq per second = %v, want 10", perSecond)
+	}
+	if calls := timings.Calls(Match); calls != 2 {
+		t.Errorf("match calls = %v, want 2", calls)
+	}
+	if perSecond := timings.PerSecond(AddCount); perSecond != 0 {
+		t.Errorf("AddCount per second = %v without any calls, want 0", perSecond)
+	}
+
+	// a nil StageTimes turns the timers off
+	var off *StageTimes
+	timer = off.NewTimer()
+	timer.Stop(Match, timer.Start())
+	timer.Add(Read, time.Second, 1)
+	off.Add(timer)
+	if timer != nil {
+		t.Error("nil StageTimes created a Timer")
+	}
+}
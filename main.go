@@ -1,44 +1,134 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
+	"runtime/pprof"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Roco-scientist/barcode-count-go/internal/arguments"
+	"github.com/Roco-scientist/barcode-count-go/internal/checkpoint"
 	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/logging"
+	"github.com/Roco-scientist/barcode-count-go/internal/metrics"
 	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+	"github.com/Roco-scientist/barcode-count-go/internal/progress"
 	"github.com/Roco-scientist/barcode-count-go/internal/results"
+	"github.com/Roco-scientist/barcode-count-go/internal/timing"
 )
 
 func main() {
 	args := arguments.GetArgs()
+	switch args.Command {
+	case arguments.ValidateCommand:
+		runValidate(args)
+	case arguments.InspectCommand:
+		runInspect(args)
+	case arguments.MergeCommand:
+		runMerge(args)
+	case arguments.SimulateCommand:
+		runSimulate(args)
+	default:
+		runCount(args)
+	}
+}
+
+// runCount counts the barcodes within the fastq file and writes the count files.  SIGINT or SIGTERM stops the count, which then
+// exits with status 1 after the reads counted so far are written when --write-partial is used
+func runCount(args arguments.Args) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// once the first signal is caught, the signals are reset so that a second signal stops the program straight away
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	complete, err := countReads(ctx, args)
+	if err != nil {
+		stop()
+		logging.Fatal(err)
+	}
+	if !complete {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// countReads counts the barcodes within the fastq file and writes the count files.  Once ctx is done, reading stops and the
+// parsing threads drain the reads already posted.  The counts so far are then written with an INCOMPLETE_ prefix when
+// --write-partial is used, and the checkpoint is kept so that the count can be resumed.  complete is false when the count was
+// stopped before every read was counted and written.  Errors are returned rather than exiting, so that the deferred CPU
+// profile and metrics server are stopped first
+func countReads(ctx context.Context, args arguments.Args) (complete bool, err error) {
 	runtime.GOMAXPROCS(args.Threads)
 	// start is used to measure the compute and total time of the algorithm
 	start := time.Now()
 
+	// the CPU profile covers the whole count so that it can be viewed with 'go tool pprof'
+	if args.CPUProfile != "" {
+		profileFile, err := os.Create(args.CPUProfile)
+		if err != nil {
+			return false, err
+		}
+		if err := pprof.StartCPUProfile(profileFile); err != nil {
+			return false, err
+		}
+		defer profileFile.Close()
+		defer pprof.StopCPUProfile()
+	}
+
+	// timings holds the time of each parsing stage when the stage timers are on.  The nil StageTimes does not time anything
+	var timings *timing.StageTimes
+	if args.StageTimers {
+		timings = &timing.StageTimes{}
+	}
+
 	// wg is passed to each thread to make sure to wait for completion
 	var wg sync.WaitGroup
 
-	// formatInfo contains all information for barcode and sequencing format.  This is
-	// used for regex searches and general information
-	var formatInfo input.SequenceFormat
-	formatInfo.AddSearchRegex(args.FormatPath)
+	inputs, err := loadInputs(args)
+	if err != nil {
+		return false, err
+	}
+	formatInfo, sampleBarcodes, countedBarcodes, crisprLibrary := inputs.format, inputs.sampleBarcodes, inputs.countedBarcodes, inputs.crisprLibrary
 	formatInfo.Print()
 
-	// sampleBarcodes contains conversion information for the sample barcodes  This is used in all parsing
-	// threads for sequencing error correction and while writing to csv to convert for the final file
-	sampleBarcodes := input.NewSampleBarcodes(args.SampleBarcodesPath)
-
-	// countedBarcodes contains conversion information for the counted barcodes.  This is used in all parsing
-	// threads for sequencing error correction and while writing to csv to convert for the final file
-	countedBarcodes := input.NewCountedBarcodes(args.CountedBarcodesPath, formatInfo.CountedBarcodeNum)
-
 	// counts is the struct that is used to keep track of how many matches
 	counts := results.NewCount(sampleBarcodes.Barcodes)
 
+	// library contains the expected library members.  This is used to write zero count rows and a library coverage summary
+	if args.ZeroCounts {
+		library, err := input.NewLibrary(args.LibraryMembersPath, countedBarcodes)
+		if err != nil {
+			return false, err
+		}
+		library.Print()
+		counts.AddLibrary(library)
+	}
+
+	// the control sample is used for normalized enrichment statistics within the merged output
+	if args.ControlSample != "" {
+		counts.AddControl(args.ControlSample)
+	}
+
+	// the counts are spilled to disk once --memory-budget is reached, and merged once every read is counted
+	if args.MemoryBudget != "" {
+		budget, err := arguments.ParseMemorySize(args.MemoryBudget)
+		if err != nil {
+			return false, err
+		}
+		if err := counts.SetMemoryBudget(budget, args.SpillDir); err != nil {
+			return false, err
+		}
+	}
+
 	// seqErrors keeps track of all of the sequencing errors within the sequencing reads
 	var seqErrors results.ParseErrors
 
@@ -46,33 +136,237 @@ func main() {
 	// 20% of the lenght of any of the barcodes, but changes if any of the --max-errors flags are called
 	maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, formatInfo)
 	maxErrors.Print()
+	if err := checkBarcodeDesign(inputs, maxErrors, args.RequireSafeErrors); err != nil {
+		return false, err
+	}
 
-	// sequences is the channel for which the reading thread post sequences, and the parsing threads pull sequences
-	sequences := make(chan string)
+	// parser finds and error corrects the barcodes within each read.  It is shared by all of the parsing threads
+	matcher, err := input.NewMatcher(args.Matcher, formatInfo)
+	if err != nil {
+		return false, err
+	}
+	parser := parse.NewParser(formatInfo, sampleBarcodes, countedBarcodes, maxErrors, matcher)
+	if args.ExpectedStart != -1 {
+		parser.LimitConstantOffsets(args.ExpectedStart, args.StartTolerance)
+	}
 
-	// reader thread
+	// sequences is the channel for which the reading thread post sequences, and the parsing threads pull sequences.  It is
+	// buffered so that the reading thread can decompress ahead of the parsing threads
+	sequences := make(chan input.Read, args.Threads*1024)
+
+	// reader thread.  readErr receives any error from reading the fastq file, which is checked once all threads finish.  A
+	// channel is used because ReadFastq marks wg done before its error is returned
+	readErr := make(chan error, 1)
+	// totalReads and skippedRecords are set by the reader thread, and are read once readErr is received
+	var totalReads, skippedRecords int
+	readOptions := input.ReadOptions{
+		Tags:       input.BarcodeTags{Sample: args.SampleTag, Random: args.RandomTag},
+		Validation: input.Validation(args.FastqValidation),
+		Skipped:    func(*input.RecordError) { skippedRecords++ },
+	}
+	// the counts are saved every --checkpoint-every reads, and restored from the last checkpoint with --resume
+	if args.Checkpoint != "" {
+		if err := setupCheckpoints(ctx, args, counts, &seqErrors, &readOptions); err != nil {
+			return false, err
+		}
+	}
+	// reporter reports the reads per second, percent of the reads file read, time left and pass rates on stderr
+	reporter := progress.NewReporter(progress.ResolveMode(args.Progress, os.Stderr), os.Stderr,
+		time.Duration(args.ProgressInterval)*time.Second, fastqSize(args.FastqPath), &seqErrors)
+	readOptions.Progress = reporter.Update
+	// the Prometheus metrics are served from the same counters while counting and writing, when --metrics-addr is used
+	if args.MetricsAddr != "" {
+		countMetrics := metrics.New(&seqErrors, timings, sequences)
+		server, err := metrics.Serve(args.MetricsAddr, countMetrics)
+		if err != nil {
+			return false, err
+		}
+		defer server.Close()
+		readOptions.Progress = func(totalReads int, bytesRead int64) {
+			reporter.Update(totalReads, bytesRead)
+			countMetrics.Update(totalReads, bytesRead)
+		}
+	}
+	reporter.Start()
 	wg.Add(1)
-	go input.ReadFastq(args.FastqPath, sequences, &wg)
+	go func() {
+		var err error
+		totalReads, err = input.ReadFastq(ctx, args.FastqPath, readOptions, sequences, &wg, timings)
+		readErr <- err
+	}()
 
 	// parsing threads.  Using 3x the number of threads as using 1x tended to underutilize the cores.  With GO thread scheduler
 	// this should be safe as long as GOMAXPROCS is set
 	for i := 1; i < (args.Threads * 3); i++ {
 		wg.Add(1)
-		go parse.ParseSequences(sequences, &wg, counts, formatInfo, sampleBarcodes, countedBarcodes, &seqErrors, maxErrors)
+		go parse.ParseSequences(ctx, sequences, &wg, counts, parser, &seqErrors, timings)
 	}
 
 	// wait for all threads to finish
 	wg.Wait()
+	interrupted := ctx.Err() != nil
+	if err := <-readErr; err != nil && !(interrupted && errors.Is(err, ctx.Err())) {
+		reporter.Stop()
+		return false, err
+	}
+	// the reporter is stopped before anything else is printed, so that the progress line is finished
+	if interrupted && !args.WritePartial {
+		reporter.Stop()
+		counts.DiscardSpills()
+		logging.Warn("Count stopped before every read was counted", "reads_counted", seqErrors.Summary().Reads())
+		return false, nil
+	}
+	// the random barcode duplicates found while merging the spilled counts are moved from the correct reads before the summary
+	if err := counts.MergeSpills(&seqErrors); err != nil {
+		reporter.Stop()
+		return false, err
+	}
+	// the merged counts are written from the count runs, so they are only removed once every count file is written
+	defer counts.DiscardSpills()
+	reporter.Stop()
+	if interrupted {
+		logging.Warn("Count stopped before every read was counted", "reads_counted", seqErrors.Summary().Reads())
+	}
+	fmt.Printf("Total reads:                 %v\n", totalReads)
+	if skippedRecords != 0 {
+		fmt.Printf("Malformed records skipped:   %v\n", skippedRecords)
+	}
 	seqErrors.Print()
+	if timings != nil {
+		timings.Print()
+	}
+	// the heap profile is written before the counts so that it shows the memory held by the counts
+	if args.MemProfile != "" {
+		if err := writeMemProfile(args.MemProfile); err != nil {
+			return false, err
+		}
+	}
 
 	compTime := elapsedTime(start)
 	fmt.Printf("Compute time: %v\n\n", compTime)
 
 	fmt.Println("-WRITING COUNTS-")
-	counts.WriteCsv(args.OutputDir, args.MergeOutput, args.Enrich, countedBarcodes, sampleBarcodes)
+	// the partial counts of a stopped count are written in full with an INCOMPLETE_ prefix, so the done ctx is not used
+	outpath, writeCtx := args.OutputDir, ctx
+	if interrupted {
+		outpath += "INCOMPLETE_"
+		writeCtx = context.Background()
+		logging.Warn("Writing the partial counts", "prefix", outpath)
+	}
+	if err := counts.WriteCsv(writeCtx, outpath, args.MergeOutput, args.EnrichSizes, countedBarcodes, sampleBarcodes); err != nil {
+		if errors.Is(err, context.Canceled) {
+			logging.Warn("Count stopped while the counts were written, so the count files are incomplete")
+			return false, nil
+		}
+		return false, err
+	}
+	if crisprLibrary.Included {
+		if err := counts.WriteCrispr(outpath, crisprLibrary, sampleBarcodes); err != nil {
+			return false, err
+		}
+	}
+	// the resolved config is written next to the counts so that the run can be repeated with --config
+	if _, err := arguments.WriteConfig(args, args.OutputDir); err != nil {
+		return false, err
+	}
+
+	// the checkpoint is removed once the counts are written, so that it is not resumed after the run finished.  It is kept
+	// after partial counts so that the count can be resumed
+	if args.Checkpoint != "" && !interrupted {
+		if err := os.Remove(args.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
 
 	totTime := elapsedTime(start)
 	fmt.Printf("Total time: %v\n", totTime)
+	return !interrupted, nil
+}
+
+// setupCheckpoints adds the checkpoints to the read options, and restores the counts and the position within the reads file
+// from the last checkpoint when resuming.  A checkpoint which fails to write is a warning, as the count can still finish.  No
+// checkpoint is written once ctx is done, as the parsing threads stop counting
+func setupCheckpoints(ctx context.Context, args arguments.Args, counts *results.Counts, seqErrors *results.ParseErrors, readOptions *input.ReadOptions) error {
+	reads, err := checkpoint.NewInput(args.FastqPath)
+	if err != nil {
+		return err
+	}
+	settings := checkpoint.Settings{
+		SampleErrors:    args.SampleErrors,
+		CountedErrors:   args.BarcodesErrors,
+		ConstantErrors:  args.ConstantErrors,
+		ExpectedStart:   args.ExpectedStart,
+		StartTolerance:  args.StartTolerance,
+		SampleTag:       args.SampleTag,
+		RandomTag:       args.RandomTag,
+		FastqValidation: args.FastqValidation,
+	}
+	// the sequence format and barcode files are hashed, so that a checkpoint is not resumed once one is edited
+	for _, file := range []struct {
+		path    string
+		setting *checkpoint.File
+	}{
+		{args.FormatPath, &settings.Format},
+		{args.SampleBarcodesPath, &settings.SampleBarcodes},
+		{args.CountedBarcodesPath, &settings.CountedBarcodes},
+		{args.CrisprLibraryPath, &settings.CrisprLibrary},
+	} {
+		if *file.setting, err = checkpoint.NewFile(file.path); err != nil {
+			return err
+		}
+	}
+	if args.Resume {
+		saved, err := checkpoint.Read(args.Checkpoint)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			logging.Info("No checkpoint, starting from the first read", "checkpoint", args.Checkpoint)
+		case err != nil:
+			return err
+		default:
+			if err := saved.Check(reads, settings); err != nil {
+				return fmt.Errorf("%v: %w", args.Checkpoint, err)
+			}
+			counts.Restore(saved.Counts)
+			seqErrors.Restore(saved.Errors)
+			readOptions.Skip = saved.Reads
+			logging.Info("Resuming from the checkpoint", "checkpoint", args.Checkpoint, "reads", saved.Reads)
+		}
+	}
+	writer := checkpoint.NewWriter(args.Checkpoint, reads, settings, counts, seqErrors)
+	readOptions.CheckpointEvery = args.CheckpointEvery
+	readOptions.Checkpoint = func(totalReads int) {
+		if err := writer.Write(ctx, totalReads); err != nil && ctx.Err() == nil {
+			logging.Warn("Checkpoint not written", "reads", totalReads, "error", err)
+		}
+	}
+	return nil
+}
+
+// fastqSize returns the size of the reads file for the progress reports, or 0 for stdin, where the size is not known
+func fastqSize(fastqPath string) int64 {
+	if fastqPath == input.StdinPath {
+		return 0
+	}
+	info, err := os.Stat(fastqPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// writeMemProfile writes the pprof heap profile to profilePath.  Garbage collection is run first so that the profile only
+// holds live memory
+func writeMemProfile(profilePath string) error {
+	profileFile, err := os.Create(profilePath)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(profileFile); err != nil {
+		profileFile.Close()
+		return fmt.Errorf("%v: %w", profilePath, err)
+	}
+	return profileFile.Close()
 }
 
 // elapsedTime returns the time elapsed as a string in the format '# hours # minutes #.### seconds'
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Roco-scientist/barcode-count-go/internal/arguments"
+	"github.com/Roco-scientist/barcode-count-go/internal/input"
+	"github.com/Roco-scientist/barcode-count-go/internal/parse"
+	"github.com/Roco-scientist/barcode-count-go/internal/results"
+)
+
+var update = flag.Bool("update", false, "update the golden files within testdata")
+
+// outputFiles returns the csv files written to outDir.  The key is the file name without the date prefix
+func outputFiles(t *testing.T, outDir string) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(outDir, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := make(map[string]string)
+	for _, file := range files {
+		base := filepath.Base(file)
+		outputs[base[strings.Index(base, "_")+1:]] = file
+	}
+	return outputs
+}
+
+// compareGolden compares each output file to the golden file of the same name within goldenDir, and checks that there are
+// not any missing or extra output files.  The golden files are rewritten when -update is used
+func compareGolden(t *testing.T, outDir string, goldenDir string) {
+	t.Helper()
+	outputs := outputFiles(t, outDir)
+	if *update {
+		if err := os.RemoveAll(goldenDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(goldenDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goldenFiles, err := filepath.Glob(filepath.Join(goldenDir, "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*update {
+		var gotNames, wantNames []string
+		for name := range outputs {
+			gotNames = append(gotNames, name)
+		}
+		for _, goldenFile := range goldenFiles {
+			wantNames = append(wantNames, filepath.Base(goldenFile))
+		}
+		sort.Strings(gotNames)
+		sort.Strings(wantNames)
+		if strings.Join(gotNames, " ") != strings.Join(wantNames, " ") {
+			t.Fatalf("output files = %v, want %v", gotNames, wantNames)
+		}
+	}
+	for name, outputFile := range outputs {
+		got, err := os.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		goldenPath := filepath.Join(goldenDir, name)
+		if *update {
+			if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%v differs from %v\ngot:\n%s\nwant:\n%s", name, goldenPath, got, want)
+		}
+	}
+}
+
+// TestCountGolden runs the count subcommand from the sequence format and FASTQ files through to the written counts for each
+// fixture within testdata/count.  Each fixture is run with both matchers, which must write the same counts
+func TestCountGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		// sampleBarcodes is whether the fixture has a samples.csv
+		sampleBarcodes bool
+		fastq          string
+		setArgs        func(args *arguments.Args)
+	}{
+		{"random_barcodes", true, "reads.fastq.gz", func(args *arguments.Args) {
+			args.MergeOutput = true
+		}},
+		// sam_tags is random_barcodes written to SAM with the sample and random barcodes within tags, so it has the same golden
+		// counts
+		{"sam_tags", true, "reads.sam", func(args *arguments.Args) {
+			args.MergeOutput = true
+			args.SampleTag = "BC"
+			args.RandomTag = "RX"
+		}},
+		// sam_missing_random_tag is the start of sam_tags, with the RX tag removed from simulated_1 and left empty within
+		// simulated_4.  Neither read is counted
+		{"sam_missing_random_tag", true, "reads.sam", func(args *arguments.Args) {
+			args.MergeOutput = true
+			args.SampleTag = "BC"
+			args.RandomTag = "RX"
+		}},
+		{"no_sample_file", false, "reads.fastq", func(args *arguments.Args) {}},
+		{"merge", true, "reads.fastq", func(args *arguments.Args) {
+			args.MergeOutput = true
+			args.ControlSample = "Sample_1"
+			args.ZeroCounts = true
+		}},
+		{"enrich", true, "reads.fastq", func(args *arguments.Args) {
+			args.MergeOutput = true
+			args.Enrich = true
+			args.EnrichSizes = []int{1, 2}
+		}},
+	}
+	for _, test := range tests {
+		for _, matcher := range []string{input.AnchorMatcherName, input.RegexMatcherName} {
+			t.Run(test.name+"/"+matcher, func(t *testing.T) {
+				fixtureDir := filepath.Join("testdata", "count", test.name)
+				outDir := t.TempDir() + string(os.PathSeparator)
+				args := arguments.Args{
+					Command:             arguments.CountCommand,
+					FastqPath:           filepath.Join(fixtureDir, test.fastq),
+					FormatPath:          filepath.Join(fixtureDir, "scheme.txt"),
+					CountedBarcodesPath: filepath.Join(fixtureDir, "counted.csv"),
+					OutputDir:           outDir,
+					Threads:             2,
+					BarcodesErrors:      -1,
+					SampleErrors:        -1,
+					ConstantErrors:      -1,
+					Matcher:             matcher,
+					ExpectedStart:       -1,
+				}
+				if test.sampleBarcodes {
+					args.SampleBarcodesPath = filepath.Join(fixtureDir, "samples.csv")
+				}
+				test.setArgs(&args)
+				runCount(args)
+				compareGolden(t, outDir, filepath.Join(fixtureDir, "golden"))
+			})
+		}
+	}
+}
+
+// TestCountSpill counts the fixtures with a memory budget small enough to spill the counts to disk many times.  The merged
+// counts must match the golden files of the in-memory counts
+func TestCountSpill(t *testing.T) {
+	for _, fixture := range []string{"random_barcodes", "merge", "enrich"} {
+		t.Run(fixture, func(t *testing.T) {
+			fixtureDir := filepath.Join("testdata", "count", fixture)
+			fastq := "reads.fastq"
+			if fixture == "random_barcodes" {
+				fastq = "reads.fastq.gz"
+			}
+			outDir := t.TempDir() + string(os.PathSeparator)
+			spillDir := t.TempDir()
+			args := arguments.Args{
+				Command:             arguments.CountCommand,
+				FastqPath:           filepath.Join(fixtureDir, fastq),
+				FormatPath:          filepath.Join(fixtureDir, "scheme.txt"),
+				SampleBarcodesPath:  filepath.Join(fixtureDir, "samples.csv"),
+				CountedBarcodesPath: filepath.Join(fixtureDir, "counted.csv"),
+				OutputDir:           outDir,
+				Threads:             2,
+				MergeOutput:         true,
+				BarcodesErrors:      -1,
+				SampleErrors:        -1,
+				ConstantErrors:      -1,
+				Matcher:             input.AnchorMatcherName,
+				ExpectedStart:       -1,
+				MemoryBudget:        "1K",
+				SpillDir:            spillDir,
+			}
+			switch fixture {
+			case "merge":
+				args.ControlSample = "Sample_1"
+				args.ZeroCounts = true
+			case "enrich":
+				args.Enrich = true
+				args.EnrichSizes = []int{1, 2}
+			}
+			runCount(args)
+			compareGolden(t, outDir, filepath.Join(fixtureDir, "golden"))
+			if runs, err := os.ReadDir(spillDir); err != nil || len(runs) != 0 {
+				t.Errorf("spill directory holds %v count runs, want none", len(runs))
+			}
+		})
+	}
+}
+
+// TestCountInterrupted counts with a ctx which is already done, as if SIGINT was caught before the first read.  The count
+// files are only written with --write-partial, and every file name starts with INCOMPLETE_
+func TestCountInterrupted(t *testing.T) {
+	fixtureDir := filepath.Join("testdata", "count", "merge")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, writePartial := range []bool{false, true} {
+		t.Run(fmt.Sprintf("write_partial_%v", writePartial), func(t *testing.T) {
+			outDir := t.TempDir() + string(os.PathSeparator)
+			args := arguments.Args{
+				Command:             arguments.CountCommand,
+				FastqPath:           filepath.Join(fixtureDir, "reads.fastq"),
+				FormatPath:          filepath.Join(fixtureDir, "scheme.txt"),
+				SampleBarcodesPath:  filepath.Join(fixtureDir, "samples.csv"),
+				CountedBarcodesPath: filepath.Join(fixtureDir, "counted.csv"),
+				OutputDir:           outDir,
+				Threads:             2,
+				MergeOutput:         true,
+				BarcodesErrors:      -1,
+				SampleErrors:        -1,
+				ConstantErrors:      -1,
+				Matcher:             input.AnchorMatcherName,
+				ExpectedStart:       -1,
+				ControlSample:       "Sample_1",
+				ZeroCounts:          true,
+				WritePartial:        writePartial,
+			}
+			complete, err := countReads(ctx, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if complete {
+				t.Error("countReads with a done ctx returned that every read was counted")
+			}
+			files, err := filepath.Glob(filepath.Join(outDir, "*.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			goldenFiles, err := filepath.Glob(filepath.Join(fixtureDir, "golden", "*.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFiles := 0
+			if writePartial {
+				wantFiles = len(goldenFiles)
+			}
+			if len(files) != wantFiles {
+				t.Errorf("%v count files written, want %v", len(files), wantFiles)
+			}
+			for _, file := range files {
+				if !strings.HasPrefix(filepath.Base(file), "INCOMPLETE_") {
+					t.Errorf("partial count file %v does not start with INCOMPLETE_", filepath.Base(file))
+				}
+			}
+		})
+	}
+}
+
+// TestCountErrorStopsProfile checks that a count which fails returns its error after the CPU profile is stopped and written
+func TestCountErrorStopsProfile(t *testing.T) {
+	fixtureDir := filepath.Join("testdata", "count", "merge")
+	outDir := t.TempDir() + string(os.PathSeparator)
+	profilePath := filepath.Join(outDir, "cpu.pprof")
+	args := arguments.Args{
+		Command:        arguments.CountCommand,
+		FastqPath:      filepath.Join(outDir, "missing.fastq"),
+		FormatPath:     filepath.Join(fixtureDir, "scheme.txt"),
+		OutputDir:      outDir,
+		Threads:        2,
+		BarcodesErrors: -1,
+		SampleErrors:   -1,
+		ConstantErrors: -1,
+		Matcher:        input.AnchorMatcherName,
+		ExpectedStart:  -1,
+		Progress:       "quiet",
+		CPUProfile:     profilePath,
+	}
+	if _, err := countReads(context.Background(), args); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("countReads of a missing reads file returned %v", err)
+	}
+	// a CPU profile still running can not be started again
+	if err := pprof.StartCPUProfile(io.Discard); err != nil {
+		t.Fatalf("CPU profile not stopped: %v", err)
+	}
+	pprof.StopCPUProfile()
+	if info, err := os.Stat(profilePath); err != nil || info.Size() == 0 {
+		t.Errorf("CPU profile not written: %v", err)
+	}
+}
+
+// TestCountMissingRandomTag parses the sam_missing_random_tag fixture, where one read has no RX tag and another has an empty
+// RX tag.  Both are random barcode tag errors rather than correct reads
+func TestCountMissingRandomTag(t *testing.T) {
+	fixtureDir := filepath.Join("testdata", "count", "sam_missing_random_tag")
+	args := arguments.Args{
+		FastqPath:           filepath.Join(fixtureDir, "reads.sam"),
+		FormatPath:          filepath.Join(fixtureDir, "scheme.txt"),
+		SampleBarcodesPath:  filepath.Join(fixtureDir, "samples.csv"),
+		CountedBarcodesPath: filepath.Join(fixtureDir, "counted.csv"),
+		BarcodesErrors:      -1,
+		SampleErrors:        -1,
+		ConstantErrors:      -1,
+		SampleTag:           "BC",
+		RandomTag:           "RX",
+	}
+	loaded, err := loadInputs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, loaded.format)
+	parser := parse.NewParser(loaded.format, loaded.sampleBarcodes, loaded.countedBarcodes, maxErrors, input.NewAnchorMatcher(loaded.format))
+	counts := results.NewCount(loaded.sampleBarcodes.Barcodes)
+	var seqErrors results.ParseErrors
+	readOptions := input.ReadOptions{Tags: input.BarcodeTags{Sample: args.SampleTag, Random: args.RandomTag}}
+	var wg sync.WaitGroup
+	sequences := make(chan input.Read)
+	wg.Add(2)
+	go input.ReadFastq(context.Background(), args.FastqPath, readOptions, sequences, &wg, nil)
+	go parse.ParseSequences(context.Background(), sequences, &wg, counts, parser, &seqErrors, nil)
+	wg.Wait()
+	summary := seqErrors.Summary()
+	if summary.Random != 2 || summary.Correct != 13 || summary.Reads() != 20 {
+		t.Errorf("%+v, want 2 random barcode tag errors and 13 correct reads of 20", summary)
+	}
+}
+
+// TestCountResume counts the merge fixture while keeping the first checkpoint, as if the run stopped after it, then resumes
+// from the checkpoint with runCount.  The resumed counts must match the golden files.  The fixture does not have a random
+// barcode, so any read counted twice changes the counts
+func TestCountResume(t *testing.T) {
+	fixtureDir := filepath.Join("testdata", "count", "merge")
+	outDir := t.TempDir() + string(os.PathSeparator)
+	args := arguments.Args{
+		Command:             arguments.CountCommand,
+		FastqPath:           filepath.Join(fixtureDir, "reads.fastq"),
+		FormatPath:          filepath.Join(fixtureDir, "scheme.txt"),
+		SampleBarcodesPath:  filepath.Join(fixtureDir, "samples.csv"),
+		CountedBarcodesPath: filepath.Join(fixtureDir, "counted.csv"),
+		OutputDir:           outDir,
+		Threads:             2,
+		BarcodesErrors:      -1,
+		SampleErrors:        -1,
+		ConstantErrors:      -1,
+		Matcher:             input.AnchorMatcherName,
+		ExpectedStart:       -1,
+		MergeOutput:         true,
+		ControlSample:       "Sample_1",
+		ZeroCounts:          true,
+		Checkpoint:          filepath.Join(t.TempDir(), "count.checkpoint"),
+		CheckpointEvery:     100,
+	}
+
+	loaded, err := loadInputs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxErrors := results.NewMaxErrors(args.SampleErrors, args.BarcodesErrors, args.ConstantErrors, loaded.format)
+	parser := parse.NewParser(loaded.format, loaded.sampleBarcodes, loaded.countedBarcodes, maxErrors, input.NewAnchorMatcher(loaded.format))
+	counts := results.NewCount(loaded.sampleBarcodes.Barcodes)
+	var seqErrors results.ParseErrors
+	var readOptions input.ReadOptions
+	if err := setupCheckpoints(context.Background(), args, counts, &seqErrors, &readOptions); err != nil {
+		t.Fatal(err)
+	}
+	firstCheckpoint := args.Checkpoint + ".first"
+	writeCheckpoint := readOptions.Checkpoint
+	readOptions.Checkpoint = func(totalReads int) {
+		writeCheckpoint(totalReads)
+		if totalReads == args.CheckpointEvery {
+			contents, err := os.ReadFile(args.Checkpoint)
+			if err == nil {
+				err = os.WriteFile(firstCheckpoint, contents, 0644)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	sequences := make(chan input.Read)
+	wg.Add(3)
+	go input.ReadFastq(context.Background(), args.FastqPath, readOptions, sequences, &wg, nil)
+	for i := 0; i < 2; i++ {
+		go parse.ParseSequences(context.Background(), sequences, &wg, counts, parser, &seqErrors, nil)
+	}
+	wg.Wait()
+	if err := os.Rename(firstCheckpoint, args.Checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := args
+	changed.Resume = true
+	changed.ConstantErrors = 0
+	if err := setupCheckpoints(context.Background(), changed, results.NewCount(nil), &results.ParseErrors{}, &input.ReadOptions{}); err == nil {
+		t.Error("resuming with different errors allowed did not return an error")
+	}
+
+	args.Resume = true
+	runCount(args)
+	compareGolden(t, outDir, filepath.Join(fixtureDir, "golden"))
+	if _, err := os.Stat(args.Checkpoint); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint %v was not removed once the counts were written", args.Checkpoint)
+	}
+}
+
+// TestCountResumeEditedBarcodes writes a checkpoint with copies of the merge fixture files, then edits the counted barcodes
+// file.  The edited file keeps its path, so the checkpoint must not be resumed
+func TestCountResumeEditedBarcodes(t *testing.T) {
+	fixtureDir := filepath.Join("testdata", "count", "merge")
+	dir := t.TempDir()
+	for _, name := range []string{"scheme.txt", "samples.csv", "counted.csv"} {
+		contents, err := os.ReadFile(filepath.Join(fixtureDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := arguments.Args{
+		Command:             arguments.CountCommand,
+		FastqPath:           filepath.Join(fixtureDir, "reads.fastq"),
+		FormatPath:          filepath.Join(dir, "scheme.txt"),
+		SampleBarcodesPath:  filepath.Join(dir, "samples.csv"),
+		CountedBarcodesPath: filepath.Join(dir, "counted.csv"),
+		BarcodesErrors:      -1,
+		SampleErrors:        -1,
+		ConstantErrors:      -1,
+		ExpectedStart:       -1,
+		Checkpoint:          filepath.Join(dir, "count.checkpoint"),
+		CheckpointEvery:     100,
+	}
+	var readOptions input.ReadOptions
+	if err := setupCheckpoints(context.Background(), args, results.NewCount(nil), &results.ParseErrors{}, &readOptions); err != nil {
+		t.Fatal(err)
+	}
+	// a checkpoint of 0 reads is written straight away, as every read before it is counted
+	readOptions.Checkpoint(0)
+
+	args.Resume = true
+	if err := setupCheckpoints(context.Background(), args, results.NewCount(nil), &results.ParseErrors{}, &input.ReadOptions{}); err != nil {
+		t.Fatalf("resuming with the same files returned %v", err)
+	}
+	counted, err := os.ReadFile(args.CountedBarcodesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(string(counted), "BB1_1", "BB1_9", 1)
+	if err := os.WriteFile(args.CountedBarcodesPath, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = setupCheckpoints(context.Background(), args, results.NewCount(nil), &results.ParseErrors{}, &input.ReadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "counted barcodes file changed") {
+		t.Errorf("resuming after the counted barcodes file was edited returned %v", err)
+	}
+}
+
+// TestMergeGolden runs the merge subcommand on the golden merged counts of two of the count fixtures
+func TestMergeGolden(t *testing.T) {
+	outDir := t.TempDir() + string(os.PathSeparator)
+	args := arguments.Args{
+		Command: arguments.MergeCommand,
+		MergeInputs: []string{
+			filepath.Join("testdata", "count", "random_barcodes", "golden", "counts.all.csv"),
+			filepath.Join("testdata", "count", "merge", "golden", "counts.all.csv"),
+			filepath.Join("testdata", "count", "merge", "golden", "Sample_2_counts.csv"),
+		},
+		OutputDir: outDir,
+	}
+	runMerge(args)
+	compareGolden(t, outDir, filepath.Join("testdata", "merge", "golden"))
+}